@@ -0,0 +1,189 @@
+// Package client calls the receipt processor API over HTTP
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go-fetch/receipt"
+)
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+}
+
+type Option func(*Client)
+
+// Uses the given HTTP client rather than a default one with a 10 second
+// timeout
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// Sets the timeout on whichever HTTP client the client ends up using, so
+// it applies to one passed to WithHTTPClient before it too
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = timeout
+	}
+}
+
+// Sends the given token as a bearer token, which the server requires to
+// process receipts when it's configured with API_TOKENS
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// The base URL is the scheme and host the server is listening on, like
+// "http://localhost:8000"
+func NewClient(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Returned for any non-2xx response, decoded from the error body the
+// server sends
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"error"`
+	RequestId  string `json:"requestId"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Submits the receipt for processing, returning the ID it was stored under
+func (c *Client) ProcessReceipt(
+	ctx context.Context,
+	r receipt.Receipt,
+) (string, error) {
+	requestBody, err := json.Marshal(r)
+
+	if err != nil {
+		return "", err
+	}
+
+	var responseBody struct {
+		ReceiptId string `json:"id"`
+	}
+
+	err = c.do(
+		ctx,
+		http.MethodPost,
+		"/receipts/process",
+		requestBody,
+		&responseBody,
+	)
+
+	return responseBody.ReceiptId, err
+}
+
+// Returns the points awarded for the receipt with the given ID. While a server
+// that processes receipts asynchronously is still computing them, the error
+// is an *Error with the RECEIPT_PENDING code
+func (c *Client) GetPoints(ctx context.Context, id string) (int64, error) {
+	var responseBody struct {
+		Points int64 `json:"points"`
+		// Only set by the 202 sent while the points are pending
+		Code    string `json:"code"`
+		Message string `json:"error"`
+	}
+
+	err := c.do(
+		ctx,
+		http.MethodGet,
+		"/receipts/"+url.PathEscape(id)+"/points",
+		nil,
+		&responseBody,
+	)
+
+	if err == nil && responseBody.Code != "" {
+		return 0, &Error{
+			StatusCode: http.StatusAccepted,
+			Code:       responseBody.Code,
+			Message:    responseBody.Message,
+		}
+	}
+
+	return responseBody.Points, err
+}
+
+// Sends the request and unmarshals a successful response body into the
+// given pointer, or the error body into an *Error otherwise
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	path string,
+	requestBody []byte,
+	responseBody any,
+) error {
+	var body io.Reader
+
+	if requestBody != nil {
+		body = bytes.NewReader(requestBody)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Accept", "application/json")
+
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	response, err := c.httpClient.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	responseBodyBytes, err := io.ReadAll(response.Body)
+
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		apiError := &Error{StatusCode: response.StatusCode}
+
+		if json.Unmarshal(responseBodyBytes, apiError) != nil {
+			apiError.Message = strings.TrimSpace(string(responseBodyBytes))
+		}
+
+		return apiError
+	}
+
+	return json.Unmarshal(responseBodyBytes, responseBody)
+}
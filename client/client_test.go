@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-fetch/receipt"
+)
+
+const cornerMarketReceipt = `{
+	"retailer": "M&M Corner Market",
+	"purchaseDate": "2022-03-20",
+	"purchaseTime": "14:33",
+	"items": [{"shortDescription": "Gatorade", "price": "9.00"}],
+	"total": "9.00"
+}`
+
+func TestProcessReceipt(t *testing.T) {
+	var r receipt.Receipt
+
+	if err := receipt.Unmarshal([]byte(cornerMarketReceipt), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, request *http.Request) {
+			body, err := io.ReadAll(request.Body)
+			var submitted receipt.Receipt
+
+			if err == nil {
+				err = receipt.Unmarshal(body, &submitted)
+			}
+
+			if err != nil ||
+				request.Method != http.MethodPost ||
+				request.URL.Path != "/receipts/process" ||
+				request.Header.Get("Content-Type") != "application/json" ||
+				request.Header.Get("Authorization") != "Bearer secret" ||
+				submitted.Retailer != r.Retailer {
+				t.Errorf(
+					"unexpected request %s %s: %s",
+					request.Method,
+					request.URL,
+					body,
+				)
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": "7fb1377b-b223-49d9-a31a-5a02701dd310"}`))
+		},
+	))
+	defer server.Close()
+
+	c := NewClient(server.URL+"/", WithToken("secret"))
+	id, err := c.ProcessReceipt(context.Background(), r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != "7fb1377b-b223-49d9-a31a-5a02701dd310" {
+		t.Errorf("processed as %q", id)
+	}
+}
+
+func TestGetPoints(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		body           string
+		expectedPoints int64
+		// The code of the *Error expected, if any
+		expectedCode string
+	}{
+		{"found", http.StatusOK, `{"points": 109}`, 109, ""},
+		{
+			"not found",
+			http.StatusNotFound,
+			`{"error": "No receipt found for that ID.", ` +
+				`"code": "RECEIPT_NOT_FOUND"}`,
+			0,
+			"RECEIPT_NOT_FOUND",
+		},
+		{
+			"pending",
+			http.StatusAccepted,
+			`{"error": "The points are still being computed.", ` +
+				`"code": "RECEIPT_PENDING"}`,
+			0,
+			"RECEIPT_PENDING",
+		},
+		{"plain text error", http.StatusBadGateway, "Bad Gateway", 0, ""},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, request *http.Request) {
+				if request.URL.Path != "/receipts/abc/points" {
+					t.Errorf("%s: requested %s", test.name, request.URL)
+				}
+
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			},
+		))
+
+		points, err := NewClient(server.URL).GetPoints(
+			context.Background(),
+			"abc",
+		)
+		server.Close()
+
+		var apiError *Error
+
+		if test.status == http.StatusBadGateway {
+			if !errors.As(err, &apiError) ||
+				apiError.StatusCode != test.status ||
+				apiError.Message != test.body {
+				t.Errorf("%s: returned error %v", test.name, err)
+			}
+
+			continue
+		}
+
+		if test.expectedCode != "" {
+			if !errors.As(err, &apiError) ||
+				apiError.Code != test.expectedCode {
+				t.Errorf("%s: returned error %v", test.name, err)
+			}
+
+			continue
+		}
+
+		if err != nil || points != test.expectedPoints {
+			t.Errorf(
+				"%s: returned %d points with error %v",
+				test.name,
+				points,
+				err,
+			)
+		}
+	}
+}
@@ -3,8 +3,10 @@ module go-fetch
 go 1.21.4
 
 require (
-	github.com/ayaviri/goutils v0.0.0-20241025231750-40ea857db421 // indirect
-	github.com/felixge/httpsnoop v1.0.3 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/handlers v1.5.2 // indirect
+	github.com/ayaviri/goutils v0.0.0-20241025231750-40ea857db421
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/handlers v1.5.2
+	github.com/mattn/go-sqlite3 v1.14.52
 )
+
+require github.com/felixge/httpsnoop v1.0.3 // indirect
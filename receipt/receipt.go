@@ -0,0 +1,1179 @@
+// Package receipt holds the receipt schema along with the validation and
+// rules that decide the points a receipt is awarded
+package receipt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var retailerRegex *regexp.Regexp
+var descriptionRegex *regexp.Regexp
+var twoDecimalFloatRegex *regexp.Regexp
+var numberAmountRegex *regexp.Regexp
+var lenientAmountRegex *regexp.Regexp
+var formattedAmountRegex *regexp.Regexp
+var twentyFourHourTimeRegex *regexp.Regexp
+var twelveHourTimeRegex *regexp.Regexp
+
+func init() {
+	// No need to recompile these at every request time
+	retailerRegex = regexp.MustCompile("^[\\p{L}\\p{M}\\p{N}_\\s&\\-]+$")
+	descriptionRegex = regexp.MustCompile("^[\\w\\s\\-]+$")
+	twoDecimalFloatRegex = regexp.MustCompile("^\\d+\\.\\d{2}$")
+	numberAmountRegex = regexp.MustCompile("^\\d+(\\.\\d{1,2})?$")
+	lenientAmountRegex = regexp.MustCompile("^\\d+(\\.\\d+)?$")
+	// Separators have to group every three digits, so that "1,23.45" and
+	// "1.234,56" aren't mistaken for another amount
+	formattedAmountRegex = regexp.MustCompile(
+		"^\\$?(\\d{1,3}(,\\d{3})+|\\d+)(\\.\\d+)?$",
+	)
+	twentyFourHourTimeRegex = regexp.MustCompile("^\\d{2}:\\d{2}$")
+	twelveHourTimeRegex = regexp.MustCompile("^\\d{1,2}:\\d{2} [AP]M$")
+}
+
+//  __  __ ___ ____   ____   ____   ____ _   _ _____ __  __    _    ____
+// |  \/  |_ _/ ___| / ___| / ___| / ___| | | | ____|  \/  |  / \  / ___|
+// | |\/| || |\___ \| |     \___ \| |   | |_| |  _| | |\/| | / _ \ \___ \
+// | |  | || | ___) | |___   ___) | |___|  _  | |___| |  | |/ ___ \ ___) |
+// |_|  |_|___|____/ \____| |____/ \____|_| |_|_____|_|  |_/_/   \_\____/
+//
+
+// Retailer names may contain any Unicode letters and digits (along with the
+// combining marks of decomposed accented letters), which are counted by
+// alphanumericRetailerPoints. Symbols such as emoji are still rejected
+type Retailer string
+
+func (r *Retailer) UnmarshalJSON(data []byte) error {
+	str, err := obtainQuotedString(&data)
+
+	if err != nil {
+		return err
+	}
+
+	if !retailerRegex.MatchString(str) {
+		return errors.New("Invalid retailer name")
+	}
+
+	*r = Retailer(str)
+	return nil
+}
+
+// Layouts shared by the custom (un)marshallers below so that a receipt
+// marshalled back out matches the format it was submitted in
+const (
+	dateLayout = "2006-01-02"
+	timeLayout = "15:04"
+)
+
+// The layouts tried in order when unmarshalling a purchase date. Dates are
+// always marshalled with the first, canonical layout
+var DateLayouts = []string{dateLayout, "2006/01/02", "01-02-2006"}
+
+// Returns the canonical layout followed by the given layouts, without any
+// duplicates, so that configured layouts never stop canonical dates from
+// being accepted
+func DateLayoutsFrom(layouts []string) []string {
+	dateLayouts := []string{dateLayout}
+
+	for _, layout := range layouts {
+		if !slices.Contains(dateLayouts, layout) {
+			dateLayouts = append(dateLayouts, layout)
+		}
+	}
+
+	return dateLayouts
+}
+
+type Date time.Time
+
+func (d *Date) UnmarshalJSON(data []byte) error {
+	str, err := obtainQuotedString(&data)
+
+	if err != nil {
+		return err
+	}
+
+	for _, layout := range DateLayouts {
+		parsedDate, err := time.Parse(layout, str)
+
+		if err == nil {
+			*d = Date(parsedDate)
+			return nil
+		}
+	}
+
+	return errors.New("Invalid date format")
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(time.Time(d).Format(dateLayout))), nil
+}
+
+// When set, purchase times like "3:04 PM" are accepted as well as 24-hour
+// times like "15:04". Times are always marshalled as 24-hour times
+var TwelveHourTimes bool
+
+const twelveHourTimeLayout = "3:04 PM"
+
+type Time time.Time
+
+func (t *Time) UnmarshalJSON(data []byte) error {
+	str, err := obtainQuotedString(&data)
+
+	if err != nil {
+		return err
+	}
+
+	// time.Parse accepts single digit hours like "9:30" for the 24-hour
+	// layout, so the whole string is matched first
+	layout := timeLayout
+
+	if TwelveHourTimes && twelveHourTimeRegex.MatchString(str) {
+		layout = twelveHourTimeLayout
+	} else if !twentyFourHourTimeRegex.MatchString(str) {
+		return errors.New("Invalid time format")
+	}
+
+	var parsedTime time.Time
+	parsedTime, err = time.Parse(layout, str)
+
+	if err != nil {
+		return errors.New("Invalid time format")
+	}
+
+	*t = Time(parsedTime)
+	return nil
+}
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(time.Time(t).Format(timeLayout))), nil
+}
+
+// A dollar amount in integer cents, which unlike a float represents every two
+// decimal amount exactly
+type Amount int64
+
+// Ten trillion dollars, small enough that the prices of a receipt can't
+// overflow when they're summed
+const maxAmount Amount = 1e15
+
+// When set, amounts with any number of decimals are accepted and rounded to
+// the nearest cent, instead of only quoted amounts with exactly two decimals
+// and JSON numbers with at most two
+var LenientAmounts bool
+
+// When set, quoted amounts may start with a dollar sign and group their
+// digits with commas, like "$1,234.56", which are stripped before the amount
+// is validated
+var FormattedAmounts bool
+
+// Accepts both quoted amounts, like "6.49", and the JSON numbers many
+// producers send instead, like 6.49
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var str string
+	amountRegex := numberAmountRegex
+
+	if isQuotedString(string(data)) {
+		var err error
+		str, err = obtainQuotedString(&data)
+
+		if err != nil {
+			return err
+		}
+
+		if FormattedAmounts && formattedAmountRegex.MatchString(str) {
+			str = strings.TrimPrefix(str, "$")
+			str = strings.ReplaceAll(str, ",", "")
+		}
+
+		amountRegex = twoDecimalFloatRegex
+	} else {
+		str = string(data)
+	}
+
+	if LenientAmounts {
+		amountRegex = lenientAmountRegex
+	}
+
+	if !amountRegex.MatchString(str) {
+		return errors.New("Invalid amount")
+	}
+
+	amount, err := parseAmount(str)
+
+	if err != nil {
+		return err
+	}
+
+	*a = amount
+	return nil
+}
+
+// Parses a decimal amount matched by one of the amount regexes without going
+// through a float, rounding half up when it has more than two decimals
+func parseAmount(str string) (Amount, error) {
+	dollars, fraction, _ := strings.Cut(str, ".")
+	roundUp := len(fraction) > 2 && fraction[2] >= '5'
+	// Pads "6.4" out to "6.40", and cuts "6.499" down to "6.49"
+	fraction = (fraction + "00")[:2]
+	cents, err := strconv.ParseInt(dollars+fraction, 10, 64)
+
+	if roundUp {
+		cents++
+	}
+
+	// The regexes allow any number of digits
+	if err != nil || Amount(cents) > maxAmount {
+		return 0, errors.New("Amount is too large")
+	}
+
+	return Amount(cents), nil
+}
+
+func (a Amount) Cents() int64 {
+	return int64(a)
+}
+
+// Formats the amount with exactly two decimals, like "6.49"
+func (a Amount) String() string {
+	sign := ""
+	cents := int64(a)
+
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Always emits exactly two decimals, same as what twoDecimalFloatRegex accepts
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(a.String())), nil
+}
+
+type Receipt struct {
+	Retailer     Retailer `json:"retailer"`
+	PurchaseDate Date     `json:"purchaseDate"`
+	PurchaseTime Time     `json:"purchaseTime"`
+	Items        []Item   `json:"items"`
+	Total        Amount   `json:"total"`
+}
+
+type ValidationConfig struct {
+	// Rejects receipts whose total isn't the sum of their item prices
+	RequireMatchingTotal bool
+	// Rejects receipts purchased after today, in the local time zone
+	RejectFuturePurchaseDate bool
+	// Rejects receipts with more items than this, unless it's 0
+	MaxItems int
+	// Rejects receipts with items that cost nothing. Items that cost less
+	// than nothing are always rejected
+	RejectZeroPrices bool
+}
+
+// Checks the constraints on a receipt as a whole, its individual fields
+// having already been validated when it was unmarshalled. Returns the first
+// problem found
+func (r *Receipt) Validate(cfg ValidationConfig) error {
+	if problems := r.validationErrors(cfg, true); len(problems) > 0 {
+		return problems[0]
+	}
+
+	return nil
+}
+
+// A problem with a field of a receipt, like "retailer" or "items[1].price",
+// or with the receipt as a whole when Field is empty
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// Only the message, so that Validate returns the same errors it always has
+func (e FieldError) Error() string {
+	return e.Message
+}
+
+// Unmarshals the JSON receipt into r and checks it the same way Unmarshal and
+// then Validate would, except that every problem is returned rather than just
+// the first. The fields are unmarshalled one at a time, since their
+// unmarshallers stop at the first invalid field. Returns nil for a valid
+// receipt
+func (r *Receipt) ValidateAll(data []byte, cfg ValidationConfig) []error {
+	var fields struct {
+		Retailer     json.RawMessage `json:"retailer"`
+		PurchaseDate json.RawMessage `json:"purchaseDate"`
+		PurchaseTime json.RawMessage `json:"purchaseTime"`
+		Items        json.RawMessage `json:"items"`
+		Total        json.RawMessage `json:"total"`
+	}
+
+	if err := Unmarshal(data, &fields); err != nil {
+		return []error{FieldError{Message: err.Error()}}
+	}
+
+	var problems []error
+	// Missing fields are left as they are, the same as Unmarshal does
+	unmarshalField := func(field string, data json.RawMessage, v any) {
+		if data == nil {
+			return
+		}
+
+		if err := json.Unmarshal(data, v); err != nil {
+			problems = append(problems, FieldError{field, err.Error()})
+		}
+	}
+
+	unmarshalField("retailer", fields.Retailer, &r.Retailer)
+	unmarshalField("purchaseDate", fields.PurchaseDate, &r.PurchaseDate)
+	unmarshalField("purchaseTime", fields.PurchaseTime, &r.PurchaseTime)
+	unmarshalField("total", fields.Total, &r.Total)
+
+	var rawItems []json.RawMessage
+	unmarshalField("items", fields.Items, &rawItems)
+	r.Items = make([]Item, len(rawItems))
+
+	for index, rawItem := range rawItems {
+		field := fmt.Sprintf("items[%d]", index)
+		var itemFields struct {
+			Description json.RawMessage `json:"shortDescription"`
+			Price       json.RawMessage `json:"price"`
+		}
+
+		if err := Unmarshal(rawItem, &itemFields); err != nil {
+			problems = append(problems, FieldError{field, err.Error()})
+			continue
+		}
+
+		if itemFields.Price == nil {
+			problems = append(
+				problems,
+				FieldError{field + ".price", "Item is missing a price"},
+			)
+		}
+
+		unmarshalField(
+			field+".shortDescription",
+			itemFields.Description,
+			&r.Items[index].Description,
+		)
+		unmarshalField(field+".price", itemFields.Price, &r.Items[index].Price)
+	}
+
+	// Fields that couldn't be unmarshalled, or were missing, aren't checked
+	// again, nor are the fields of items that couldn't be, and the sum of the
+	// prices can't be trusted once any are
+	reported := make(map[string]bool)
+
+	for _, problem := range problems {
+		reported[problem.(FieldError).Field] = true
+	}
+
+	for _, problem := range r.validationErrors(cfg, len(problems) == 0) {
+		field := problem.(FieldError).Field
+		item, _, _ := strings.Cut(field, ".")
+
+		if !reported[field] && !reported[item] {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+// Collects every problem Validate checks for, in the order it checks for them.
+// The total is only compared with the sum of the prices when checkTotal is set
+func (r *Receipt) validationErrors(
+	cfg ValidationConfig,
+	checkTotal bool,
+) []error {
+	var problems []error
+
+	if len(r.Items) == 0 {
+		problems = append(problems, FieldError{
+			"items",
+			"Receipt must have at least one item",
+		})
+	}
+
+	if cfg.MaxItems > 0 && len(r.Items) > cfg.MaxItems {
+		problems = append(
+			problems,
+			FieldError{"items", "Receipt has too many items"},
+		)
+	}
+
+	for index, item := range r.Items {
+		field := fmt.Sprintf("items[%d]", index)
+
+		if strings.TrimSpace(string(item.Description)) == "" {
+			problems = append(problems, FieldError{
+				field + ".shortDescription",
+				"Item is missing a description",
+			})
+		}
+
+		// Unmarshalled prices can't be negative, but receipts built in Go
+		// could have any price
+		if item.Price < 0 {
+			problems = append(problems, FieldError{
+				field + ".price",
+				"Item price must not be negative",
+			})
+		}
+
+		if cfg.RejectZeroPrices && item.Price == 0 {
+			problems = append(problems, FieldError{
+				field + ".price",
+				"Item price must be positive",
+			})
+		}
+	}
+
+	if cfg.RequireMatchingTotal && checkTotal {
+		var itemsTotal int64 = 0
+
+		for _, item := range r.Items {
+			itemsTotal += item.Price.Cents()
+		}
+
+		if itemsTotal != r.Total.Cents() {
+			problems = append(problems, FieldError{
+				"total",
+				"Total does not match the sum of item prices",
+			})
+		}
+	}
+
+	if cfg.RejectFuturePurchaseDate {
+		// Purchase dates are parsed as midnight UTC, so today has to be too
+		now := time.Now()
+		today := time.Date(
+			now.Year(),
+			now.Month(),
+			now.Day(),
+			0, 0, 0, 0,
+			time.UTC,
+		)
+
+		if time.Time(r.PurchaseDate).After(today) {
+			problems = append(problems, FieldError{
+				"purchaseDate",
+				"Purchase date is in the future",
+			})
+		}
+	}
+
+	return problems
+}
+
+// The tunable constants of each points rule. DefaultRuleConfig reproduces
+// the rules as they were originally specified
+type RuleConfig struct {
+	RetailerCharacterPoints    int64   `json:"retailerCharacterPoints"`
+	RoundDollarPoints          int64   `json:"roundDollarPoints"`
+	TotalMultiple              float64 `json:"totalMultiple"`
+	TotalMultiplePoints        int64   `json:"totalMultiplePoints"`
+	ItemGroupSize              int     `json:"itemGroupSize"`
+	ItemGroupPoints            int64   `json:"itemGroupPoints"`
+	DescriptionLengthMultiple  int     `json:"descriptionLengthMultiple"`
+	DescriptionPriceMultiplier float64 `json:"descriptionPriceMultiplier"`
+	// How the price times the multiplier is rounded to whole points. Configs
+	// that leave it empty round up, like the original rule
+	DescriptionPriceRounding RoundingMode `json:"descriptionPriceRounding"`
+	OddDayPoints             int64        `json:"oddDayPoints"`
+	// The purchase hour must be at least the start hour and before the end
+	AfternoonStartHour int   `json:"afternoonStartHour"`
+	AfternoonEndHour   int   `json:"afternoonEndHour"`
+	AfternoonPoints    int64 `json:"afternoonPoints"`
+	// When set to a time zone like "America/Chicago", purchase times are
+	// taken to be in UTC and converted to it before their hour is checked
+	// against the afternoon hours. Otherwise they're checked as they are
+	PurchaseTimeZone string `json:"purchaseTimeZone"`
+	// Loaded from PurchaseTimeZone by LoadRuleConfig
+	purchaseLocation *time.Location
+	// Awarded when the total is more than the threshold
+	LargeTotalThreshold   float64 `json:"largeTotalThreshold"`
+	LargeTotalBonusPoints int64   `json:"largeTotalBonusPoints"`
+	// Awarded when there are at least as many items as the threshold, on top
+	// of the points for every group of items
+	ManyItemsThreshold   int   `json:"manyItemsThreshold"`
+	ManyItemsBonusPoints int64 `json:"manyItemsBonusPoints"`
+	// Keyed by retailer name, matched regardless of case
+	RetailerBonuses map[string]int64 `json:"retailerBonuses"`
+	// The fewest points a receipt needs to be in the silver or gold tier,
+	// below which it's in the bronze tier. Tiers don't affect the points
+	SilverTierPoints int64 `json:"silverTierPoints"`
+	GoldTierPoints   int64 `json:"goldTierPoints"`
+	// Keyed by the rule names of the points breakdown. Rules that are
+	// disabled are left out of the points and the breakdown, while rules
+	// missing from the map are enabled
+	EnabledRules map[string]bool `json:"enabledRules"`
+}
+
+type RoundingMode string
+
+const (
+	RoundingCeil  RoundingMode = "ceil"
+	RoundingFloor RoundingMode = "floor"
+	// Rounds to the nearest whole number, and halves up
+	RoundingRound RoundingMode = "round"
+)
+
+func DefaultRuleConfig() RuleConfig {
+	enabledRules := make(map[string]bool, len(pointsRules))
+
+	for _, rule := range pointsRules {
+		enabledRules[rule.name] = true
+	}
+
+	return RuleConfig{
+		RetailerCharacterPoints:    1,
+		RoundDollarPoints:          50,
+		TotalMultiple:              0.25,
+		TotalMultiplePoints:        25,
+		ItemGroupSize:              2,
+		ItemGroupPoints:            5,
+		DescriptionLengthMultiple:  3,
+		DescriptionPriceMultiplier: 0.2,
+		DescriptionPriceRounding:   RoundingCeil,
+		OddDayPoints:               6,
+		AfternoonStartHour:         14,
+		AfternoonEndHour:           16,
+		AfternoonPoints:            10,
+		PurchaseTimeZone:           "",
+		LargeTotalThreshold:        100,
+		LargeTotalBonusPoints:      0,
+		ManyItemsThreshold:         10,
+		ManyItemsBonusPoints:       0,
+		RetailerBonuses:            map[string]int64{},
+		SilverTierPoints:           100,
+		GoldTierPoints:             250,
+		EnabledRules:               enabledRules,
+	}
+}
+
+// Returns the names of every rule, in the order of the points breakdown
+func RuleNames() []string {
+	names := make([]string, 0, len(pointsRules))
+
+	for _, rule := range pointsRules {
+		names = append(names, rule.name)
+	}
+
+	return names
+}
+
+func (cfg RuleConfig) ruleEnabled(name string) bool {
+	enabled, exists := cfg.EnabledRules[name]
+
+	return !exists || enabled
+}
+
+// Reads the JSON rule config at the given path. Any constants it leaves out
+// keep their default values
+func LoadRuleConfig(path string) (RuleConfig, error) {
+	config := DefaultRuleConfig()
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(data, &config)
+
+	if err != nil {
+		return config, err
+	}
+
+	if centsFromDollars(config.TotalMultiple) <= 0 {
+		return config, errors.New("totalMultiple must be at least 0.01")
+	}
+
+	if config.ItemGroupSize <= 0 || config.DescriptionLengthMultiple <= 0 {
+		return config, errors.New(
+			"itemGroupSize and descriptionLengthMultiple must be positive",
+		)
+	}
+
+	switch config.DescriptionPriceRounding {
+	case RoundingCeil, RoundingFloor, RoundingRound:
+	default:
+		return config, errors.New(
+			"descriptionPriceRounding must be ceil, floor or round",
+		)
+	}
+
+	for name := range config.EnabledRules {
+		if !slices.Contains(RuleNames(), name) {
+			return config, fmt.Errorf("enabledRules has unknown rule %q", name)
+		}
+	}
+
+	// Retailers that only differ in case would both match the same receipts
+	retailers := make(map[string]bool, len(config.RetailerBonuses))
+
+	for retailer := range config.RetailerBonuses {
+		folded := strings.ToLower(retailer)
+
+		if retailers[folded] {
+			return config, fmt.Errorf(
+				"retailerBonuses has %q more than once, regardless of case",
+				retailer,
+			)
+		}
+
+		retailers[folded] = true
+	}
+
+	if config.PurchaseTimeZone != "" {
+		config.purchaseLocation, err = time.LoadLocation(
+			config.PurchaseTimeZone,
+		)
+
+		if err != nil {
+			return config, fmt.Errorf(
+				"purchaseTimeZone is not a known time zone: %w",
+				err,
+			)
+		}
+	}
+
+	if config.GoldTierPoints < config.SilverTierPoints {
+		return config, errors.New(
+			"goldTierPoints must be at least silverTierPoints",
+		)
+	}
+
+	return config, nil
+}
+
+// Returns the points awarded to the receipt under the original rules, for
+// programs that don't need to tune them
+func ComputePoints(r Receipt) int64 {
+	return r.ComputePoints(DefaultRuleConfig())
+}
+
+func (r *Receipt) ComputePoints(cfg RuleConfig) int64 {
+	return r.ComputePointsBreakdown(cfg).Total()
+}
+
+// The points rules in the order of the breakdown, by the names used in it
+var pointsRules = []struct {
+	name   string
+	points func(r *Receipt, cfg RuleConfig) int64
+}{
+	{"alphanumericRetailerPoints", (*Receipt).alphanumericRetailerPoints},
+	{"totalRoundDollarAmountPoints", (*Receipt).totalRoundDollarAmountPoints},
+	{"totalMultipleOf25CentsPoints", (*Receipt).totalMultipleOf25CentsPoints},
+	{"every2ItemsPoints", (*Receipt).every2ItemsPoints},
+	{"itemDescriptionLengthsPoints", (*Receipt).itemDescriptionLengthsPoints},
+	{"purchaseDayOddPoints", (*Receipt).purchaseDayOddPoints},
+	{
+		"purchaseTimeBetween2And4Points",
+		(*Receipt).purchaseTimeBetween2And4Points,
+	},
+	{"largeTotalBonusPoints", (*Receipt).largeTotalBonusPoints},
+	{"manyItemsBonusPoints", (*Receipt).manyItemsBonusPoints},
+	{"retailerBonusPoints", (*Receipt).retailerBonusPoints},
+}
+
+// Only the enabled rules are part of the breakdown
+func (r *Receipt) ComputePointsBreakdown(cfg RuleConfig) PointsBreakdown {
+	breakdown := make(PointsBreakdown, 0, len(pointsRules))
+
+	for _, rule := range pointsRules {
+		if cfg.ruleEnabled(rule.name) {
+			breakdown = append(
+				breakdown,
+				RulePoints{rule.name, rule.points(r, cfg)},
+			)
+		}
+	}
+
+	return breakdown
+}
+
+func (r *Receipt) alphanumericRetailerPoints(cfg RuleConfig) int64 {
+	return int64(r.alphanumericRetailerCharacters()) *
+		cfg.RetailerCharacterPoints
+}
+
+func (r *Receipt) totalRoundDollarAmountPoints(cfg RuleConfig) int64 {
+	if r.Total.Cents()%100 == 0 {
+		return cfg.RoundDollarPoints
+	} else {
+		return 0
+	}
+}
+
+func (r *Receipt) totalMultipleOf25CentsPoints(cfg RuleConfig) int64 {
+	if r.Total.Cents()%centsFromDollars(cfg.TotalMultiple) == 0 {
+		return cfg.TotalMultiplePoints
+	} else {
+		return 0
+	}
+}
+
+func (r *Receipt) every2ItemsPoints(cfg RuleConfig) int64 {
+	return cfg.ItemGroupPoints * int64(len(r.Items)/cfg.ItemGroupSize)
+}
+
+func (r *Receipt) itemDescriptionLengthsPoints(cfg RuleConfig) int64 {
+	var points int64 = 0
+
+	for _, item := range r.Items {
+		points += item.descriptionLengthPoints(cfg)
+	}
+
+	return points
+}
+
+// The points an item contributed to itemDescriptionLengthsPoints
+type ItemPoints struct {
+	Description   Description `json:"description"`
+	PointsAwarded int64       `json:"pointsAwarded"`
+}
+
+// Attributes the points of itemDescriptionLengthsPoints to each item, in the
+// order of the items. They add up to the points of the rule, so every item is
+// awarded 0 points when it's disabled
+func (r *Receipt) ComputeItemPoints(cfg RuleConfig) []ItemPoints {
+	itemPoints := make([]ItemPoints, 0, len(r.Items))
+	enabled := cfg.ruleEnabled("itemDescriptionLengthsPoints")
+
+	for _, item := range r.Items {
+		var points int64 = 0
+
+		if enabled {
+			points = item.descriptionLengthPoints(cfg)
+		}
+
+		itemPoints = append(itemPoints, ItemPoints{
+			Description:   item.Description,
+			PointsAwarded: points,
+		})
+	}
+
+	return itemPoints
+}
+
+// Descriptions are trimmed again for receipts that weren't unmarshalled
+func (i *Item) descriptionLengthPoints(cfg RuleConfig) int64 {
+	trimmedDescription := strings.TrimSpace(string(i.Description))
+
+	if len(trimmedDescription)%cfg.DescriptionLengthMultiple == 0 {
+		return roundDiv(
+			i.descriptionPriceMillionths(cfg),
+			1e6,
+			cfg.DescriptionPriceRounding,
+		)
+	} else {
+		return 0
+	}
+}
+
+// The price multiplied by the description price multiplier, in millionths of
+// a dollar. The multiplier is rounded to four decimals so that the points can
+// be computed in integers, from the price in cents
+func (i *Item) descriptionPriceMillionths(cfg RuleConfig) int64 {
+	multiplier := int64(math.Round(cfg.DescriptionPriceMultiplier * 1e4))
+
+	return i.Price.Cents() * multiplier
+}
+
+func (r *Receipt) purchaseDayOddPoints(cfg RuleConfig) int64 {
+	if time.Time(r.PurchaseDate).Day()%2 == 1 {
+		return cfg.OddDayPoints
+	} else {
+		return 0
+	}
+}
+
+func (r *Receipt) purchaseTimeBetween2And4Points(cfg RuleConfig) int64 {
+	purchaseHour := r.afternoonPurchaseTime(cfg).Hour()
+
+	if purchaseHour >= cfg.AfternoonStartHour &&
+		purchaseHour < cfg.AfternoonEndHour {
+		return cfg.AfternoonPoints
+	} else {
+		return 0
+	}
+}
+
+// Returns the purchase time in cfg.PurchaseTimeZone. It's combined with the
+// purchase date first, since the offset of a zone can depend on the date
+func (r *Receipt) afternoonPurchaseTime(cfg RuleConfig) time.Time {
+	purchaseTime := time.Time(r.PurchaseTime)
+
+	if cfg.PurchaseTimeZone == "" {
+		return purchaseTime
+	}
+
+	location := cfg.purchaseLocation
+
+	// Configs that weren't loaded by LoadRuleConfig, which rejects unknown
+	// zones, fall back to the time as it is
+	if location == nil {
+		var err error
+		location, err = time.LoadLocation(cfg.PurchaseTimeZone)
+
+		if err != nil {
+			return purchaseTime
+		}
+	}
+
+	purchaseDate := time.Time(r.PurchaseDate)
+
+	return time.Date(
+		purchaseDate.Year(),
+		purchaseDate.Month(),
+		purchaseDate.Day(),
+		purchaseTime.Hour(),
+		purchaseTime.Minute(),
+		0,
+		0,
+		time.UTC,
+	).In(location)
+}
+
+func (r *Receipt) largeTotalBonusPoints(cfg RuleConfig) int64 {
+	if r.Total.Cents() > centsFromDollars(cfg.LargeTotalThreshold) {
+		return cfg.LargeTotalBonusPoints
+	} else {
+		return 0
+	}
+}
+
+func (r *Receipt) manyItemsBonusPoints(cfg RuleConfig) int64 {
+	if len(r.Items) >= cfg.ManyItemsThreshold {
+		return cfg.ManyItemsBonusPoints
+	} else {
+		return 0
+	}
+}
+
+func (r *Receipt) retailerBonusPoints(cfg RuleConfig) int64 {
+	for retailer, points := range cfg.RetailerBonuses {
+		if strings.EqualFold(retailer, string(r.Retailer)) {
+			return points
+		}
+	}
+
+	return 0
+}
+
+// Explains the nonzero points of the breakdown line by line, in the wording of
+// the examples of the original challenge, followed by their total. The lines
+// are built from the breakdown and item points alone, as they were stored,
+// so they leave out the rule settings, which may have changed since
+func (r *Receipt) ExplainPoints(
+	breakdown PointsBreakdown,
+	itemPoints []ItemPoints,
+) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Total Points: %d\nBreakdown:\n", breakdown.Total())
+
+	writeLine := func(points int64, explanation string) {
+		fmt.Fprintf(&builder, "%6d points - %s\n", points, explanation)
+	}
+
+	for _, rulePoints := range breakdown {
+		if rulePoints.Points == 0 {
+			continue
+		}
+
+		switch rulePoints.Rule {
+		case "alphanumericRetailerPoints":
+			writeLine(rulePoints.Points, fmt.Sprintf(
+				"retailer name (%s) has %d alphanumeric characters",
+				r.Retailer,
+				r.alphanumericRetailerCharacters(),
+			))
+		case "totalRoundDollarAmountPoints":
+			writeLine(rulePoints.Points, "total is a round dollar amount")
+		case "totalMultipleOf25CentsPoints":
+			writeLine(rulePoints.Points, fmt.Sprintf(
+				"total of %s is a multiple of the rule's amount",
+				r.Total,
+			))
+		case "every2ItemsPoints":
+			writeLine(rulePoints.Points, fmt.Sprintf(
+				"%d items, counted in groups",
+				len(r.Items),
+			))
+		case "itemDescriptionLengthsPoints":
+			for _, item := range itemPoints {
+				if item.PointsAwarded == 0 {
+					continue
+				}
+
+				description := strings.TrimSpace(string(item.Description))
+				writeLine(item.PointsAwarded, fmt.Sprintf(
+					"%q is %d characters",
+					description,
+					len(description),
+				))
+			}
+		case "purchaseDayOddPoints":
+			writeLine(rulePoints.Points, "purchase day is odd")
+		case "purchaseTimeBetween2And4Points":
+			writeLine(rulePoints.Points, fmt.Sprintf(
+				"%s is in the afternoon hours",
+				time.Time(r.PurchaseTime).Format("3:04pm"),
+			))
+		case "largeTotalBonusPoints":
+			writeLine(rulePoints.Points, fmt.Sprintf(
+				"total of %s is above the rule's threshold",
+				r.Total,
+			))
+		case "manyItemsBonusPoints":
+			writeLine(rulePoints.Points, fmt.Sprintf(
+				"%d items, above the rule's threshold",
+				len(r.Items),
+			))
+		case "retailerBonusPoints":
+			writeLine(rulePoints.Points, fmt.Sprintf(
+				"retailer is %s",
+				r.Retailer,
+			))
+		default:
+			writeLine(rulePoints.Points, rulePoints.Rule)
+		}
+	}
+
+	fmt.Fprintf(&builder, "  + ---------\n  = %d points\n", breakdown.Total())
+
+	return builder.String()
+}
+
+func (r *Receipt) alphanumericRetailerCharacters() int {
+	characters := 0
+
+	for _, char := range r.Retailer {
+		if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			characters++
+		}
+	}
+
+	return characters
+}
+
+func hourOfDay(hour int) time.Time {
+	return time.Date(0, 1, 1, hour, 0, 0, 0, time.UTC)
+}
+
+type RulePoints struct {
+	Rule   string
+	Points int64
+}
+
+// The points awarded by each rule, in the order the rules are applied.
+// Marshalled as a JSON object from rule name to points, keeping that order
+type PointsBreakdown []RulePoints
+
+func (b PointsBreakdown) Total() int64 {
+	var total int64 = 0
+
+	for _, rulePoints := range b {
+		total += rulePoints.Points
+	}
+
+	return total
+}
+
+func (b PointsBreakdown) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+
+	for index, rulePoints := range b {
+		if index > 0 {
+			buffer.WriteByte(',')
+		}
+
+		buffer.WriteString(strconv.Quote(rulePoints.Rule))
+		buffer.WriteByte(':')
+		buffer.WriteString(strconv.FormatInt(rulePoints.Points, 10))
+	}
+
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// Decodes the object token by token, since unmarshalling into a map would
+// lose the order of the rules
+func (b *PointsBreakdown) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+
+	if err != nil {
+		return err
+	}
+
+	if delimiter, ok := token.(json.Delim); !ok || delimiter != '{' {
+		return errors.New("Points breakdown must be an object")
+	}
+
+	var breakdown PointsBreakdown
+
+	for decoder.More() {
+		token, err = decoder.Token()
+
+		if err != nil {
+			return err
+		}
+
+		var rulePoints RulePoints
+		rulePoints.Rule = token.(string)
+		err = decoder.Decode(&rulePoints.Points)
+
+		if err != nil {
+			return err
+		}
+
+		breakdown = append(breakdown, rulePoints)
+	}
+
+	*b = breakdown
+	return nil
+}
+
+// Leading and trailing whitespace is trimmed when unmarshalling, so that the
+// stored description is the one whose length is scored
+type Description string
+
+func (d *Description) UnmarshalJSON(data []byte) error {
+	str, err := obtainQuotedString(&data)
+
+	if err != nil {
+		return err
+	}
+
+	if !descriptionRegex.MatchString(str) {
+		return errors.New("Invalid item description")
+	}
+
+	*d = Description(strings.TrimSpace(str))
+	return nil
+}
+
+type Item struct {
+	Description Description `json:"shortDescription"`
+	Price       Amount      `json:"price"`
+}
+
+// Unmarshals through pointers first so that a missing price can be told
+// apart from a price of "0.00"
+func (i *Item) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Description *Description `json:"shortDescription"`
+		Price       *Amount      `json:"price"`
+	}
+
+	if err := Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if fields.Price == nil {
+		return errors.New("Item is missing a price")
+	}
+
+	if fields.Description != nil {
+		i.Description = *fields.Description
+	}
+
+	i.Price = *fields.Price
+	return nil
+}
+
+// When set, Unmarshal rejects receipts with fields that aren't part of the
+// Receipt or Item schemas, like a misspelled "retailor", instead of ignoring
+// them and leaving the intended field empty
+var DisallowUnknownFields bool
+
+// Unmarshals a receipt, or a value holding one, the same way json.Unmarshal
+// does, except for the handling of unknown fields set by DisallowUnknownFields
+func Unmarshal(data []byte, v any) error {
+	if !DisallowUnknownFields {
+		return json.Unmarshal(data, v)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+
+	// json.Unmarshal rejects anything after the value, so this does too
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("Unexpected data after the JSON value")
+	}
+
+	return nil
+}
+
+//  __  __ ___ ____   ____   _   _ _____ ___ _     ___ _____ ___ _____ ____
+// |  \/  |_ _/ ___| / ___| | | | |_   _|_ _| |   |_ _|_   _|_ _| ____/ ___|
+// | |\/| || |\___ \| |     | | | | | |  | || |    | |  | |  | ||  _| \___ \
+// | |  | || | ___) | |___  | |_| | | |  | || |___ | |  | |  | || |___ ___) |
+// |_|  |_|___|____/ \____|  \___/  |_| |___|_____|___| |_| |___|_____|____/
+//
+
+// Rounds a dollar amount of the rule config to the nearest integer number of
+// cents, to compare it with amounts
+func centsFromDollars(dollars float64) int64 {
+	return int64(math.Round(dollars * 100))
+}
+
+// Divides a by b, rounding as the mode says. a must not be negative and b
+// must be positive. Any mode other than floor or round rounds up
+func roundDiv(a int64, b int64, mode RoundingMode) int64 {
+	switch mode {
+	case RoundingFloor:
+		return a / b
+	case RoundingRound:
+		return (a + b/2) / b
+	default:
+		return (a + b - 1) / b
+	}
+}
+
+// Returns true if the length of the given string is at least 2 and
+// it is wrapped in double quotes
+func isQuotedString(s string) bool {
+	return len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"'
+}
+
+// 1) Converts the byte slice to a string
+// 2) Checks if the string is surrounded by double quotes
+// 3) Returns the string in between the double quotes, with any escapes
+// like the "\u0026" encoding/json writes for "&" decoded
+func obtainQuotedString(data *[]byte) (string, error) {
+	str := string(*data)
+
+	if !isQuotedString(str) {
+		return "", errors.New("Field must be a quoted string")
+	}
+
+	var unquoted string
+
+	if err := json.Unmarshal(*data, &unquoted); err != nil {
+		return "", errors.New("Field must be a quoted string")
+	}
+
+	return unquoted, nil
+}
@@ -0,0 +1,1771 @@
+package receipt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The receipts of the examples of the original challenge
+const targetReceipt = `{
+	"retailer": "Target",
+	"purchaseDate": "2022-01-01",
+	"purchaseTime": "13:01",
+	"items": [
+		{"shortDescription": "Mountain Dew 12PK", "price": "6.49"},
+		{"shortDescription": "Emils Cheese Pizza", "price": "12.25"},
+		{"shortDescription": "Knorr Creamy Chicken", "price": "1.26"},
+		{"shortDescription": "Doritos Nacho Cheese", "price": "3.35"},
+		{"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ", "price": "12.00"}
+	],
+	"total": "35.35"
+}`
+
+const cornerMarketReceipt = `{
+	"retailer": "M&M Corner Market",
+	"purchaseDate": "2022-03-20",
+	"purchaseTime": "14:33",
+	"items": [
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"}
+	],
+	"total": "9.00"
+}`
+
+func unmarshalTestReceipt(t *testing.T, data string) Receipt {
+	t.Helper()
+	var r Receipt
+
+	if err := Unmarshal([]byte(data), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestComputePointsBreakdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		receipt  string
+		expected map[string]int64
+	}{
+		{
+			"Target",
+			targetReceipt,
+			map[string]int64{
+				"alphanumericRetailerPoints":   6,
+				"every2ItemsPoints":            10,
+				"itemDescriptionLengthsPoints": 6,
+				"purchaseDayOddPoints":         6,
+			},
+		},
+		{
+			"M&M Corner Market",
+			cornerMarketReceipt,
+			map[string]int64{
+				"alphanumericRetailerPoints":     14,
+				"totalRoundDollarAmountPoints":   50,
+				"totalMultipleOf25CentsPoints":   25,
+				"every2ItemsPoints":              10,
+				"purchaseTimeBetween2And4Points": 10,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		r := unmarshalTestReceipt(t, test.receipt)
+		breakdown := r.ComputePointsBreakdown(DefaultRuleConfig())
+		var expectedTotal int64 = 0
+
+		for _, rulePoints := range breakdown {
+			expectedTotal += test.expected[rulePoints.Rule]
+
+			if rulePoints.Points != test.expected[rulePoints.Rule] {
+				t.Errorf(
+					"%s: %s awarded %d points, expected %d",
+					test.name,
+					rulePoints.Rule,
+					rulePoints.Points,
+					test.expected[rulePoints.Rule],
+				)
+			}
+		}
+
+		if !slices.Equal(ruleNamesOf(breakdown), RuleNames()) {
+			t.Errorf("%s: breakdown of %q", test.name, ruleNamesOf(breakdown))
+		}
+
+		if total := ComputePoints(r); total != expectedTotal {
+			t.Errorf(
+				"%s: %d points, expected %d",
+				test.name,
+				total,
+				expectedTotal,
+			)
+		}
+	}
+}
+
+func testTime(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+// Each rule under the default config, on a receipt that only awards points
+// for the retailer rule until a test changes it
+func TestPointsRules(t *testing.T) {
+	withTotal := func(total Amount) func(r *Receipt) {
+		return func(r *Receipt) { r.Total = total }
+	}
+
+	tests := []struct {
+		rule     string
+		change   func(r *Receipt)
+		expected int64
+	}{
+		{"alphanumericRetailerPoints", func(r *Receipt) {}, 1},
+		{
+			"alphanumericRetailerPoints",
+			func(r *Receipt) { r.Retailer = "M&M Corner Market" },
+			14,
+		},
+		{"totalRoundDollarAmountPoints", withTotal(900), 50},
+		{"totalRoundDollarAmountPoints", withTotal(901), 0},
+		{"totalMultipleOf25CentsPoints", withTotal(975), 25},
+		{"totalMultipleOf25CentsPoints", withTotal(910), 0},
+		{"every2ItemsPoints", func(r *Receipt) {}, 0},
+		{
+			"every2ItemsPoints",
+			func(r *Receipt) { r.Items = append(r.Items, r.Items[0]) },
+			5,
+		},
+		{
+			"every2ItemsPoints",
+			func(r *Receipt) {
+				r.Items = append(r.Items, r.Items[0], r.Items[0])
+			},
+			5,
+		},
+		{"itemDescriptionLengthsPoints", func(r *Receipt) {}, 0},
+		{
+			"itemDescriptionLengthsPoints",
+			func(r *Receipt) {
+				r.Items = []Item{
+					{Description: "Emils Cheese Pizza", Price: 1225},
+				}
+			},
+			3,
+		},
+		{
+			"itemDescriptionLengthsPoints",
+			func(r *Receipt) {
+				r.Items = []Item{
+					{Description: "   Klarbrunn 12-PK 12 FL OZ  ", Price: 1200},
+				}
+			},
+			3,
+		},
+		{"purchaseDayOddPoints", func(r *Receipt) {}, 0},
+		{
+			"purchaseDayOddPoints",
+			func(r *Receipt) {
+				r.PurchaseDate = Date(testTime(2022, 1, 1, 0, 0))
+			},
+			6,
+		},
+		{"purchaseTimeBetween2And4Points", func(r *Receipt) {}, 0},
+		{
+			"purchaseTimeBetween2And4Points",
+			func(r *Receipt) {
+				r.PurchaseTime = Time(testTime(0, 1, 1, 14, 33))
+			},
+			10,
+		},
+		{
+			"purchaseTimeBetween2And4Points",
+			func(r *Receipt) {
+				r.PurchaseTime = Time(testTime(0, 1, 1, 16, 0))
+			},
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		r := Receipt{
+			Retailer:     "T",
+			PurchaseDate: Date(testTime(2022, 1, 2, 0, 0)),
+			PurchaseTime: Time(testTime(0, 1, 1, 13, 1)),
+			Items:        []Item{{Description: "Gatorade", Price: 110}},
+			Total:        110,
+		}
+		test.change(&r)
+		breakdown := r.ComputePointsBreakdown(DefaultRuleConfig())
+		index := slices.Index(ruleNamesOf(breakdown), test.rule)
+
+		if index < 0 {
+			t.Errorf("%s is missing from the breakdown", test.rule)
+			continue
+		}
+
+		if breakdown[index].Points != test.expected {
+			t.Errorf(
+				"%s awarded %d points to %+v, expected %d",
+				test.rule,
+				breakdown[index].Points,
+				r,
+				test.expected,
+			)
+		}
+	}
+}
+
+// The afternoon hours are 2pm to 4pm in the zone, the purchase times being
+// taken to be in UTC. Chicago is 5 hours behind UTC in July and 6 in January
+func TestPurchaseTimeZone(t *testing.T) {
+	tests := []struct {
+		zone     string
+		month    time.Month
+		hour     int
+		minute   int
+		expected int64
+	}{
+		{"", time.July, 13, 59, 0},
+		{"", time.July, 14, 0, 10},
+		{"", time.July, 15, 59, 10},
+		{"", time.July, 16, 0, 0},
+		{"UTC", time.January, 13, 59, 0},
+		{"UTC", time.January, 14, 0, 10},
+		{"UTC", time.January, 15, 59, 10},
+		{"UTC", time.January, 16, 0, 0},
+		{"America/Chicago", time.July, 14, 0, 0},
+		{"America/Chicago", time.July, 18, 59, 0},
+		{"America/Chicago", time.July, 19, 0, 10},
+		{"America/Chicago", time.July, 20, 59, 10},
+		{"America/Chicago", time.July, 21, 0, 0},
+		{"America/Chicago", time.January, 19, 59, 0},
+		{"America/Chicago", time.January, 20, 0, 10},
+		{"America/Chicago", time.January, 21, 59, 10},
+		{"America/Chicago", time.January, 22, 0, 0},
+		{"Asia/Tokyo", time.July, 4, 59, 0},
+		{"Asia/Tokyo", time.July, 5, 0, 10},
+		{"Asia/Tokyo", time.July, 6, 59, 10},
+		{"Asia/Tokyo", time.July, 7, 0, 0},
+	}
+
+	for _, test := range tests {
+		config, err := LoadRuleConfig(writeTestRuleConfig(
+			t,
+			fmt.Sprintf(`{"purchaseTimeZone": %q}`, test.zone),
+		))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Configs built in Go load the zone when the rule is applied
+		unloaded := DefaultRuleConfig()
+		unloaded.PurchaseTimeZone = test.zone
+		r := Receipt{
+			PurchaseDate: Date(testTime(2022, test.month, 1, 0, 0)),
+			PurchaseTime: Time(testTime(0, 1, 1, test.hour, test.minute)),
+		}
+
+		for _, cfg := range []RuleConfig{config, unloaded} {
+			points := r.purchaseTimeBetween2And4Points(cfg)
+
+			if points != test.expected {
+				t.Errorf(
+					"%02d:%02d in %s on %s 1 awarded %d points, expected %d",
+					test.hour,
+					test.minute,
+					test.zone,
+					test.month,
+					points,
+					test.expected,
+				)
+			}
+		}
+	}
+
+	path := writeTestRuleConfig(t, `{"purchaseTimeZone": "Mars/Olympus"}`)
+
+	if _, err := LoadRuleConfig(path); err == nil {
+		t.Error("loaded an unknown purchaseTimeZone")
+	}
+}
+
+func TestComputeItemPoints(t *testing.T) {
+	r := unmarshalTestReceipt(t, targetReceipt)
+	r.Items = append(
+		r.Items,
+		// Rounded up from a fraction of a cent
+		Item{Description: "ABC", Price: 1},
+		// Exactly a point, which mustn't be rounded up to 2
+		Item{Description: "ABCDEF", Price: 500},
+	)
+	expected := []int64{0, 3, 0, 0, 3, 1, 1}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		expected []int64
+	}{
+		{"enabled", true, expected},
+		{"disabled", false, make([]int64, len(expected))},
+	}
+
+	for _, test := range tests {
+		cfg := DefaultRuleConfig()
+		cfg.EnabledRules = map[string]bool{
+			"itemDescriptionLengthsPoints": test.enabled,
+		}
+		itemPoints := r.ComputeItemPoints(cfg)
+		var total int64 = 0
+
+		for index, points := range itemPoints {
+			total += points.PointsAwarded
+
+			if points.Description != r.Items[index].Description ||
+				points.PointsAwarded != test.expected[index] {
+				t.Errorf(
+					"%s: item %d awarded %+v, expected %d",
+					test.name,
+					index,
+					points,
+					test.expected[index],
+				)
+			}
+		}
+
+		if len(itemPoints) != len(r.Items) {
+			t.Errorf("%s: %d item points", test.name, len(itemPoints))
+		}
+
+		var ruleTotal int64 = 0
+
+		for _, rulePoints := range r.ComputePointsBreakdown(cfg) {
+			if rulePoints.Rule == "itemDescriptionLengthsPoints" {
+				ruleTotal = rulePoints.Points
+			}
+		}
+
+		if total != ruleTotal {
+			t.Errorf(
+				"%s: item points add up to %d, but the rule awarded %d",
+				test.name,
+				total,
+				ruleTotal,
+			)
+		}
+	}
+}
+
+// Worded like the examples of the original challenge, with a line for each
+// rule that awarded points
+func TestExplainPoints(t *testing.T) {
+	tests := []struct {
+		receipt  string
+		expected []string
+	}{
+		{
+			targetReceipt,
+			[]string{
+				"Total Points: 28",
+				"Breakdown:",
+				"     6 points - retailer name (Target) has 6 alphanumeric " +
+					"characters",
+				"    10 points - 5 items, counted in groups",
+				`     3 points - "Emils Cheese Pizza" is 18 characters`,
+				`     3 points - "Klarbrunn 12-PK 12 FL OZ" is 24 characters`,
+				"     6 points - purchase day is odd",
+				"  + ---------",
+				"  = 28 points",
+			},
+		},
+		{
+			cornerMarketReceipt,
+			[]string{
+				"Total Points: 109",
+				"Breakdown:",
+				"    14 points - retailer name (M&M Corner Market) has 14 " +
+					"alphanumeric characters",
+				"    50 points - total is a round dollar amount",
+				"    25 points - total of 9.00 is a multiple of the rule's " +
+					"amount",
+				"    10 points - 4 items, counted in groups",
+				"    10 points - 2:33pm is in the afternoon hours",
+				"  + ---------",
+				"  = 109 points",
+			},
+		},
+	}
+
+	cfg := DefaultRuleConfig()
+
+	for _, test := range tests {
+		r := unmarshalTestReceipt(t, test.receipt)
+		explanation := r.ExplainPoints(
+			r.ComputePointsBreakdown(cfg),
+			r.ComputeItemPoints(cfg),
+		)
+		expected := strings.Join(test.expected, "\n") + "\n"
+
+		if explanation != expected {
+			t.Errorf(
+				"%s explained as\n%s\nexpected\n%s",
+				r.Retailer,
+				explanation,
+				expected,
+			)
+		}
+	}
+}
+
+// Descriptions are stored trimmed, so that they're scored by the length
+// they're stored with
+func TestDescriptionWhitespace(t *testing.T) {
+	tests := []struct {
+		description string
+		expected    Description
+		points      int64
+	}{
+		{"Emils Cheese Pizza", "Emils Cheese Pizza", 3},
+		{"  Emils Cheese Pizza", "Emils Cheese Pizza", 3},
+		{"Emils Cheese Pizza \t", "Emils Cheese Pizza", 3},
+		{"\n Emils Cheese Pizza \n", "Emils Cheese Pizza", 3},
+		// Inner whitespace counts towards the length
+		{"Emils  Cheese Pizza", "Emils  Cheese Pizza", 0},
+		{"   Klarbrunn 12-PK 12 FL OZ  ", "Klarbrunn 12-PK 12 FL OZ", 3},
+		{" Gatorade ", "Gatorade", 0},
+	}
+
+	cfg := DefaultRuleConfig()
+
+	for _, test := range tests {
+		data, err := json.Marshal(map[string]string{
+			"shortDescription": test.description,
+			"price":            "12.25",
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var item Item
+
+		if err := json.Unmarshal(data, &item); err != nil {
+			t.Fatalf("%q: %v", test.description, err)
+		}
+
+		if item.Description != test.expected {
+			t.Errorf("%q stored as %q", test.description, item.Description)
+		}
+
+		trimmed := Item{Description: test.expected, Price: item.Price}
+		points := item.descriptionLengthPoints(cfg)
+
+		if points != test.points ||
+			points != trimmed.descriptionLengthPoints(cfg) {
+			t.Errorf("%q awarded %d points", test.description, points)
+		}
+
+		marshalled, err := json.Marshal(item)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedField := `"shortDescription":` +
+			strconv.Quote(string(test.expected))
+
+		if !strings.Contains(string(marshalled), expectedField) {
+			t.Errorf("%q marshalled as %s", test.description, marshalled)
+		}
+	}
+}
+
+func ruleNamesOf(breakdown PointsBreakdown) []string {
+	names := make([]string, 0, len(breakdown))
+
+	for _, rulePoints := range breakdown {
+		names = append(names, rulePoints.Rule)
+	}
+
+	return names
+}
+
+// Retailers are counted a character per letter or digit, in any script,
+// while symbols like emoji are rejected
+func TestRetailerUnmarshal(t *testing.T) {
+	tests := []struct {
+		retailer   string
+		valid      bool
+		characters int
+	}{
+		{"Target", true, 6},
+		{"M&M Corner Market", true, 14},
+		{"Café", true, 4},
+		{"Müller", true, 6},
+		// Decomposed, with a combining acute accent after the e
+		{"Cafe\u0301", true, 4},
+		{"東京堂", true, 3},
+		{"7-Eleven", true, 7},
+		{"Café ☕", false, 0},
+		{"Target 🎯", false, 0},
+		{"Target!", false, 0},
+		{"", false, 0},
+	}
+
+	for _, test := range tests {
+		var retailer Retailer
+		data, err := json.Marshal(test.retailer)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = json.Unmarshal(data, &retailer)
+
+		if (err == nil) != test.valid {
+			t.Errorf("%q unmarshalled with error %v", test.retailer, err)
+			continue
+		}
+
+		r := Receipt{Retailer: retailer}
+
+		if test.valid && r.alphanumericRetailerCharacters() != test.characters {
+			t.Errorf(
+				"%q counted %d characters, expected %d",
+				test.retailer,
+				r.alphanumericRetailerCharacters(),
+				test.characters,
+			)
+		}
+	}
+}
+
+func TestDateLayoutsFrom(t *testing.T) {
+	tests := []struct {
+		layouts  []string
+		expected []string
+	}{
+		{nil, []string{"2006-01-02"}},
+		{[]string{"02.01.2006"}, []string{"2006-01-02", "02.01.2006"}},
+		{
+			[]string{"02.01.2006", "2006-01-02", "02.01.2006"},
+			[]string{"2006-01-02", "02.01.2006"},
+		},
+	}
+
+	for _, test := range tests {
+		layouts := DateLayoutsFrom(test.layouts)
+
+		if !slices.Equal(layouts, test.expected) {
+			t.Errorf(
+				"%q gave %q, expected %q",
+				test.layouts,
+				layouts,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestUnmarshalDateWithConfiguredLayouts(t *testing.T) {
+	defaultLayouts := DateLayouts
+	DateLayouts = DateLayoutsFrom([]string{"02.01.2006"})
+	defer func() { DateLayouts = defaultLayouts }()
+
+	tests := []struct {
+		date     string
+		expected string
+		valid    bool
+	}{
+		{`"2022-01-31"`, `"2022-01-31"`, true},
+		{`"31.01.2022"`, `"2022-01-31"`, true},
+		{`"2022/01/31"`, "", false},
+		{`"31.13.2022"`, "", false},
+	}
+
+	for _, test := range tests {
+		var date Date
+		err := json.Unmarshal([]byte(test.date), &date)
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s unmarshalled with error %v", test.date, err)
+			continue
+		}
+
+		if !test.valid {
+			continue
+		}
+
+		marshalled, err := json.Marshal(date)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(marshalled) != test.expected {
+			t.Errorf(
+				"%s marshalled back as %s, expected %s",
+				test.date,
+				marshalled,
+				test.expected,
+			)
+		}
+	}
+}
+
+// Unmarshalling has to reject malformed receipts with an error rather than
+// panicking, and any amount it accepts has to be small enough for its cents
+// to be exact
+func FuzzReceiptUnmarshal(f *testing.F) {
+	f.Add([]byte(`{
+		"retailer": "M&M Corner Market",
+		"purchaseDate": "2022-03-20",
+		"purchaseTime": "14:33",
+		"items": [{"shortDescription": "Gatorade", "price": "2.25"}],
+		"total": "2.25"
+	}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var r Receipt
+
+		if err := Unmarshal(data, &r); err != nil {
+			return
+		}
+
+		amounts := []Amount{r.Total}
+
+		for _, item := range r.Items {
+			amounts = append(amounts, item.Price)
+		}
+
+		for _, amount := range amounts {
+			if amount < 0 || amount > maxAmount {
+				t.Errorf("accepted the amount %s", amount)
+			}
+		}
+
+		if r.Validate(ValidationConfig{}) == nil {
+			cfg := DefaultRuleConfig()
+			r.ExplainPoints(
+				r.ComputePointsBreakdown(cfg),
+				r.ComputeItemPoints(cfg),
+			)
+		}
+	})
+}
+
+func TestUnmarshalTime(t *testing.T) {
+	defer func(twelveHour bool) { TwelveHourTimes = twelveHour }(
+		TwelveHourTimes,
+	)
+
+	tests := []struct {
+		data       string
+		twelveHour bool
+		// As a 24-hour time, empty when the time is expected to be rejected
+		expected string
+	}{
+		{`"14:30"`, false, "14:30"},
+		{`"00:00"`, false, "00:00"},
+		{`"23:59"`, false, "23:59"},
+		{`"24:00"`, false, ""},
+		{`"14:60"`, false, ""},
+		{`"9:30"`, false, ""},
+		{`"14:30:00"`, false, ""},
+		{`"14:30 "`, false, ""},
+		{`" 14:30"`, false, ""},
+		{`"14:30pm"`, false, ""},
+		{`"3:04 PM"`, false, ""},
+		{`1430`, false, ""},
+		{`"3:04 PM"`, true, "15:04"},
+		{`"12:00 AM"`, true, "00:00"},
+		{`"12:30 PM"`, true, "12:30"},
+		{`"11:59 pm"`, true, ""},
+		{`"13:00 PM"`, true, ""},
+		{`"3:04PM"`, true, ""},
+		{`"14:30"`, true, "14:30"},
+	}
+
+	for _, test := range tests {
+		TwelveHourTimes = test.twelveHour
+		var parsed Time
+		err := json.Unmarshal([]byte(test.data), &parsed)
+		actual := ""
+
+		if err == nil {
+			actual = time.Time(parsed).Format("15:04")
+		}
+
+		if actual != test.expected {
+			t.Errorf(
+				"%s (twelve hour %t) unmarshalled as %q with error %v",
+				test.data,
+				test.twelveHour,
+				actual,
+				err,
+			)
+		}
+	}
+}
+
+func TestMarshalAmount(t *testing.T) {
+	tests := []struct {
+		amount   Amount
+		expected string
+	}{
+		{649, `"6.49"`},
+		{1200, `"12.00"`},
+		{5, `"0.05"`},
+		{0, `"0.00"`},
+	}
+
+	for _, test := range tests {
+		data, err := json.Marshal(test.amount)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != test.expected {
+			t.Errorf(
+				"%d cents marshalled as %s, expected %s",
+				test.amount,
+				data,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestUnmarshalAmount(t *testing.T) {
+	defer func(lenient bool) { LenientAmounts = lenient }(LenientAmounts)
+
+	tests := []struct {
+		data     string
+		lenient  bool
+		expected Amount
+		valid    bool
+	}{
+		{`"6.49"`, false, 649, true},
+		{`6.49`, false, 649, true},
+		{`6.4`, false, 640, true},
+		{`6`, false, 600, true},
+		{`0`, false, 0, true},
+		{`"6.4"`, false, 0, false},
+		{`"6"`, false, 0, false},
+		{`6.499`, false, 0, false},
+		{`-6.49`, false, 0, false},
+		{`6.49e2`, false, 0, false},
+		{`"six"`, false, 0, false},
+		{`true`, false, 0, false},
+		{`"6.4"`, true, 640, true},
+		{`6.499`, true, 650, true},
+		{`"6.494"`, true, 649, true},
+	}
+
+	for _, test := range tests {
+		LenientAmounts = test.lenient
+		var amount Amount
+		err := json.Unmarshal([]byte(test.data), &amount)
+
+		if (err == nil) != test.valid || amount != test.expected {
+			t.Errorf(
+				"%s (lenient %t) unmarshalled as %d cents with error %v",
+				test.data,
+				test.lenient,
+				amount,
+				err,
+			)
+		}
+	}
+}
+
+func TestUnmarshalFormattedAmount(t *testing.T) {
+	defer func(formatted bool) { FormattedAmounts = formatted }(
+		FormattedAmounts,
+	)
+
+	tests := []struct {
+		data      string
+		formatted bool
+		expected  Amount
+		valid     bool
+	}{
+		{`"$6.49"`, false, 0, false},
+		{`"1,234.56"`, false, 0, false},
+		{`"6.49"`, false, 649, true},
+		{`"$6.49"`, true, 649, true},
+		{`"1,234.56"`, true, 123456, true},
+		{`"$1,234,567.89"`, true, 123456789, true},
+		{`"6.49"`, true, 649, true},
+		{`6.49`, true, 649, true},
+		// Still two decimals
+		{`"$6.4"`, true, 0, false},
+		// Separators that don't group every three digits
+		{`"1,23.45"`, true, 0, false},
+		{`"1,2345.67"`, true, 0, false},
+		{`"1.234,56"`, true, 0, false},
+		{`"$$6.49"`, true, 0, false},
+		{`"6.49$"`, true, 0, false},
+		{`"$,123.00"`, true, 0, false},
+		{`"-$6.49"`, true, 0, false},
+		// Formatting only applies to quoted amounts
+		{`1,234.56`, true, 0, false},
+	}
+
+	for _, test := range tests {
+		FormattedAmounts = test.formatted
+		var amount Amount
+		err := json.Unmarshal([]byte(test.data), &amount)
+
+		if (err == nil) != test.valid || amount != test.expected {
+			t.Errorf(
+				"%s (formatted %t) unmarshalled as %d cents with error %v",
+				test.data,
+				test.formatted,
+				amount,
+				err,
+			)
+		}
+	}
+}
+
+// The dates, times and amounts of a receipt are marshalled back out exactly
+// as they were submitted
+func TestMarshalReceiptRoundTrip(t *testing.T) {
+	r := unmarshalTestReceipt(t, targetReceipt)
+	data, err := json.Marshal(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var submitted, marshalled map[string]any
+
+	if err := json.Unmarshal([]byte(targetReceipt), &submitted); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(data, &marshalled); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"purchaseDate", "purchaseTime", "total"} {
+		if marshalled[field] != submitted[field] {
+			t.Errorf(
+				"%s marshalled as %v, expected %v",
+				field,
+				marshalled[field],
+				submitted[field],
+			)
+		}
+	}
+
+	submittedItems := submitted["items"].([]any)
+	marshalledItems := marshalled["items"].([]any)
+
+	for index, item := range submittedItems {
+		price := item.(map[string]any)["price"]
+		marshalledPrice := marshalledItems[index].(map[string]any)["price"]
+
+		if marshalledPrice != price {
+			t.Errorf(
+				"items[%d].price marshalled as %v, expected %v",
+				index,
+				marshalledPrice,
+				price,
+			)
+		}
+	}
+
+	var again Receipt
+
+	if err := Unmarshal(data, &again); err != nil {
+		t.Fatalf("the marshalled receipt can't be unmarshalled: %v", err)
+	}
+}
+
+func TestValidateMatchingTotal(t *testing.T) {
+	items := []Item{
+		{Description: "Gatorade", Price: 225},
+		{Description: "Doritos", Price: 335},
+	}
+
+	tests := []struct {
+		name    string
+		total   Amount
+		require bool
+		valid   bool
+	}{
+		{"exact match", 560, true, true},
+		{"a cent short", 559, true, false},
+		{"a cent over", 561, true, false},
+		{"mismatch without the check", 100, false, true},
+	}
+
+	for _, test := range tests {
+		r := Receipt{Retailer: "Target", Items: items, Total: test.total}
+		err := r.Validate(ValidationConfig{RequireMatchingTotal: test.require})
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s: validated with error %v", test.name, err)
+		}
+	}
+}
+
+// Prices that don't add up exactly as floats, like 0.1 + 0.2, still have to
+// match their total to the cent
+func TestValidateMatchingTotalOfManyItems(t *testing.T) {
+	tests := []struct {
+		price string
+		count int
+		total string
+		valid bool
+	}{
+		{"0.10", 1000, "100.00", true},
+		{"0.01", 999, "9.99", true},
+		{"0.30", 3, "0.90", true},
+		{"1.10", 10, "11.00", true},
+		{"0.10", 1000, "100.01", false},
+		{"0.10", 1000, "99.99", false},
+	}
+
+	for _, test := range tests {
+		items := make([]string, test.count)
+
+		for index := range items {
+			items[index] = `{"shortDescription": "Gum", "price": "` +
+				test.price + `"}`
+		}
+
+		r := unmarshalTestReceipt(t, `{
+			"retailer": "Target",
+			"items": [`+strings.Join(items, ",")+`],
+			"total": "`+test.total+`"
+		}`)
+		err := r.Validate(ValidationConfig{RequireMatchingTotal: true})
+
+		if (err == nil) != test.valid {
+			t.Errorf(
+				"%d items of %s totalling %s validated with error %v",
+				test.count,
+				test.price,
+				test.total,
+				err,
+			)
+		}
+	}
+}
+
+func TestValidateItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		items string
+		valid bool
+	}{
+		{
+			"valid",
+			`[{"shortDescription": "Gatorade", "price": "2.25"}]`,
+			true,
+		},
+		{"empty items", `[]`, false},
+		{"missing items", ``, false},
+		{"missing price", `[{"shortDescription": "Gatorade"}]`, false},
+		{"missing description", `[{"price": "2.25"}]`, false},
+		{
+			"blank description",
+			`[{"shortDescription": "   ", "price": "2.25"}]`,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		data := `{"retailer": "Target", "total": "2.25"}`
+
+		if test.items != "" {
+			data = `{"retailer": "Target", "total": "2.25", "items": ` +
+				test.items + `}`
+		}
+
+		var r Receipt
+		err := Unmarshal([]byte(data), &r)
+
+		if err == nil {
+			err = r.Validate(ValidationConfig{})
+		}
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s: validated with error %v", test.name, err)
+		}
+	}
+}
+
+func TestValidateFuturePurchaseDate(t *testing.T) {
+	today := time.Now()
+
+	tests := []struct {
+		name         string
+		purchaseDate time.Time
+		reject       bool
+		valid        bool
+	}{
+		{"today", today, true, true},
+		{"yesterday", today.AddDate(0, 0, -1), true, true},
+		{"tomorrow", today.AddDate(0, 0, 1), true, false},
+		{"next year", today.AddDate(1, 0, 0), true, false},
+		{"tomorrow without the check", today.AddDate(0, 0, 1), false, true},
+	}
+
+	for _, test := range tests {
+		data := `{
+			"retailer": "Target",
+			"purchaseDate": "` + test.purchaseDate.Format("2006-01-02") + `",
+			"purchaseTime": "13:01",
+			"items": [{"shortDescription": "Gatorade", "price": "2.25"}],
+			"total": "2.25"
+		}`
+		r := unmarshalTestReceipt(t, data)
+		err := r.Validate(
+			ValidationConfig{RejectFuturePurchaseDate: test.reject},
+		)
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s: validated with error %v", test.name, err)
+		}
+	}
+}
+
+func TestValidateMaxItems(t *testing.T) {
+	tests := []struct {
+		items    int
+		maxItems int
+		valid    bool
+	}{
+		{3, 3, true},
+		{4, 3, false},
+		{1, 1, true},
+		{2, 1, false},
+		// No limit
+		{5000, 0, true},
+		// A long grocery run under the server's default limit
+		{200, 1000, true},
+		{1000, 1000, true},
+		{1001, 1000, false},
+	}
+
+	for _, test := range tests {
+		r := Receipt{Retailer: "Target", Total: Amount(225 * test.items)}
+
+		for len(r.Items) < test.items {
+			r.Items = append(r.Items, Item{Description: "Gatorade", Price: 225})
+		}
+
+		err := r.Validate(ValidationConfig{MaxItems: test.maxItems})
+
+		if (err == nil) != test.valid {
+			t.Errorf(
+				"%d items of at most %d validated with error %v",
+				test.items,
+				test.maxItems,
+				err,
+			)
+		}
+	}
+}
+
+func TestValidateItemPrice(t *testing.T) {
+	tests := []struct {
+		price            Amount
+		rejectZeroPrices bool
+		valid            bool
+	}{
+		{225, false, true},
+		{225, true, true},
+		{1, true, true},
+		{0, false, true},
+		{0, true, false},
+		{-1, false, false},
+		{-225, true, false},
+	}
+
+	for _, test := range tests {
+		r := Receipt{
+			Retailer: "Target",
+			Items:    []Item{{Description: "Gatorade", Price: test.price}},
+			Total:    225,
+		}
+		err := r.Validate(ValidationConfig{
+			RejectZeroPrices: test.rejectZeroPrices,
+		})
+		var fieldError FieldError
+
+		if (err == nil) != test.valid ||
+			err != nil &&
+				(!errors.As(err, &fieldError) ||
+					fieldError.Field != "items[0].price") {
+			t.Errorf(
+				"%s rejecting zero prices %t validated with error %v",
+				test.price,
+				test.rejectZeroPrices,
+				err,
+			)
+		}
+	}
+
+	// Negative prices don't get as far as Validate when unmarshalled
+	var r Receipt
+	err := Unmarshal([]byte(`{
+		"retailer": "Target",
+		"purchaseDate": "2022-01-01",
+		"purchaseTime": "13:01",
+		"items": [{"shortDescription": "Gatorade", "price": "-2.25"}],
+		"total": "-2.25"
+	}`), &r)
+
+	if err == nil {
+		t.Errorf("unmarshalled a negative price as %s", r.Items[0].Price)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	tests := []struct {
+		name           string
+		receipt        string
+		cfg            ValidationConfig
+		expectedFields []string
+	}{
+		{
+			"valid",
+			`{
+				"retailer": "Target",
+				"purchaseDate": "2022-01-01",
+				"purchaseTime": "13:01",
+				"items": [{"shortDescription": "Gatorade", "price": "2.25"}],
+				"total": "2.25"
+			}`,
+			ValidationConfig{RequireMatchingTotal: true},
+			nil,
+		},
+		{
+			"every field",
+			`{
+				"retailer": "Target!",
+				"purchaseDate": "2022-13-01",
+				"purchaseTime": "25:00",
+				"items": [],
+				"total": "2.2"
+			}`,
+			ValidationConfig{},
+			[]string{
+				"retailer",
+				"purchaseDate",
+				"purchaseTime",
+				"total",
+				"items",
+			},
+		},
+		{
+			"items",
+			`{
+				"retailer": "Target",
+				"purchaseDate": "2022-01-01",
+				"purchaseTime": "13:01",
+				"items": [
+					{"shortDescription": "Gatorade"},
+					{"shortDescription": "Gatorade!", "price": "2.25"},
+					{"shortDescription": " ", "price": "0.00"},
+					42
+				],
+				"total": "2.25"
+			}`,
+			ValidationConfig{
+				RequireMatchingTotal: true,
+				RejectZeroPrices:     true,
+			},
+			[]string{
+				"items[0].price",
+				"items[1].shortDescription",
+				"items[3]",
+				"items[2].shortDescription",
+				"items[2].price",
+			},
+		},
+		{
+			"total mismatch",
+			`{
+				"retailer": "Target",
+				"purchaseDate": "2022-01-01",
+				"purchaseTime": "13:01",
+				"items": [
+					{"shortDescription": "Gatorade", "price": "2.25"},
+					{"shortDescription": "Gatorade", "price": "2.25"}
+				],
+				"total": "2.25"
+			}`,
+			ValidationConfig{RequireMatchingTotal: true, MaxItems: 1},
+			[]string{"items", "total"},
+		},
+		{"not an object", `[]`, ValidationConfig{}, []string{""}},
+	}
+
+	for _, test := range tests {
+		var r Receipt
+		problems := r.ValidateAll([]byte(test.receipt), test.cfg)
+		var fields []string
+
+		for _, problem := range problems {
+			var fieldError FieldError
+
+			if !errors.As(problem, &fieldError) || fieldError.Message == "" {
+				t.Errorf("%s: returned problem %#v", test.name, problem)
+			}
+
+			fields = append(fields, fieldError.Field)
+		}
+
+		if !slices.Equal(fields, test.expectedFields) {
+			t.Errorf(
+				"%s: returned problems with %q, expected %q",
+				test.name,
+				fields,
+				test.expectedFields,
+			)
+		}
+	}
+}
+
+// Writes the rule config to a file for LoadRuleConfig and returns its path
+func writeTestRuleConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// The points are those of the M&M Corner Market receipt, 109 by default
+func TestLoadRuleConfig(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected int64
+		valid    bool
+	}{
+		{`{}`, 109, true},
+		{`{"roundDollarPoints": 100}`, 159, true},
+		// Each "Gatorade" is awarded ceil(2.25 * 0.2) points
+		{`{"descriptionLengthMultiple": 4}`, 113, true},
+		{`{"totalMultiple": 0.5, "totalMultiplePoints": 10}`, 94, true},
+		{`{"itemGroupSize": 0}`, 0, false},
+		{`{"totalMultiple": 0}`, 0, false},
+		{`{"roundDollarPoints": "100"}`, 0, false},
+		{`{`, 0, false},
+	}
+
+	r := unmarshalTestReceipt(t, cornerMarketReceipt)
+
+	for _, test := range tests {
+		cfg, err := LoadRuleConfig(writeTestRuleConfig(t, test.config))
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s loaded with error %v", test.config, err)
+			continue
+		}
+
+		if test.valid && r.ComputePoints(cfg) != test.expected {
+			t.Errorf(
+				"%s awarded %d points, expected %d",
+				test.config,
+				r.ComputePoints(cfg),
+				test.expected,
+			)
+		}
+	}
+
+	_, err := LoadRuleConfig(filepath.Join(t.TempDir(), "rules.json"))
+
+	if err == nil {
+		t.Error("loaded a missing rule config")
+	}
+}
+
+func TestLargeTotalBonusPoints(t *testing.T) {
+	cfg := DefaultRuleConfig()
+	cfg.LargeTotalBonusPoints = 20
+
+	tests := []struct {
+		total    Amount
+		expected int64
+	}{
+		{10000, 0},
+		{10001, 20},
+		{2500, 0},
+		{123456, 20},
+	}
+
+	for _, test := range tests {
+		r := Receipt{Total: test.total}
+
+		points := r.largeTotalBonusPoints(cfg)
+
+		if points != test.expected {
+			t.Errorf(
+				"%s awarded %d bonus points, expected %d",
+				test.total,
+				points,
+				test.expected,
+			)
+		}
+
+		// The bonus is off by default
+		points = r.largeTotalBonusPoints(DefaultRuleConfig())
+
+		if points != 0 {
+			t.Errorf(
+				"%s awarded %d bonus points by default",
+				test.total,
+				points,
+			)
+		}
+	}
+
+	for _, fixture := range []struct {
+		receipt  string
+		expected int64
+	}{
+		{targetReceipt, 28},
+		{cornerMarketReceipt, 109},
+	} {
+		r := unmarshalTestReceipt(t, fixture.receipt)
+
+		if points := ComputePoints(r); points != fixture.expected {
+			t.Errorf(
+				"%s awarded %d points, expected %d",
+				r.Retailer,
+				points,
+				fixture.expected,
+			)
+		}
+	}
+}
+
+// The price is multiplied by 0.2 before rounding, so the modes differ for
+// every price that isn't a multiple of $5
+func TestDescriptionPriceRounding(t *testing.T) {
+	tests := []struct {
+		price         Amount
+		expectedCeil  int64
+		expectedFloor int64
+		expectedRound int64
+	}{
+		{0, 0, 0, 0},
+		{225, 1, 0, 0},
+		{250, 1, 0, 1},
+		{500, 1, 1, 1},
+		{750, 2, 1, 2},
+		{1200, 3, 2, 2},
+		{1225, 3, 2, 2},
+		{1249, 3, 2, 2},
+		{1250, 3, 2, 3},
+	}
+
+	for _, test := range tests {
+		item := Item{Description: "Emils Cheese Pizza", Price: test.price}
+
+		for mode, expected := range map[RoundingMode]int64{
+			RoundingCeil:  test.expectedCeil,
+			RoundingFloor: test.expectedFloor,
+			RoundingRound: test.expectedRound,
+		} {
+			cfg := DefaultRuleConfig()
+			cfg.DescriptionPriceRounding = mode
+			points := item.descriptionLengthPoints(cfg)
+
+			if points != expected {
+				t.Errorf(
+					"%s rounded with %s awarded %d points, expected %d",
+					test.price,
+					mode,
+					points,
+					expected,
+				)
+			}
+		}
+	}
+
+	// Rounds up by default, as the rule always has
+	item := Item{Description: "Emils Cheese Pizza", Price: 225}
+
+	points := item.descriptionLengthPoints(DefaultRuleConfig())
+
+	if points != 1 {
+		t.Errorf("2.25 awarded %d points by default", points)
+	}
+
+	for _, test := range []struct {
+		mode  string
+		valid bool
+	}{
+		{"ceil", true},
+		{"floor", true},
+		{"round", true},
+		{"half", false},
+		{"", false},
+	} {
+		path := writeTestRuleConfig(
+			t,
+			fmt.Sprintf(`{"descriptionPriceRounding": %q}`, test.mode),
+		)
+
+		if _, err := LoadRuleConfig(path); (err == nil) != test.valid {
+			t.Errorf("loaded rounding %q with error %v", test.mode, err)
+		}
+	}
+}
+
+func TestManyItemsBonusPoints(t *testing.T) {
+	cfg := DefaultRuleConfig()
+	cfg.ManyItemsBonusPoints = 10
+
+	tests := []struct {
+		items    int
+		expected int64
+	}{
+		{0, 0},
+		{1, 0},
+		{9, 0},
+		{10, 10},
+		{11, 10},
+		{100, 10},
+	}
+
+	for _, test := range tests {
+		r := Receipt{Items: make([]Item, test.items)}
+
+		points := r.manyItemsBonusPoints(cfg)
+
+		if points != test.expected {
+			t.Errorf(
+				"%d items awarded %d bonus points, expected %d",
+				test.items,
+				points,
+				test.expected,
+			)
+		}
+
+		// The bonus is off by default
+		points = r.manyItemsBonusPoints(DefaultRuleConfig())
+
+		if points != 0 {
+			t.Errorf(
+				"%d items awarded %d bonus points by default",
+				test.items,
+				points,
+			)
+		}
+	}
+
+	// Only the bonus changes the points of a receipt with enough items
+	r := unmarshalTestReceipt(t, cornerMarketReceipt)
+
+	for len(r.Items) < cfg.ManyItemsThreshold {
+		r.Items = append(r.Items, r.Items[0])
+	}
+
+	defaultPoints := ComputePoints(r)
+	points := r.ComputePoints(cfg)
+
+	if points != defaultPoints+10 {
+		t.Errorf(
+			"%d items awarded %d points, expected %d",
+			len(r.Items),
+			points,
+			defaultPoints+10,
+		)
+	}
+}
+
+func TestRetailerBonusPoints(t *testing.T) {
+	cfg := DefaultRuleConfig()
+	cfg.RetailerBonuses = map[string]int64{"Target": 15, "M&M Corner Market": 5}
+
+	tests := []struct {
+		retailer Retailer
+		expected int64
+	}{
+		{"Target", 15},
+		{"target", 15},
+		{"TARGET", 15},
+		{"M&M Corner Market", 5},
+		{"m&m corner market", 5},
+		{"Targets", 0},
+		{"Target ", 0},
+		{"Walgreens", 0},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		r := Receipt{Retailer: test.retailer}
+
+		points := r.retailerBonusPoints(cfg)
+
+		if points != test.expected {
+			t.Errorf(
+				"%q awarded %d bonus points, expected %d",
+				test.retailer,
+				points,
+				test.expected,
+			)
+		}
+
+		// No retailers are named by default
+		points = r.retailerBonusPoints(DefaultRuleConfig())
+
+		if points != 0 {
+			t.Errorf(
+				"%q awarded %d bonus points by default",
+				test.retailer,
+				points,
+			)
+		}
+	}
+
+	r := unmarshalTestReceipt(t, targetReceipt)
+
+	if points := r.ComputePoints(cfg); points != 28+15 {
+		t.Errorf("Target awarded %d points with its bonus", points)
+	}
+
+	for _, test := range []struct {
+		config string
+		valid  bool
+	}{
+		{`{"retailerBonuses": {"Target": 15, "Walgreens": 5}}`, true},
+		{`{"retailerBonuses": {"Target": 15, "target": 5}}`, false},
+	} {
+		path := writeTestRuleConfig(t, test.config)
+
+		if _, err := LoadRuleConfig(path); (err == nil) != test.valid {
+			t.Errorf("loaded %s with error %v", test.config, err)
+		}
+	}
+}
+
+func TestDisabledRules(t *testing.T) {
+	for _, fixture := range []string{targetReceipt, cornerMarketReceipt} {
+		r := unmarshalTestReceipt(t, fixture)
+		total := ComputePoints(r)
+		defaultBreakdown := r.ComputePointsBreakdown(DefaultRuleConfig())
+
+		for _, rulePoints := range defaultBreakdown {
+			cfg := DefaultRuleConfig()
+			cfg.EnabledRules = map[string]bool{rulePoints.Rule: false}
+			breakdown := r.ComputePointsBreakdown(cfg)
+
+			if slices.Contains(ruleNamesOf(breakdown), rulePoints.Rule) {
+				t.Errorf(
+					"%s: %s is in the breakdown",
+					r.Retailer,
+					rulePoints.Rule,
+				)
+			}
+
+			points := r.ComputePoints(cfg)
+
+			if points != total-rulePoints.Points {
+				t.Errorf(
+					"%s: awarded %d points without %s, expected %d",
+					r.Retailer,
+					points,
+					rulePoints.Rule,
+					total-rulePoints.Points,
+				)
+			}
+		}
+	}
+
+	tests := []struct {
+		config   string
+		expected int64
+		valid    bool
+	}{
+		{
+			`{"enabledRules": {"purchaseTimeBetween2And4Points": false}}`,
+			99,
+			true,
+		},
+		{
+			`{"enabledRules": {"purchaseTimeBetween2And4Points": true}}`,
+			109,
+			true,
+		},
+		{`{"enabledRules": {"noSuchRule": false}}`, 0, false},
+	}
+
+	r := unmarshalTestReceipt(t, cornerMarketReceipt)
+
+	for _, test := range tests {
+		cfg, err := LoadRuleConfig(writeTestRuleConfig(t, test.config))
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s loaded with error %v", test.config, err)
+		} else if test.valid && r.ComputePoints(cfg) != test.expected {
+			t.Errorf(
+				"%s awarded %d points, expected %d",
+				test.config,
+				r.ComputePoints(cfg),
+				test.expected,
+			)
+		}
+	}
+}
+
+// Totals that drift when they're taken modulo 0.25 or 1 as floats
+func TestTotalRules(t *testing.T) {
+	tests := []struct {
+		total              string
+		roundDollarPoints  int64
+		multipleOf25Points int64
+	}{
+		{"0.10", 0, 0},
+		{"0.30", 0, 0},
+		{"0.75", 0, 25},
+		{"2.25", 0, 25},
+		{"35.00", 50, 25},
+		{"35.35", 0, 0},
+		{"0.00", 50, 25},
+		{"1234567.75", 0, 25},
+	}
+
+	cfg := DefaultRuleConfig()
+
+	for _, test := range tests {
+		var r Receipt
+		data := []byte(strconv.Quote(test.total))
+
+		if err := json.Unmarshal(data, &r.Total); err != nil {
+			t.Fatal(err)
+		}
+
+		points := r.totalRoundDollarAmountPoints(cfg)
+
+		if points != test.roundDollarPoints {
+			t.Errorf("%s: %d round dollar points", test.total, points)
+		}
+
+		points = r.totalMultipleOf25CentsPoints(cfg)
+
+		if points != test.multipleOf25Points {
+			t.Errorf("%s: %d multiple of 0.25 points", test.total, points)
+		}
+	}
+}
+
+// Compares the rules computed in cents with what they computed from float
+// dollars, with a tolerance for float error, for every amount up to $50
+func TestAmountRulesMatchFloatRules(t *testing.T) {
+	const epsilon = 1e-4
+	cfg := DefaultRuleConfig()
+	floatPoints := func(isMultiple bool, points int64) int64 {
+		if isMultiple {
+			return points
+		}
+
+		return 0
+	}
+
+	for cents := int64(0); cents <= 5000; cents++ {
+		amount := Amount(cents)
+		dollars, err := strconv.ParseFloat(amount.String(), 64)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roundDollarRemainder := math.Mod(dollars, 1)
+		multipleRemainder := math.Mod(dollars, cfg.TotalMultiple)
+		expected := []int64{
+			floatPoints(
+				roundDollarRemainder < epsilon ||
+					1-roundDollarRemainder < epsilon,
+				cfg.RoundDollarPoints,
+			),
+			floatPoints(
+				multipleRemainder < epsilon ||
+					cfg.TotalMultiple-multipleRemainder < epsilon,
+				cfg.TotalMultiplePoints,
+			),
+			int64(math.Ceil(dollars*cfg.DescriptionPriceMultiplier - epsilon)),
+		}
+
+		r := Receipt{Total: amount}
+		item := Item{Description: "ABC", Price: amount}
+		actual := []int64{
+			r.totalRoundDollarAmountPoints(cfg),
+			r.totalMultipleOf25CentsPoints(cfg),
+			item.descriptionLengthPoints(cfg),
+		}
+
+		if !slices.Equal(actual, expected) {
+			t.Errorf("%s awarded %v, expected %v", amount, actual, expected)
+		}
+	}
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	defer func() { DisallowUnknownFields = false }()
+
+	tests := []struct {
+		name   string
+		data   string
+		strict bool
+		valid  bool
+	}{
+		{"known fields", cornerMarketReceipt, true, true},
+		{
+			"unknown field",
+			`{"retailor": "Target", "items": []}`,
+			true,
+			false,
+		},
+		{
+			"unknown item field",
+			`{"items": [{"shortDescription": "Gatorade", "price": "2.25", ` +
+				`"quantity": 2}]}`,
+			true,
+			false,
+		},
+		{
+			"unknown field when lenient",
+			`{"retailor": "Target", "items": []}`,
+			false,
+			true,
+		},
+		{"trailing data", `{} {}`, true, false},
+	}
+
+	for _, test := range tests {
+		DisallowUnknownFields = test.strict
+		var r Receipt
+		err := Unmarshal([]byte(test.data), &r)
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unmarshalled with error %v", test.name, err)
+		}
+	}
+}
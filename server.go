@@ -1,514 +1,5349 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-	"unicode"
+
+	"go-fetch/receipt"
 
 	"github.com/ayaviri/goutils/timer"
 	"github.com/google/uuid"
 	"github.com/gorilla/handlers"
 )
 
-var err error
-var retailerRegex *regexp.Regexp
-var descriptionRegex *regexp.Regexp
-var twoDecimalFloatRegex *regexp.Regexp
+// Set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var version string = "dev"
+var commit string = "unknown"
+var date string = "unknown"
+var requestIDRegex *regexp.Regexp
+var formItemKeyRegex *regexp.Regexp
+var receiptIDRegex *regexp.Regexp
+
+var db Storage
+var validation receipt.ValidationConfig = receipt.ValidationConfig{
+	MaxItems: defaultMaxReceiptItems,
+}
+var rules receipt.RuleConfig = receipt.DefaultRuleConfig()
+var maxRequestBodyBytes int64 = 1 << 20
+var corsConfig CORSConfig
+var logFormat string = "text"
+var logDestination io.Writer = os.Stdout
+var processStartTime time.Time = time.Now()
+var adminToken string
+var apiTokens []string
+var rateLimit float64 = 100
+var rateLimitBurst int64 = 200
+var trustProxy bool
+var maxPointsBatchIds int64 = 100
+var prettyJSONResponses bool
+var defaultProcessingWorkers int64 = 4
+var defaultProcessingQueueSize int64 = 1000
+
+// Set when ASYNC_PROCESSING is, otherwise receipts are processed synchronously
+var processing *processingQueue
 
-var db *xDB
+// Set when WEBHOOK_URL is
+var webhook *webhookNotifier
+var defaultWebhookTimeout = 5 * time.Second
+var defaultWebhookRetries int64 = 3
+var defaultWebhookQueueSize int64 = 100
+
+// Where the health check is served, along with the detailed one under it
+var healthPath = "/health"
+
+// Set while the heap is over MEMORY_WATERMARK_BYTES, so that receipts stop
+// being processed until it's back under
+var memoryPressure atomic.Bool
+var memoryCheckInterval = 5 * time.Second
+
+// Set once the server starts shutting down, so that health checks fail
+var shuttingDown atomic.Bool
 
 func init() {
-	// No need to recompile these at every request time
-	retailerRegex = regexp.MustCompile("^[\\w\\s&\\-]+$")
-	descriptionRegex = regexp.MustCompile("^[\\w\\s\\-]+$")
-	twoDecimalFloatRegex = regexp.MustCompile("^\\d+\\.\\d{2}$")
+	// No need to recompile these at every request time. Client supplied
+	// request IDs are only honored when they look like one, so that they
+	// can't be used to inject anything into the logs
+	requestIDRegex = regexp.MustCompile("^[\\w\\-.]{1,128}$")
+	formItemKeyRegex = regexp.MustCompile("^items\\[(\\d+)\\]\\.(\\w+)$")
+	receiptIDRegex = regexp.MustCompile("^[\\w\\-]{1,128}$")
 	db = NewXDB()
 }
 
-func defineResources() *http.ServeMux {
-	logging := newLoggingHandler(os.Stdout)
+// The rate limiter evicts idle clients until stop is closed
+func defineResources(stop <-chan struct{}) *http.ServeMux {
+	logging := newLoggingHandler(logDestination)
+
+	if logFormat == "json" {
+		logging = newStructuredLoggingHandler(logDestination)
+	}
+
+	proxy := newProxyHandler(trustProxy)
+	cors := newCORSHandler(corsConfig)
+	limit := newRateLimitHandler(rateLimit, rateLimitBurst, stop)
 	var s *http.ServeMux = http.NewServeMux()
 
-	s.Handle("/health", logging(healthHandler()))
-	s.Handle("/receipts/", logging(receiptsSubresourceHandler()))
+	// Panics are recovered outside of every other middleware so that they
+	// can't take any of it down either. The request ID and client address
+	// have to be set before logging so that they can be logged, and CORS
+	// headers before rate limiting so that browsers can read a 429
+	route := func(pattern string, handler http.Handler) {
+		s.Handle(
+			pattern,
+			recoverPanic(withRequestID(proxy(logging(cors(handler))))),
+		)
+	}
+
+	handle := func(pattern string, handler http.Handler) {
+		route(pattern, limit(measureLatency(pattern, handler)))
+	}
+
+	// Health checks aren't rate limited, so that a prober sharing its address
+	// with busy clients can't be turned away and take the server out of
+	// rotation
+	handleProbe := func(pattern string, handler http.Handler) {
+		route(pattern, measureLatency(pattern, handler))
+	}
+
+	handle("/", uiHandler())
+	handleProbe(healthPath, healthHandler())
+	handleProbe(healthPath+"/detailed", detailedHealthHandler())
+	// Only the routes whose responses grow with the number of receipts are
+	// compressed, since gzipping the small bodies of the rest, which fit in a
+	// single packet anyway, would only make them larger
+	handle("/receipts", handlers.CompressHandler(receiptsHandler()))
+	handle("/receipts/", receiptsSubresourceHandler())
+	handle("/version", versionHandler())
+	handle("/metrics", metricsHandler())
+	handle("/openapi.json", openAPIHandler())
+	handle(
+		"/admin/snapshot",
+		requireAdminToken(adminToken)(
+			handlers.CompressHandler(snapshotHandler()),
+		),
+	)
+	handle(
+		"/admin/recompute",
+		requireAdminToken(adminToken)(recomputeHandler()),
+	)
+
+	return s
+}
+
+func main() {
+	var err error
+
+	processStartTime = time.Now()
+
+	validation, err = loadValidationConfig()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxRequestBodyBytes, err = int64FromEnv(
+		"MAX_REQUEST_BODY_BYTES",
+		maxRequestBodyBytes,
+	)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	corsConfig, err = loadCORSConfig()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if format := os.Getenv("LOG_FORMAT"); format != "" {
+		if format != "text" && format != "json" {
+			log.Fatalf("LOG_FORMAT must be text or json, got %q", format)
+		}
+
+		logFormat = format
+	}
+
+	if path := os.Getenv("HEALTH_PATH"); path != "" {
+		// A trailing slash would have the health check answer for every path
+		// under it
+		if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+			log.Fatalf(
+				"HEALTH_PATH must start and not end with a slash, got %q",
+				path,
+			)
+		}
+
+		healthPath = path
+	}
+
+	if path := os.Getenv("LOG_FILE"); path != "" {
+		logMaxBytes, err := int64FromEnv("LOG_MAX_BYTES", defaultLogMaxBytes)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		logMaxFiles, err := int64FromEnv("LOG_MAX_FILES", defaultLogMaxFiles)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		logDestination, err = newRotatingWriter(
+			path,
+			logMaxBytes,
+			int(logMaxFiles),
+		)
+
+		if err != nil {
+			log.Fatalf("Could not open the log file %s: %v", path, err)
+		}
+	}
+
+	receipt.DisallowUnknownFields, err = boolFromEnv("STRICT_RECEIPT_FIELDS")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	receipt.LenientAmounts, err = boolFromEnv("LENIENT_AMOUNTS")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	receipt.FormattedAmounts, err = boolFromEnv("FORMATTED_AMOUNTS")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	receipt.TwelveHourTimes, err = boolFromEnv("TWELVE_HOUR_TIMES")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if layouts := listFromEnv("DATE_LAYOUTS"); len(layouts) > 0 {
+		receipt.DateLayouts = receipt.DateLayoutsFrom(layouts)
+	}
+
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	apiTokens = listFromEnv("API_TOKENS")
+	rateLimit, err = float64FromEnv("RATE_LIMIT", rateLimit)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rateLimitBurst, err = int64FromEnv("RATE_LIMIT_BURST", rateLimitBurst)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	trustProxy, err = boolFromEnv("TRUST_PROXY")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// TRUST_X_FORWARDED_FOR came first, and is still accepted in its place
+	trustForwardedFor, err := boolFromEnv("TRUST_X_FORWARDED_FOR")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	trustProxy = trustProxy || trustForwardedFor
+
+	prettyJSONResponses, err = boolFromEnv("PRETTY_JSON")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxPointsBatchIds, err = int64FromEnv(
+		"MAX_POINTS_BATCH_IDS",
+		maxPointsBatchIds,
+	)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if path := os.Getenv("RULES_CONFIG"); path != "" {
+		rules, err = receipt.LoadRuleConfig(path)
+
+		if err != nil {
+			log.Fatalf("Could not load rule config from %s: %v", path, err)
+		}
+	}
+
+	rulesJSON, err := json.Marshal(rules)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Points rules: %s", rulesJSON)
+
+	switch storage := os.Getenv("STORAGE"); storage {
+	case "", "memory":
+		if path := os.Getenv("DB_FILE"); path != "" {
+			db, err = NewXDBFromFile(path)
+
+			if err != nil {
+				log.Fatalf("Could not load receipts from %s: %v", path, err)
+			}
+		}
+	case "sqlite":
+		db, err = newSQLiteStore(os.Getenv("STORAGE_DSN"))
+
+		if err != nil {
+			log.Fatalf("Could not open the SQLite database: %v", err)
+		}
+	default:
+		log.Fatalf("STORAGE must be memory or sqlite, got %q", storage)
+	}
+
+	maxReceipts, err := nonNegativeInt64FromEnv("MAX_RECEIPTS", 0)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if maxReceipts > 0 {
+		memory, ok := db.(*xDB)
+
+		if !ok {
+			log.Fatal("MAX_RECEIPTS is only supported by memory storage")
+		}
+
+		if err = memory.SetMaxReceipts(int(maxReceipts)); err != nil {
+			log.Fatalf("Could not evict receipts over MAX_RECEIPTS: %v", err)
+		}
+	}
+
+	if webhookURL := os.Getenv("WEBHOOK_URL"); webhookURL != "" {
+		timeout, err := durationFromEnv(
+			"WEBHOOK_TIMEOUT",
+			defaultWebhookTimeout,
+		)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		retries, err := int64FromEnv("WEBHOOK_RETRIES", defaultWebhookRetries)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		queueSize, err := int64FromEnv(
+			"WEBHOOK_QUEUE_SIZE",
+			defaultWebhookQueueSize,
+		)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		webhook = newWebhookNotifier(
+			webhookURL,
+			timeout,
+			int(retries),
+			int(queueSize),
+		)
+	}
+
+	receiptTTL, err := durationFromEnv("RECEIPT_TTL", 0)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	evictionInterval, err := durationFromEnv("EVICTION_INTERVAL", time.Minute)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if receiptTTL > 0 {
+		db.StartEviction(receiptTTL, evictionInterval)
+	}
+
+	memoryWatermark, err := int64FromEnv("MEMORY_WATERMARK_BYTES", 0)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if memoryWatermark > 0 {
+		memoryCheckInterval, err = durationFromEnv(
+			"MEMORY_CHECK_INTERVAL",
+			memoryCheckInterval,
+		)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go watchMemory(uint64(memoryWatermark), memoryCheckInterval)
+	}
+
+	asyncProcessing, err := boolFromEnv("ASYNC_PROCESSING")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if asyncProcessing {
+		// sqliteStore computes points as receipts are written, which leaves
+		// nothing for the workers to do
+		if _, ok := db.(*xDB); !ok {
+			log.Fatal("ASYNC_PROCESSING is only supported by memory storage")
+		}
+
+		workers, err := int64FromEnv(
+			"PROCESSING_WORKERS",
+			defaultProcessingWorkers,
+		)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		queueSize, err := int64FromEnv(
+			"PROCESSING_QUEUE_SIZE",
+			defaultProcessingQueueSize,
+		)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		processing = newProcessingQueue(int(queueSize), int(workers))
+	}
+
+	address, err := listenAddress()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stopRateLimiting := make(chan struct{})
+	defer close(stopRateLimiting)
+	var s *http.ServeMux = defineResources(stopRateLimiting)
+	server, err := newServer(address, s)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf(
+		"Timeouts: read %s, read header %s, write %s, idle %s",
+		server.ReadTimeout,
+		server.ReadHeaderTimeout,
+		server.WriteTimeout,
+		server.IdleTimeout,
+	)
+
+	shutdownTimeout, err := durationFromEnv("SHUTDOWN_TIMEOUT", 10*time.Second)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownComplete := make(chan struct{})
+
+	go func() {
+		shutdownOnSignal(server, shutdownTimeout)
+		close(shutdownComplete)
+	}()
+
+	withTimer("server", func() {
+		err = server.ListenAndServe()
+	})
+
+	// ListenAndServe returns as soon as Shutdown is called, while the
+	// requests in flight are still being served
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-shutdownComplete
+}
+
+// Waits for SIGINT or SIGTERM, then fails health checks and stops accepting
+// new connections, giving the requests in flight up to timeout to finish
+func shutdownOnSignal(server *http.Server, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	received := <-signals
+
+	log.Printf("Received %s, shutting down", received)
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Could not finish the requests in flight: %v", err)
+	}
+
+	db.Stop()
+}
+
+//  ____  _____ ____   ___  _   _ ____   ____ _____
+// |  _ \| ____/ ___| / _ \| | | |  _ \ / ___| ____|
+// | |_) |  _| \___ \| | | | | | | |_) | |   |  _|
+// |  _ <| |___ ___) | |_| | |_| |  _ <| |___| |___
+// |_| \_\_____|____/ \___/ \___/|_| \_\\____|_____|
+//
+//  _   _    _    _   _ ____  _     _____ ____  ____
+// | | | |  / \  | \ | |  _ \| |   | ____|  _ \/ ___|
+// | |_| | / _ \ |  \| | | | | |   |  _| | |_) \___ \
+// |  _  |/ ___ \| |\  | |_| | |___| |___|  _ < ___) |
+// |_| |_/_/   \_\_| \_|____/|_____|_____|_| \_\____/
+//
+
+// How long the health check waits on the storage to respond
+const healthPingTimeout = 2 * time.Second
+
+// Fails with a 503 once the server is shutting down or when the storage
+// doesn't respond, so that it can be used as a readiness probe
+func healthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			writeJSONError(
+				w,
+				http.StatusServiceUnavailable,
+				"SHUTTING_DOWN",
+				"The server is shutting down.",
+			)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+		defer cancel()
+
+		if err := db.Ping(ctx); err != nil {
+			writeJSONError(
+				w,
+				http.StatusServiceUnavailable,
+				"STORAGE_UNAVAILABLE",
+				"The storage is unavailable.",
+			)
+			return
+		}
+
+		w.Write([]byte("go fetch !"))
+	})
+}
+
+// Served as is from openapi.json, which has to be kept up to date by hand
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func openAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	})
+}
+
+// Served as is from receipt.schema.json, which describes receipts under the
+// default configuration and has to be kept up to date by hand along with the
+// Receipt of openapi.json. TestReceiptSchemaMatchesValidation checks it
+// against ValidateAll
+//
+//go:embed receipt.schema.json
+var receiptSchema []byte
+
+func receiptsSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(receiptSchema)
+}
+
+//go:embed ui
+var uiFiles embed.FS
+
+// Serves the page in ui for submitting receipts by hand at exactly "/", which
+// the ServeMux otherwise routes every path that no other route matches to, so
+// that they get the same JSON 404 as the rest of the API
+func uiHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeJSONError(w, http.StatusNotFound, "NOT_FOUND", "Not found.")
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(
+				w,
+				http.StatusMethodNotAllowed,
+				"METHOD_NOT_ALLOWED",
+				"Method not allowed.",
+			)
+			return
+		}
+
+		page, err := uiFiles.ReadFile("ui/index.html")
+
+		if err != nil {
+			writeJSONError(
+				w,
+				http.StatusInternalServerError,
+				"INTERNAL_ERROR",
+				"The page could not be served.",
+			)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+}
+
+func detailedHealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receipts, err := db.count()
+
+		if err != nil {
+			writeJSONError(
+				w,
+				http.StatusInternalServerError,
+				"INTERNAL_ERROR",
+				"The health could not be reported.",
+			)
+			return
+		}
+
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			DetailedHealthResponseBody{
+				Status:        "ok",
+				Receipts:      receipts,
+				UptimeSeconds: int64(time.Since(processStartTime).Seconds()),
+			},
+			prettyJSON(r),
+		)
+
+		if err != nil {
+			writeResponseBodyError(w, err, "The health could not be reported.")
+		}
+	})
+}
+
+func versionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := writeJSON(
+			w,
+			http.StatusOK,
+			VersionResponseBody{Version: version, Commit: commit, Date: date},
+			prettyJSON(r),
+		)
+
+		if err != nil {
+			writeResponseBodyError(w, err, "The version could not be reported.")
+		}
+	})
+}
+
+const defaultReceiptsPageLimit = 20
+const maxReceiptsPageLimit = 100
+
+const defaultLeaderboardLimit = 10
+
+const maxLeaderboardLimit = 100
+
+// Far more than any real receipt has, while still bounding the work of the
+// per item rules
+const defaultMaxReceiptItems = 1000
+
+func receiptsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			receiptsListHandler(w, r)
+		} else {
+			writeJSONError(
+				w,
+				http.StatusMethodNotAllowed,
+				"METHOD_NOT_ALLOWED",
+				"Method not allowed.",
+			)
+		}
+	})
+}
+
+var receiptsActionSegments = []string{
+	"process",
+	"batch",
+	"stream",
+	"preview",
+	"validate",
+	"points",
+	"breakdown",
+	"explain",
+	"recompute",
+	"leaderboard",
+	"stats",
+	"status",
+	"schema",
+}
+
+func receiptsSubresourceHandler() http.Handler {
+	// Only the routes that write receipts require a token
+	auth := newAuthHandler(apiTokens)
+	processHandler := auth(shedUnderMemoryPressure(
+		requireMediaType(
+			"The receipt must be JSON or form encoded.",
+			"application/json",
+			"application/x-www-form-urlencoded",
+		)(http.HandlerFunc(receiptsProcessHandler)),
+	))
+	processBatchHandler := auth(shedUnderMemoryPressure(
+		http.HandlerFunc(receiptsProcessBatchHandler),
+	))
+	processStreamHandler := auth(shedUnderMemoryPressure(
+		http.HandlerFunc(receiptsProcessStreamHandler),
+	))
+	deleteHandler := auth(http.HandlerFunc(receiptsDeleteHandler))
+	updateHandler := auth(
+		requireMediaType(
+			"The receipt patch must be JSON.",
+			"application/json",
+		)(http.HandlerFunc(receiptsUpdateHandler)),
+	)
+	recomputeHandler := auth(http.HandlerFunc(receiptsRecomputeHandler))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Guaranteed to have at least 2 elements, "" and "receipts", once the
+		// trailing slashes are trimmed
+		pathSegments := strings.Split(strings.TrimRight(r.URL.Path, "/"), "/")
+
+		// Only the action segments are matched case insensitively, since
+		// receipt IDs are case sensitive
+		for index := 2; index < len(pathSegments); index++ {
+			action := strings.ToLower(pathSegments[index])
+
+			if slices.Contains(receiptsActionSegments, action) {
+				pathSegments[index] = action
+			}
+		}
+
+		// Neither "/receipts/" nor a path with an empty receipt ID, which can
+		// still reach this handler when it isn't served through a ServeMux
+		// that cleans paths, name a subresource
+		if len(pathSegments) < 3 || pathSegments[2] == "" {
+			writeJSONError(w, http.StatusNotFound, "NOT_FOUND", "Not found.")
+		} else if len(pathSegments) == 3 && pathSegments[2] == "process" {
+			processHandler.ServeHTTP(w, r)
+		} else if len(pathSegments) == 3 && pathSegments[2] == "preview" {
+			receiptsPreviewHandler(w, r)
+		} else if len(pathSegments) == 3 && pathSegments[2] == "validate" {
+			receiptsValidateHandler(w, r)
+		} else if len(pathSegments) == 4 &&
+			pathSegments[2] == "process" &&
+			pathSegments[3] == "batch" {
+			processBatchHandler.ServeHTTP(w, r)
+		} else if len(pathSegments) == 4 &&
+			pathSegments[2] == "process" &&
+			pathSegments[3] == "stream" {
+			processStreamHandler.ServeHTTP(w, r)
+		} else if len(pathSegments) == 3 &&
+			pathSegments[2] == "leaderboard" &&
+			r.Method == http.MethodGet {
+			receiptsLeaderboardHandler(w, r)
+		} else if len(pathSegments) == 3 &&
+			pathSegments[2] == "stats" &&
+			r.Method == http.MethodGet {
+			receiptsStatsHandler(w, r)
+		} else if len(pathSegments) == 3 &&
+			pathSegments[2] == "schema" &&
+			r.Method == http.MethodGet {
+			receiptsSchemaHandler(w, r)
+		} else if len(pathSegments) == 4 &&
+			pathSegments[2] == "points" &&
+			pathSegments[3] == "batch" {
+			receiptsPointsBatchHandler(w, r)
+		} else if len(pathSegments) == 3 && r.Method == http.MethodGet {
+			receiptsGetHandler(w, r)
+		} else if len(pathSegments) == 3 && r.Method == http.MethodDelete {
+			deleteHandler.ServeHTTP(w, r)
+		} else if len(pathSegments) == 3 && r.Method == http.MethodPatch {
+			updateHandler.ServeHTTP(w, r)
+		} else if len(pathSegments) == 4 && pathSegments[3] == "points" {
+			receiptsPointsHandler(w, r)
+		} else if len(pathSegments) == 4 &&
+			pathSegments[3] == "status" &&
+			r.Method == http.MethodGet {
+			receiptsStatusHandler(w, r)
+		} else if len(pathSegments) == 4 && pathSegments[3] == "recompute" {
+			recomputeHandler.ServeHTTP(w, r)
+		} else if len(pathSegments) == 5 &&
+			pathSegments[3] == "points" &&
+			pathSegments[4] == "breakdown" {
+			receiptsPointsBreakdownHandler(w, r)
+		} else if len(pathSegments) == 5 &&
+			pathSegments[3] == "points" &&
+			pathSegments[4] == "explain" {
+			receiptsPointsExplainHandler(w, r)
+		} else {
+			writeJSONError(w, http.StatusNotFound, "NOT_FOUND", "Not found.")
+		}
+	})
+}
+
+func receiptsListHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := intFromQuery(query, "limit", defaultReceiptsPageLimit)
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_QUERY",
+			"The limit must be a non-negative integer.",
+		)
+		return
+	}
+
+	offset, err := intFromQuery(query, "offset", 0)
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_QUERY",
+			"The offset must be a non-negative integer.",
+		)
+		return
+	}
+
+	minPoints, err := intFromQuery(query, "minPoints", 0)
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_QUERY",
+			"The minPoints must be a non-negative integer.",
+		)
+		return
+	}
+
+	limit = min(limit, maxReceiptsPageLimit)
+	filter := ReceiptFilter{
+		Retailer:  query.Get("retailer"),
+		MinPoints: int64(minPoints),
+	}
+
+	var summaries []ReceiptSummary
+	var total int
+
+	withTimer("listing a page of receipts", func() {
+		summaries, total, err = db.listReceipts(filter, limit, offset)
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusInternalServerError,
+			"INTERNAL_ERROR",
+			"The receipts could not be listed.",
+		)
+		return
+	}
+
+	withTimer("writing receipts page to response body", func() {
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			ListReceiptsResponseBody{Receipts: summaries, Total: total},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The receipts could not be listed.")
+	}
+}
+
+func receiptsProcessHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodPost {
+		receiptsProcessed.inc("failure")
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	// The media type has already been checked by requireMediaType
+	mediaType := requestMediaType(r)
+
+	verbose, err := boolFromQuery(r.URL.Query(), "verbose")
+
+	if err != nil {
+		receiptsProcessed.inc("failure")
+		writeJSONError(w, http.StatusBadRequest, "INVALID_QUERY", err.Error())
+		return
+	}
+
+	version, err := receiptVersion(r)
+
+	if err != nil {
+		receiptsProcessed.inc("failure")
+		writeUnsupportedReceiptVersionError(w)
+		return
+	}
+
+	var b ProcessReceiptRequestBody
+	var problems []error
+
+	withTimer("reading/unmarshalling request body", func() {
+		// ValidateAll decodes version 1, the only version so far
+		if verbose {
+			problems, err = readValidateRequestBody(w, r, mediaType, &b)
+		} else {
+			err = readDecodeRequestBody(w, r, mediaType, version, &b)
+		}
+	})
+
+	if err != nil {
+		receiptsProcessed.inc("failure")
+		writeRequestBodyError(w, err)
+		return
+	}
+
+	if len(problems) > 0 {
+		receiptsProcessed.inc("failure")
+		writeValidationErrors(w, problems)
+		return
+	}
+
+	var receiptId string
+	var replayed bool
+
+	withTimer("writing receipt to storage", func() {
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			receiptId, replayed, err = db.writeReceiptIdempotent(
+				r.Context(),
+				key,
+				b.Receipt,
+			)
+		} else {
+			receiptId, err = db.writeReceipt(r.Context(), b.Receipt)
+		}
+	})
+
+	if err != nil {
+		receiptsProcessed.inc("failure")
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	receiptsProcessed.inc("success")
+
+	// A replay doesn't create anything, but still points at the receipt
+	status := http.StatusCreated
+	w.Header().Set("Location", "/receipts/"+url.PathEscape(receiptId))
+
+	if replayed {
+		status = http.StatusOK
+		w.Header().Set("Idempotent-Replayed", "true")
+	} else if processing != nil {
+		// A full queue falls back to responding the way processing does
+		// without one, leaving the points to be computed on first lookup
+		if processing.enqueue(receiptId) {
+			status = http.StatusAccepted
+		} else {
+			status = http.StatusCreated
+		}
+	}
+
+	if !replayed {
+		webhook.notify(receiptId)
+	}
+
+	withTimer("writing receipt ID to response body", func() {
+		err = writeJSON(
+			w,
+			status,
+			ProcessReceiptsResponseBody{ReceiptId: receiptId},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The receipt ID could not be written.")
+	}
+}
+
+// Validates the receipt and responds with the points it would be awarded,
+// without writing it to storage
+func receiptsPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodPost {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	version, err := receiptVersion(r)
+
+	if err != nil {
+		writeUnsupportedReceiptVersionError(w)
+		return
+	}
+
+	var b ProcessReceiptRequestBody
+
+	withTimer("reading/unmarshalling request body", func() {
+		err = readDecodeRequestBody(w, r, "application/json", version, &b)
+	})
+
+	if err != nil {
+		writeRequestBodyError(w, err)
+		return
+	}
+
+	withTimer("validating receipt", func() {
+		err = b.Receipt.Validate(validation)
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	var receiptPoints int64
+
+	withTimer("computing the points awarded for the receipt", func() {
+		receiptPoints = computeReceiptPoints(b.Receipt)
+	})
+
+	withTimer("writing points to response body", func() {
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			ReceiptsPointsResponseBody{Points: receiptPoints},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The points could not be written.")
+	}
+}
+
+// Checks the receipt like processing would and responds with how the server
+// reads it, in the same format receipts are returned in, or with every problem
+// with it. Nothing is written to storage, and an invalid receipt is still a
+// 200 since validating it succeeded
+func receiptsValidateHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodPost {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	if _, err = receiptVersion(r); err != nil {
+		writeUnsupportedReceiptVersionError(w)
+		return
+	}
+
+	var b ProcessReceiptRequestBody
+	var problems []error
+
+	withTimer("reading/validating request body", func() {
+		problems, err = readValidateRequestBody(w, r, requestMediaType(r), &b)
+	})
+
+	if err != nil {
+		writeRequestBodyError(w, err)
+		return
+	}
+
+	responseBody := ValidateReceiptResponseBody{Valid: len(problems) == 0}
+
+	if responseBody.Valid {
+		responseBody.Receipt = &b.Receipt
+	} else {
+		responseBody.Errors = fieldErrors(problems)
+	}
+
+	withTimer("writing validation result to response body", func() {
+		err = writeJSON(w, http.StatusOK, responseBody, prettyJSON(r))
+	})
+
+	if err != nil {
+		writeResponseBodyError(
+			w,
+			err,
+			"The validation result could not be written.",
+		)
+	}
+}
+
+// Processes each receipt in the array independently, so that one invalid
+// receipt doesn't fail the rest of the batch. Responds with 207 when any of
+// them failed
+func receiptsProcessBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodPost {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	var rawReceipts []json.RawMessage
+
+	withTimer("reading/unmarshalling request body", func() {
+		err = readUnmarshalRequestBody(w, r, &rawReceipts)
+	})
+
+	if err != nil {
+		writeRequestBodyError(w, err)
+		return
+	}
+
+	results := make([]BatchReceiptResult, len(rawReceipts))
+	status := http.StatusOK
+
+	withTimer("writing batch of receipts to storage", func() {
+		for index, rawReceipt := range rawReceipts {
+			results[index].Index = index
+			receiptId, err := processRawReceipt(r.Context(), rawReceipt)
+
+			if err != nil {
+				receiptsProcessed.inc("failure")
+				results[index].Error = "The receipt is invalid."
+				status = http.StatusMultiStatus
+			} else {
+				receiptsProcessed.inc("success")
+				results[index].ReceiptId = receiptId
+			}
+		}
+	})
+
+	withTimer("writing batch results to response body", func() {
+		err = writeJSON(w, status, results, prettyJSON(r))
+	})
+
+	if err != nil {
+		writeResponseBodyError(
+			w,
+			err,
+			"The batch results could not be written.",
+		)
+	}
+}
+
+// Processes newline delimited JSON receipts one at a time as they're read,
+// writing back a result line for each, so that uploads too large for the batch
+// endpoint don't have to be held in memory. The body isn't limited to
+// maxRequestBodyBytes for the same reason
+func receiptsProcessStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	body, err := requestBodyReader(w, r, 0)
+
+	if err != nil {
+		writeRequestBodyError(w, err)
+		return
+	}
+
+	defer body.Close()
+	controller := http.NewResponseController(w)
+	// HTTP/1 responses otherwise can't be written while the body is still
+	// being read. HTTP/2 doesn't need this, so the error is ignored
+	controller.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	decoder := json.NewDecoder(body)
+	encoder := json.NewEncoder(w)
+
+	withTimer("streaming receipts to storage", func() {
+		for index := 0; ; index++ {
+			var rawReceipt json.RawMessage
+
+			if err := decoder.Decode(&rawReceipt); err == io.EOF {
+				return
+			} else if err != nil {
+				// Nothing after the first value that isn't JSON can be decoded
+				receiptsProcessed.inc("failure")
+				encoder.Encode(BatchReceiptResult{
+					Index: index,
+					Error: "The receipt is invalid.",
+				})
+				return
+			}
+
+			result := BatchReceiptResult{Index: index}
+			receiptId, err := processRawReceipt(r.Context(), rawReceipt)
+
+			if err != nil {
+				receiptsProcessed.inc("failure")
+				result.Error = "The receipt is invalid."
+			} else {
+				receiptsProcessed.inc("success")
+				result.ReceiptId = receiptId
+			}
+
+			// The client is gone, so there's no one to write results to
+			if err := encoder.Encode(result); err != nil {
+				return
+			}
+
+			controller.Flush()
+		}
+	})
+}
+
+// Unmarshals and writes a single receipt of a batch. Each write takes the
+// lock on its own rather than holding it across the whole batch
+func processRawReceipt(
+	ctx context.Context,
+	rawReceipt json.RawMessage,
+) (string, error) {
+	var b ProcessReceiptRequestBody
+
+	if err := receipt.Unmarshal(rawReceipt, &b); err != nil {
+		return "", err
+	}
+
+	receiptId, err := db.writeReceipt(ctx, b.Receipt)
+
+	if err == nil {
+		webhook.notify(receiptId)
+	}
+
+	return receiptId, err
+}
+
+// The receipt schema versions decodeReceipt can decode, the first being the
+// default
+var receiptVersions = []int{1}
+
+const receiptVersionHeader = "X-Receipt-Version"
+
+// Returns the receipt schema version requested with ?version, or else the
+// X-Receipt-Version header, or the first of receiptVersions when neither is
+// set. Versions that aren't in receiptVersions are an error
+func receiptVersion(request *http.Request) (int, error) {
+	value := request.URL.Query().Get("version")
+
+	if value == "" {
+		value = request.Header.Get(receiptVersionHeader)
+	}
+
+	if value == "" {
+		return receiptVersions[0], nil
+	}
+
+	version, err := strconv.Atoi(value)
+
+	if err != nil || !slices.Contains(receiptVersions, version) {
+		return 0, fmt.Errorf("Unsupported receipt version %q", value)
+	}
+
+	return version, nil
+}
+
+// Decodes a receipt in the given schema version. Version 1 is the schema of
+// openapi.json. Later versions, with fields of their own, would be mapped onto
+// a receipt here
+func decodeReceipt(version int, data []byte) (receipt.Receipt, error) {
+	switch version {
+	case 1:
+		var b ProcessReceiptRequestBody
+		err := receipt.Unmarshal(data, &b)
+
+		return b.Receipt, err
+	default:
+		return receipt.Receipt{}, fmt.Errorf(
+			"Unsupported receipt version %d",
+			version,
+		)
+	}
+}
+
+func writeUnsupportedReceiptVersionError(w http.ResponseWriter) {
+	versions := make([]string, len(receiptVersions))
+
+	for index, version := range receiptVersions {
+		versions[index] = strconv.Itoa(version)
+	}
+
+	writeJSONError(
+		w,
+		http.StatusBadRequest,
+		"UNSUPPORTED_RECEIPT_VERSION",
+		"Unsupported receipt version. The supported versions are "+
+			strings.Join(versions, ", ")+".",
+	)
+}
+
+// Also answers HEAD requests, for monitoring that only checks whether the
+// receipt exists
+func receiptsPointsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	includeTier, err := boolFromQuery(r.URL.Query(), "tier")
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_QUERY",
+			"The tier must be true or false.",
+		)
+		return
+	}
+
+	var receiptId string
+
+	withTimer("getting receipt ID from request URL path", func() {
+		receiptId = getReceiptIDFromURLPath(r.URL.Path)
+	})
+
+	if !isValidReceiptID(receiptId) {
+		pointsLookups.inc("invalid_id")
+		writeInvalidReceiptIDError(w)
+		return
+	}
+
+	if processing.isPending(receiptId) {
+		pointsLookups.inc("pending")
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(
+			w,
+			http.StatusAccepted,
+			"RECEIPT_PENDING",
+			"The points of the receipt are still being computed.",
+		)
+		return
+	}
+
+	var receiptPoints int64
+
+	withTimer("getting the points awarded for the given receipt", func() {
+		receiptPoints, err = db.getReceiptPoints(r.Context(), receiptId)
+	})
+
+	if err != nil {
+		pointsLookups.inc("not_found")
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	pointsLookups.inc("found")
+	pointsResponseBody := ReceiptsPointsResponseBody{Points: receiptPoints}
+
+	if includeTier {
+		pointsResponseBody.Tier = classifyTier(receiptPoints, rules)
+	}
+
+	// Only changes when the points are recomputed, or with the tier
+	etag := pointsETag(receiptId, pointsResponseBody)
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// The not found error still has a body, which net/http leaves out of
+	// responses to HEAD requests
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	withTimer("writing points to response body", func() {
+		err = writeJSON(w, http.StatusOK, pointsResponseBody, prettyJSON(r))
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The points could not be written.")
+	}
+}
+
+// Responds with whether the points of a receipt processed asynchronously have
+// been computed yet. Receipts processed synchronously are always done
+func receiptsStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var receiptId string
+
+	withTimer("getting receipt ID from request URL path", func() {
+		receiptId = getReceiptIDFromURLPath(r.URL.Path)
+	})
+
+	if !isValidReceiptID(receiptId) {
+		writeInvalidReceiptIDError(w)
+		return
+	}
+
+	withTimer("getting receipt row from storage", func() {
+		_, err = db.getReceiptRow(receiptId)
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	status := "done"
+
+	if processing.isPending(receiptId) {
+		status = "pending"
+	}
+
+	withTimer("writing receipt status to response body", func() {
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			ReceiptStatusResponseBody{Status: status},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The status could not be written.")
+	}
+}
+
+// Looks up the points of up to maxPointsBatchIds receipts at once, responding
+// with a 207 when some of them couldn't be found
+func receiptsPointsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodPost {
+		writeJSONError(
+			w,
+			http.StatusMethodNotAllowed,
+			"METHOD_NOT_ALLOWED",
+			"Method not allowed.",
+		)
+		return
+	}
+
+	var b PointsBatchRequestBody
+
+	withTimer("reading/unmarshalling request body", func() {
+		err = readUnmarshalRequestBody(w, r, &b)
+	})
+
+	if err != nil {
+		writeRequestBodyError(w, err)
+		return
+	}
+
+	if int64(len(b.ReceiptIds)) > maxPointsBatchIds {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"TOO_MANY_IDS",
+			fmt.Sprintf(
+				"At most %d receipt IDs may be looked up at once.",
+				maxPointsBatchIds,
+			),
+		)
+		return
+	}
+
+	var pointsByReceiptId map[string]int64
+
+	withTimer("getting the points awarded for the receipts", func() {
+		pointsByReceiptId, err = db.getReceiptsPoints(r.Context(), b.ReceiptIds)
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusInternalServerError,
+			"INTERNAL_ERROR",
+			"The points could not be looked up.",
+		)
+		return
+	}
+
+	results := make(map[string]PointsBatchResult, len(b.ReceiptIds))
+	status := http.StatusOK
+
+	for _, receiptId := range b.ReceiptIds {
+		if points, exists := pointsByReceiptId[receiptId]; exists {
+			pointsLookups.inc("found")
+			results[receiptId] = PointsBatchResult{Points: &points}
+		} else if !isValidReceiptID(receiptId) {
+			pointsLookups.inc("invalid_id")
+			results[receiptId] = PointsBatchResult{
+				Error: "Invalid receipt ID format.",
+			}
+			status = http.StatusMultiStatus
+		} else {
+			pointsLookups.inc("not_found")
+			results[receiptId] = PointsBatchResult{
+				Error: "No receipt found for that ID.",
+			}
+			status = http.StatusMultiStatus
+		}
+	}
+
+	withTimer("writing batch points to response body", func() {
+		err = writeJSON(w, status, results, prettyJSON(r))
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The points could not be looked up.")
+	}
+}
+
+func receiptsPointsBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodGet {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	var receiptId string
+
+	withTimer("getting receipt ID from request URL path", func() {
+		receiptId = getReceiptIDFromURLPath(r.URL.Path)
+	})
+
+	if !isValidReceiptID(receiptId) {
+		writeInvalidReceiptIDError(w)
+		return
+	}
+
+	var receiptRow ReceiptRow
+
+	withTimer("getting the points breakdown for the receipt", func() {
+		receiptRow, err = db.getComputedReceiptRow(receiptId)
+	})
+
+	if errors.Is(err, ErrNotFound) {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusInternalServerError,
+			"INTERNAL_ERROR",
+			"The points breakdown could not be looked up.",
+		)
+		return
+	}
+
+	withTimer("writing points breakdown to response body", func() {
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			ReceiptsPointsBreakdownResponseBody{
+				Rules: receiptRow.Breakdown,
+				Total: receiptRow.Breakdown.Total(),
+				Items: receiptRow.ItemPoints,
+			},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(
+			w,
+			err,
+			"The points breakdown could not be written.",
+		)
+	}
+}
+
+// Explains the points of the receipt in plain text for support tooling,
+// rather than the JSON of receiptsPointsBreakdownHandler
+func receiptsPointsExplainHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodGet {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	var receiptId string
+
+	withTimer("getting receipt ID from request URL path", func() {
+		receiptId = getReceiptIDFromURLPath(r.URL.Path)
+	})
+
+	if !isValidReceiptID(receiptId) {
+		writeInvalidReceiptIDError(w)
+		return
+	}
+
+	var receiptRow ReceiptRow
+
+	withTimer("getting the points breakdown for the receipt", func() {
+		receiptRow, err = db.getComputedReceiptRow(receiptId)
+	})
+
+	if errors.Is(err, ErrNotFound) {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusInternalServerError,
+			"INTERNAL_ERROR",
+			"The points could not be explained.",
+		)
+		return
+	}
+
+	withTimer("writing points explanation to response body", func() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = io.WriteString(
+			w,
+			receiptRow.Receipt.ExplainPoints(
+				receiptRow.Breakdown,
+				receiptRow.ItemPoints,
+			),
+		)
+	})
+}
+
+func receiptsGetHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var receiptId string
+
+	withTimer("getting receipt ID from request URL path", func() {
+		receiptId = getReceiptIDFromURLPath(r.URL.Path)
+	})
+
+	var receiptRow ReceiptRow
+
+	withTimer("getting the receipt with the given ID", func() {
+		receiptRow, err = db.getReceiptRow(receiptId)
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	withTimer("writing receipt to response body", func() {
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			GetReceiptResponseBody{
+				Receipt:      receiptRow.Receipt,
+				CreationDate: receiptRow.CreationDate.Format(time.RFC3339),
+			},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The receipt could not be written.")
+	}
+}
+
+func receiptsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var receiptId string
+
+	withTimer("getting receipt ID from request URL path", func() {
+		receiptId = getReceiptIDFromURLPath(r.URL.Path)
+	})
+
+	withTimer("deleting the receipt with the given ID", func() {
+		err = db.deleteReceipt(receiptId)
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Recomputes the points of a single receipt under the configured rules and
+// responds with them, for when recomputing every receipt would take too long
+func receiptsRecomputeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(
+			w,
+			http.StatusMethodNotAllowed,
+			"METHOD_NOT_ALLOWED",
+			"Method not allowed.",
+		)
+		return
+	}
+
+	var err error
+	var receiptId string
+
+	withTimer("getting receipt ID from request URL path", func() {
+		receiptId = getReceiptIDFromURLPath(r.URL.Path)
+	})
+
+	var receiptPoints int64
+
+	withTimer("recomputing the points of the given receipt", func() {
+		receiptPoints, err = db.recomputeReceipt(receiptId, rules)
+	})
+
+	if errors.Is(err, ErrNotFound) {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusInternalServerError,
+			"INTERNAL_ERROR",
+			"The points could not be recomputed.",
+		)
+		return
+	}
+
+	withTimer("writing points to response body", func() {
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			ReceiptsPointsResponseBody{Points: receiptPoints},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The points could not be written.")
+	}
+}
+
+// Updates the fields of the stored receipt that are in the JSON object of the
+// request body, leaving the rest as they are, and responds with the points of
+// the updated receipt
+func receiptsUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var receiptId string
+
+	withTimer("getting receipt ID from request URL path", func() {
+		receiptId = getReceiptIDFromURLPath(r.URL.Path)
+	})
+
+	var patch map[string]json.RawMessage
+
+	withTimer("reading/unmarshalling request body", func() {
+		var requestBodyBytes []byte
+		requestBodyBytes, err = readRequestBody(w, r)
+
+		if err == nil {
+			err = json.Unmarshal(requestBodyBytes, &patch)
+		}
+	})
+
+	if err != nil {
+		writeRequestBodyError(w, err)
+		return
+	}
+
+	var receiptPoints int64
+
+	withTimer("updating the given receipt", func() {
+		receiptPoints, err = db.updateReceipt(receiptId, patch)
+	})
+
+	if errors.Is(err, ErrNotFound) {
+		writeJSONError(
+			w,
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		)
+		return
+	}
+
+	if errors.Is(err, ErrInvalidPatch) {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusInternalServerError,
+			"INTERNAL_ERROR",
+			"The receipt could not be updated.",
+		)
+		return
+	}
+
+	withTimer("writing points to response body", func() {
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			ReceiptsPointsResponseBody{Points: receiptPoints},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The points could not be written.")
+	}
+}
+
+// Exports every receipt row as JSON lines on GET, and replaces every receipt
+// with the rows of such an export on POST, keeping their IDs
+func snapshotHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			snapshotExportHandler(w, r)
+		} else if r.Method == http.MethodPost {
+			snapshotImportHandler(w, r)
+		} else {
+			writeJSONError(
+				w,
+				http.StatusMethodNotAllowed,
+				"METHOD_NOT_ALLOWED",
+				"Method not allowed.",
+			)
+		}
+	})
+}
+
+func snapshotExportHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	withTimer("exporting receipt rows to response body", func() {
+		err = db.export(w)
+	})
+
+	// The status has already been written along with the first row, so all
+	// that's left to do is log it
+	if err != nil {
+		log.Printf("Could not export receipts: %v", err)
+	}
+}
+
+func snapshotImportHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var imported int
+
+	// Snapshots aren't limited to maxRequestBodyBytes since they hold every
+	// receipt, and only admins can send them
+	withTimer("importing receipt rows from request body", func() {
+		imported, err = db.importRows(r.Body)
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_SNAPSHOT",
+			"The snapshot is invalid.",
+		)
+		return
+	}
+
+	withTimer("writing import count to response body", func() {
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			ImportSnapshotResponseBody{Imported: imported},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The import count could not be written.")
+	}
+}
+
+// Recomputes the points of every stored receipt under the configured rules,
+// for receipts whose points were stored under the rules of an earlier run
+func recomputeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(
+				w,
+				http.StatusMethodNotAllowed,
+				"METHOD_NOT_ALLOWED",
+				"Method not allowed.",
+			)
+			return
+		}
+
+		var recomputed int
+		var err error
+
+		withTimer("recomputing the points of every receipt", func() {
+			recomputed, err = db.recomputeAllPoints(rules)
+		})
+
+		if err != nil {
+			writeJSONError(
+				w,
+				http.StatusInternalServerError,
+				"INTERNAL_ERROR",
+				"The points could not be recomputed.",
+			)
+			return
+		}
+
+		withTimer("writing recompute count to response body", func() {
+			err = writeJSON(
+				w,
+				http.StatusOK,
+				RecomputePointsResponseBody{Recomputed: recomputed},
+				prettyJSON(r),
+			)
+		})
+
+		if err != nil {
+			writeResponseBodyError(
+				w,
+				err,
+				"The recompute count could not be written.",
+			)
+		}
+	})
+}
+
+//  ____  _____ ___      ______  _____ ____  ____
+// |  _ \| ____/ _ \    / /  _ \| ____/ ___||  _ \
+// | |_) |  _|| | | |  / /| |_) |  _| \___ \| |_) |
+// |  _ <| |__| |_| | / / |  _ <| |___ ___) |  __/
+// |_| \_\_____\__\_\/_/  |_| \_\_____|____/|_|
+//
+//  ____   ____ _   _ _____ __  __    _    ____
+// / ___| / ___| | | | ____|  \/  |  / \  / ___|
+// \___ \| |   | |_| |  _| | |\/| | / _ \ \___ \
+//  ___) | |___|  _  | |___| |  | |/ ___ \ ___) |
+// |____/ \____|_| |_|_____|_|  |_/_/   \_\____/
+//
+
+type DetailedHealthResponseBody struct {
+	Status        string `json:"status"`
+	Receipts      int    `json:"receipts"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+type VersionResponseBody struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+type ProcessReceiptRequestBody struct {
+	receipt.Receipt
+}
+
+type ProcessReceiptsResponseBody struct {
+	ReceiptId string `json:"id"`
+}
+
+type ValidateReceiptResponseBody struct {
+	Valid bool `json:"valid"`
+	// Only set for valid receipts, as they would be stored
+	Receipt *receipt.Receipt `json:"receipt,omitempty"`
+	// Only set for invalid receipts
+	Errors []receipt.FieldError `json:"errors,omitempty"`
+}
+
+type ReceiptStatusResponseBody struct {
+	// "pending" until the points are computed, then "done"
+	Status string `json:"status"`
+}
+
+type ReceiptsPointsResponseBody struct {
+	Points int64 `json:"points"`
+	// Only set when the tier is requested with ?tier=true
+	Tier string `json:"tier,omitempty"`
+}
+
+func receiptsLeaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := intFromQuery(r.URL.Query(), "limit", defaultLeaderboardLimit)
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_QUERY",
+			"The limit must be a non-negative integer.",
+		)
+		return
+	}
+
+	limit = min(limit, maxLeaderboardLimit)
+	var rows []ReceiptRow
+
+	withTimer("getting the receipts with the most points", func() {
+		rows, err = db.topReceipts(limit)
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusInternalServerError,
+			"INTERNAL_ERROR",
+			"The leaderboard could not be retrieved.",
+		)
+		return
+	}
+
+	withTimer("writing leaderboard to response body", func() {
+		entries := make([]LeaderboardEntry, 0, len(rows))
+
+		for _, row := range rows {
+			entries = append(entries, LeaderboardEntry{
+				ReceiptId: row.ReceiptId,
+				Retailer:  string(row.Receipt.Retailer),
+				Points:    row.Points,
+			})
+		}
+
+		err = writeJSON(
+			w,
+			http.StatusOK,
+			LeaderboardResponseBody{Receipts: entries},
+			prettyJSON(r),
+		)
+	})
+
+	if err != nil {
+		writeResponseBodyError(
+			w,
+			err,
+			"The leaderboard could not be retrieved.",
+		)
+	}
+}
+
+func receiptsStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var stats ReceiptStats
+
+	withTimer("computing statistics of every receipt", func() {
+		stats, err = db.stats()
+	})
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusInternalServerError,
+			"INTERNAL_ERROR",
+			"The statistics could not be computed.",
+		)
+		return
+	}
+
+	withTimer("writing statistics to response body", func() {
+		err = writeJSON(w, http.StatusOK, stats, prettyJSON(r))
+	})
+
+	if err != nil {
+		writeResponseBodyError(w, err, "The statistics could not be computed.")
+	}
+}
+
+type ReceiptsPointsBreakdownResponseBody struct {
+	Rules receipt.PointsBreakdown `json:"rules"`
+	Total int64                   `json:"total"`
+	// Attributes the points of itemDescriptionLengthsPoints to each item
+	Items []receipt.ItemPoints `json:"items"`
+}
+
+type ReceiptSummary struct {
+	ReceiptId    string `json:"id"`
+	Points       int64  `json:"points"`
+	CreationDate string `json:"creationDate"`
+}
+
+type ListReceiptsResponseBody struct {
+	Receipts []ReceiptSummary `json:"receipts"`
+	// The number of receipts across all pages
+	Total int `json:"total"`
+}
+
+// The points statistics are all 0 when there aren't any receipts
+type ReceiptStats struct {
+	Receipts      int     `json:"receipts"`
+	TotalPoints   int64   `json:"totalPoints"`
+	AveragePoints float64 `json:"averagePoints"`
+	MinPoints     int64   `json:"minPoints"`
+	MaxPoints     int64   `json:"maxPoints"`
+	// Keyed by retailer name
+	ReceiptsByRetailer map[string]int `json:"receiptsByRetailer"`
+}
+
+type LeaderboardEntry struct {
+	ReceiptId string `json:"id"`
+	Retailer  string `json:"retailer"`
+	Points    int64  `json:"points"`
+}
+
+// Sorted by points, highest first
+type LeaderboardResponseBody struct {
+	Receipts []LeaderboardEntry `json:"receipts"`
+}
+
+type PointsBatchRequestBody struct {
+	ReceiptIds []string `json:"ids"`
+}
+
+// Only one of Points and Error is set
+type PointsBatchResult struct {
+	Points *int64 `json:"points,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Only one of ReceiptId and Error is set
+type BatchReceiptResult struct {
+	Index     int    `json:"index"`
+	ReceiptId string `json:"id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ImportSnapshotResponseBody struct {
+	Imported int `json:"imported"`
+}
+
+type RecomputePointsResponseBody struct {
+	Recomputed int `json:"recomputed"`
+}
+
+type ErrorResponseBody struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestId string `json:"requestId,omitempty"`
+	// Only set for receipts processed with ?verbose=true
+	Errors []receipt.FieldError `json:"errors,omitempty"`
+}
+
+type GetReceiptResponseBody struct {
+	receipt.Receipt
+	CreationDate string `json:"creationDate"`
+}
+
+//  __  __ ___ ____  ____  _     _______        ___    ____  _____
+// |  \/  |_ _|  _ \|  _ \| |   | ____\ \      / / \  |  _ \| ____|
+// | |\/| || || | | | | | | |   |  _|  \ \ /\ / / _ \ | |_) |  _|
+// | |  | || || |_| | |_| | |___| |___  \ V  V / ___ \|  _ <| |___
+// |_|  |_|___|____/|____/|_____|_____|  \_/\_/_/   \_\_| \_\_____|
+//
+
+func newLoggingHandler(destination io.Writer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return handlers.CustomLoggingHandler(
+			destination,
+			next,
+			writeLogWithRequestID,
+		)
+	}
+}
+
+// Writes the same Apache common log line as handlers.LoggingHandler, with
+// the request ID appended to it
+func writeLogWithRequestID(
+	writer io.Writer,
+	params handlers.LogFormatterParams,
+) {
+	host, _, err := net.SplitHostPort(params.Request.RemoteAddr)
+
+	if err != nil {
+		host = params.Request.RemoteAddr
+	}
+
+	username := "-"
+
+	if params.URL.User != nil && params.URL.User.Username() != "" {
+		username = params.URL.User.Username()
+	}
+
+	fmt.Fprintf(
+		writer,
+		"%s - %s [%s] \"%s %s %s\" %d %d %s\n",
+		host,
+		username,
+		params.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		params.Request.Method,
+		params.URL.RequestURI(),
+		params.Request.Proto,
+		params.StatusCode,
+		params.Size,
+		requestIDFromContext(params.Request.Context()),
+	)
+}
+
+type requestLogEntry struct {
+	Time            string  `json:"time"`
+	Method          string  `json:"method"`
+	Path            string  `json:"path"`
+	Status          int     `json:"status"`
+	Bytes           int     `json:"bytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	RequestId       string  `json:"requestId"`
+}
+
+// Logs one JSON object per request, which is easier for log aggregators to
+// parse than the Apache lines of newLoggingHandler
+func newStructuredLoggingHandler(
+	destination io.Writer,
+) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(destination)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			startTime := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+
+			entry := requestLogEntry{
+				Time:            startTime.UTC().Format(time.RFC3339),
+				Method:          r.Method,
+				Path:            r.URL.Path,
+				Status:          recorder.status(),
+				Bytes:           recorder.bytes,
+				DurationSeconds: time.Since(startTime).Seconds(),
+				RequestId:       requestIDFromContext(r.Context()),
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			encoder.Encode(entry)
+		})
+	}
+}
+
+const defaultLogMaxBytes = 10 << 20
+
+const defaultLogMaxFiles = 5
+
+// Appends to the file at Path until writing to it would make it larger than
+// MaxBytes, at which point it's renamed to Path.1, the previous Path.1 to
+// Path.2 and so on, keeping at most MaxFiles old files, and a new file is
+// started. Each write goes to a single file so that log lines aren't split
+type rotatingWriter struct {
+	Path     string
+	MaxBytes int64
+	MaxFiles int
+	// Guards file and size, since requests are logged concurrently
+	Mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingWriter(
+	path string,
+	maxBytes int64,
+	maxFiles int,
+) (*rotatingWriter, error) {
+	writer := &rotatingWriter{
+		Path:     path,
+		MaxBytes: maxBytes,
+		MaxFiles: maxFiles,
+	}
+
+	if err := writer.open(); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+func (writer *rotatingWriter) Write(data []byte) (int, error) {
+	writer.Mu.Lock()
+	defer writer.Mu.Unlock()
+
+	// An empty file is written to regardless, since a write larger than
+	// MaxBytes would never fit in any file
+	if writer.size > 0 && writer.size+int64(len(data)) > writer.MaxBytes {
+		if err := writer.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	written, err := writer.file.Write(data)
+	writer.size += int64(written)
+
+	return written, err
+}
+
+func (writer *rotatingWriter) Close() error {
+	writer.Mu.Lock()
+	defer writer.Mu.Unlock()
+
+	return writer.file.Close()
+}
+
+// Opens the file at Path for appending, creating it if it doesn't exist yet.
+// Assumes the caller holds the lock, or that the writer isn't shared yet
+func (writer *rotatingWriter) open() error {
+	file, err := os.OpenFile(
+		writer.Path,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	writer.file = file
+	writer.size = info.Size()
+
+	return nil
+}
+
+// Shifts every old file up by one, dropping the oldest, and starts a new
+// file. Assumes the caller holds the lock
+func (writer *rotatingWriter) rotate() error {
+	if err := writer.file.Close(); err != nil {
+		return err
+	}
+
+	oldest := fmt.Sprintf("%s.%d", writer.Path, writer.MaxFiles)
+
+	if err := os.Remove(oldest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for index := writer.MaxFiles - 1; index >= 1; index-- {
+		err := os.Rename(
+			fmt.Sprintf("%s.%d", writer.Path, index),
+			fmt.Sprintf("%s.%d", writer.Path, index+1),
+		)
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(writer.Path, writer.Path+".1"); err != nil {
+		return err
+	}
+
+	return writer.open()
+}
+
+// Records the status code and number of body bytes written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = statusCode
+	}
+
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+
+	written, err := recorder.ResponseWriter.Write(data)
+	recorder.bytes += written
+
+	return written, err
+}
+
+// Lets http.ResponseController reach the flushing of the wrapped writer
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// A handler that never writes anything responds with a 200
+func (recorder *statusRecorder) status() int {
+	if recorder.statusCode == 0 {
+		return http.StatusOK
+	}
+
+	return recorder.statusCode
+}
+
+type contextKey string
+
+const requestIDContextKey contextKey = "requestId"
+const requestIDHeader = "X-Request-ID"
+
+// Recovers from panics in the handlers it wraps, logging them along with the
+// stack and request ID and responding with a 500, rather than letting
+// net/http drop the connection without a response. A response that was
+// already started can only be cut short
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			recovered := recover()
+
+			if recovered == nil {
+				return
+			}
+
+			// Panicking with http.ErrAbortHandler aborts the response on
+			// purpose, which net/http doesn't log
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			// withRequestID has set the response header by now, unless the
+			// panic happened before it
+			log.Printf(
+				"Recovered from panic serving request %s: %v\n%s",
+				w.Header().Get(requestIDHeader),
+				recovered,
+				debug.Stack(),
+			)
+
+			if recorder.statusCode != 0 {
+				panic(http.ErrAbortHandler)
+			}
+
+			writeJSONError(
+				w,
+				http.StatusInternalServerError,
+				"INTERNAL_ERROR",
+				"The request could not be served.",
+			)
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// Reuses the X-Request-ID header of the request, generating one when it's
+// missing, then stores it in the request context and echoes it back in the
+// response headers
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIDHeader)
+
+		if !requestIDRegex.MatchString(requestId) {
+			requestId = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, requestId)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, requestId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	requestId, ok := ctx.Value(requestIDContextKey).(string)
+
+	if !ok {
+		return "-"
+	}
+
+	return requestId
+}
+
+// Allows cross-origin requests from the given origins only. No CORS headers
+// are sent at all when there aren't any, since handlers.CORS would otherwise
+// default to allowing every origin
+func newCORSHandler(config CORSConfig) func(http.Handler) http.Handler {
+	if len(config.AllowedOrigins) == 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	options := []handlers.CORSOption{
+		handlers.AllowedOrigins(config.AllowedOrigins),
+		handlers.AllowedMethods(config.AllowedMethods),
+		handlers.AllowedHeaders(config.AllowedHeaders),
+		handlers.ExposedHeaders([]string{
+			requestIDHeader,
+			"Idempotent-Replayed",
+			"Retry-After",
+			"Location",
+			"ETag",
+		}),
+	}
+
+	if config.MaxAge > 0 {
+		options = append(options, handlers.MaxAge(config.MaxAge))
+	}
+
+	if config.AllowCredentials {
+		options = append(options, handlers.AllowCredentials())
+	}
+
+	return handlers.CORS(options...)
+}
+
+// How cross-origin requests are answered. No CORS headers are sent unless
+// some origins are allowed
+type CORSConfig struct {
+	AllowedOrigins []string
+	AllowedMethods []string
+	// Allowed on top of the headers every browser may send, like Accept
+	AllowedHeaders []string
+	// How many seconds browsers may cache preflight responses for, at most
+	// 600. Left up to the browser when 0
+	MaxAge           int
+	AllowCredentials bool
+}
+
+var defaultCORSAllowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+var defaultCORSAllowedHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Idempotency-Key",
+	receiptVersionHeader,
+	requestIDHeader,
+}
+
+const maxCORSMaxAge = 600
+
+func loadCORSConfig() (CORSConfig, error) {
+	config := CORSConfig{
+		AllowedOrigins: listFromEnv("CORS_ALLOWED_ORIGINS"),
+		AllowedMethods: listFromEnv("CORS_ALLOWED_METHODS"),
+		AllowedHeaders: listFromEnv("CORS_ALLOWED_HEADERS"),
+	}
+
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = defaultCORSAllowedMethods
+	}
+
+	if len(config.AllowedHeaders) == 0 {
+		config.AllowedHeaders = defaultCORSAllowedHeaders
+	}
+
+	maxAge, err := nonNegativeInt64FromEnv("CORS_MAX_AGE", 0)
+
+	if err != nil {
+		return config, err
+	}
+
+	// Browsers cap it anyway, and handlers.MaxAge would silently lower it
+	if maxAge > maxCORSMaxAge {
+		return config, fmt.Errorf(
+			"CORS_MAX_AGE must be at most %d, got %d",
+			maxCORSMaxAge,
+			maxAge,
+		)
+	}
+
+	config.MaxAge = int(maxAge)
+	config.AllowCredentials, err = boolFromEnv("CORS_ALLOW_CREDENTIALS")
+
+	if err != nil {
+		return config, err
+	}
+
+	// Browsers reject credentialed responses allowing any origin
+	if config.AllowCredentials && slices.Contains(config.AllowedOrigins, "*") {
+		return config, errors.New(
+			"CORS_ALLOW_CREDENTIALS can't be used with the * origin",
+		)
+	}
+
+	return config, nil
+}
+
+// Only lets through requests with an "Authorization: Bearer <token>" header
+// for the given token. Every request is turned away with a 404 when the token
+// is empty, as if the routes it guards didn't exist
+func requireAdminToken(token string) func(http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				writeJSONError(
+					w,
+					http.StatusNotFound,
+					"NOT_FOUND",
+					"Not found.",
+				)
+				return
+			}
+
+			actual := []byte(r.Header.Get("Authorization"))
+
+			if subtle.ConstantTimeCompare(actual, expected) != 1 {
+				writeJSONError(
+					w,
+					http.StatusUnauthorized,
+					"UNAUTHORIZED",
+					"A valid admin token is required.",
+				)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Requires an "Authorization: Bearer <token>" header with one of the given
+// tokens, rejecting requests without one with a 401. Every request is let
+// through when there aren't any tokens, so that the API stays open by default
+func newAuthHandler(tokens []string) func(http.Handler) http.Handler {
+	if len(tokens) == 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	expected := make([][]byte, len(tokens))
+
+	for index, token := range tokens {
+		expected[index] = []byte("Bearer " + token)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actual := []byte(r.Header.Get("Authorization"))
+			valid := false
+
+			// Every token is compared so that the time taken doesn't tell
+			// which one came closest
+			for _, token := range expected {
+				if subtle.ConstantTimeCompare(actual, token) == 1 {
+					valid = true
+				}
+			}
+
+			if !valid {
+				writeJSONError(
+					w,
+					http.StatusUnauthorized,
+					"UNAUTHORIZED",
+					"A valid API token is required.",
+				)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Rejects requests whose Content-Type isn't one of the given media types with
+// a 415 and the given message, as are requests without a Content-Type.
+// Parameters like charset are ignored
+func requireMediaType(
+	message string,
+	mediaTypes ...string,
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mediaType, _, err := mime.ParseMediaType(
+				r.Header.Get("Content-Type"),
+			)
+
+			if err != nil || !slices.Contains(mediaTypes, mediaType) {
+				writeJSONError(
+					w,
+					http.StatusUnsupportedMediaType,
+					"UNSUPPORTED_MEDIA_TYPE",
+					message,
+				)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Checks whether the heap is over watermark bytes every interval rather than
+// on every request, since reading the memory stats stops the world
+func watchMemory(watermark uint64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var stats runtime.MemStats
+
+	for range ticker.C {
+		runtime.ReadMemStats(&stats)
+		over := stats.Alloc > watermark
+
+		if memoryPressure.Swap(over) == over {
+			continue
+		}
+
+		if over {
+			log.Printf("Heap of %d bytes is over the watermark", stats.Alloc)
+		} else {
+			log.Printf(
+				"Heap of %d bytes is back under the watermark",
+				stats.Alloc,
+			)
+		}
+	}
+}
+
+// Turns receipts away with a 503 while the heap is over the memory watermark,
+// so that they can be retried once it's back under. Every other route,
+// including looking up points, is left available
+func shedUnderMemoryPressure(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if memoryPressure.Load() {
+			w.Header().Set(
+				"Retry-After",
+				strconv.Itoa(int(math.Ceil(memoryCheckInterval.Seconds()))),
+			)
+			writeJSONError(
+				w,
+				http.StatusServiceUnavailable,
+				"MEMORY_PRESSURE",
+				"The server is low on memory.",
+			)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Limits every client to rate requests per second on average, with bursts of
+// up to burst requests, using a token bucket per client IP. Requests over the
+// limit are turned away with a 429. Clients are told apart by their remote
+// address, which the proxy handler has already replaced when TRUST_PROXY is
+// set. Idle clients' buckets are evicted every minute until stop is closed
+func newRateLimitHandler(
+	rate float64,
+	burst int64,
+	stop <-chan struct{},
+) func(http.Handler) http.Handler {
+	limiter := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				limiter.evictFullBuckets(now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, retryAfter := limiter.take(
+				clientIP(r, false),
+				time.Now(),
+			)
+
+			if !allowed {
+				w.Header().Set(
+					"Retry-After",
+					strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))),
+				)
+				writeJSONError(
+					w,
+					http.StatusTooManyRequests,
+					"RATE_LIMITED",
+					"Too many requests.",
+				)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	// When the tokens were last refilled
+	updated time.Time
+}
+
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	// Keyed by client IP
+	buckets map[string]*tokenBucket
+	mu      sync.Mutex
+}
+
+// Takes a token from the given client's bucket after refilling it for the
+// time since it was last refilled. When the bucket is empty, returns how long
+// until it holds a token again instead
+func (limiter *rateLimiter) take(
+	client string,
+	now time.Time,
+) (bool, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	bucket, exists := limiter.buckets[client]
+
+	if !exists {
+		bucket = &tokenBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[client] = bucket
+	}
+
+	bucket.tokens = min(
+		limiter.burst,
+		bucket.tokens+now.Sub(bucket.updated).Seconds()*limiter.rate,
+	)
+	bucket.updated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	missing := (1 - bucket.tokens) / limiter.rate
+	return false, time.Duration(missing * float64(time.Second))
+}
+
+// Deletes the buckets that would have been refilled by now, since a missing
+// bucket is the same as a full one, so that clients that have gone idle
+// don't take up memory forever
+func (limiter *rateLimiter) evictFullBuckets(now time.Time) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	for client, bucket := range limiter.buckets {
+		refilled := now.Sub(bucket.updated).Seconds() * limiter.rate
+
+		if bucket.tokens+refilled >= limiter.burst {
+			delete(limiter.buckets, client)
+		}
+	}
+}
+
+// Replaces the remote address of every request with the address of the
+// client the proxy in front of the server forwarded it for, as returned by
+// clientIP, so that it's what gets logged and rate limited. The headers are
+// ignored unless trust is set, since clients can send them too
+func newProxyHandler(trust bool) func(http.Handler) http.Handler {
+	if !trust {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.RemoteAddr = clientIP(r, true)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Returns the IP of the client that made the request. Behind a proxy, that's
+// the last address of the X-Forwarded-For header, the one appended by the
+// proxy itself, or else the X-Real-IP header. The first address would be the
+// original client after several hops, but it's taken from whatever the client
+// sent, so trusting it would let anyone pick the address they're logged and
+// rate limited under. Forwarded addresses that aren't IPs are ignored
+func clientIP(request *http.Request, behindProxy bool) string {
+	if behindProxy {
+		forwardedFor := request.Header.Values("X-Forwarded-For")
+		var address string
+
+		if len(forwardedFor) > 0 {
+			addresses := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+			address = addresses[len(addresses)-1]
+		} else {
+			address = request.Header.Get("X-Real-IP")
+		}
+
+		address = strings.TrimSpace(address)
+
+		if net.ParseIP(address) != nil {
+			return address
+		}
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+
+	if err != nil {
+		return request.RemoteAddr
+	}
+
+	return host
+}
+
+// Records how long the given handler takes to serve each request into the
+// request duration histogram, under the given route
+func measureLatency(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		next.ServeHTTP(w, r)
+		requestDuration.observe(route, time.Since(startTime).Seconds())
+	})
+}
+
+//  __  __ _____ _____ ____  ___ ____ ____
+// |  \/  | ____|_   _|  _ \|_ _/ ___/ ___|
+// | |\/| |  _|   | | | |_) || | |   \___ \
+// | |  | | |___  | | |  _ < | | |___ ___) |
+// |_|  |_|_____| |_| |_| \_\___\____|____/
+//
+
+var receiptsProcessed = newCounterVec(
+	"receipts_processed_total",
+	"Receipts submitted for processing, by result.",
+	"result",
+)
+var pointsLookups = newCounterVec(
+	"points_lookups_total",
+	"Lookups of the points awarded for a receipt, by result.",
+	"result",
+)
+var requestDuration = newHistogramVec(
+	"request_duration_seconds",
+	"Time taken to serve requests, by route.",
+	"route",
+	[]float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+)
+
+var operationDuration = newHistogramVec(
+	"operation_duration_seconds",
+	"Time taken by the steps of serving requests, by the message logged.",
+	"operation",
+	[]float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+)
+
+// Logs the task's duration like timer.WithTimer, and also records it into
+// the operation duration histogram under the message, which is always a
+// literal so that there's a bounded number of series
+func withTimer(message string, task func()) {
+	timer.WithTimer(message, func() {
+		startTime := time.Now()
+		task()
+		operationDuration.observe(message, time.Since(startTime).Seconds())
+	})
+}
+
+// Writes every metric in the Prometheus text format. The handful of metrics
+// here didn't seem worth pulling in the Prometheus client library for
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		receiptsProcessed.writeTo(w)
+		pointsLookups.writeTo(w)
+		requestDuration.writeTo(w)
+		operationDuration.writeTo(w)
+	})
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		counts: make(map[string]uint64),
+	}
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[labelValue] += 1
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+
+	for _, labelValue := range sortedKeys(c.counts) {
+		fmt.Fprintf(
+			w,
+			"%s{%s=%q} %d\n",
+			c.name,
+			c.label,
+			labelValue,
+			c.counts[labelValue],
+		)
+	}
+}
+
+type histogram struct {
+	// Cumulative, so each one counts every observation up to its bucket's
+	// upper bound
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+func newHistogramVec(
+	name string,
+	help string,
+	label string,
+	buckets []float64,
+) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(labelValue string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series, exists := h.series[labelValue]
+
+	if !exists {
+		series = &histogram{bucketCounts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = series
+	}
+
+	for index, upperBound := range h.buckets {
+		if value <= upperBound {
+			series.bucketCounts[index] += 1
+		}
+	}
+
+	series.sum += value
+	series.count += 1
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	for _, labelValue := range sortedKeys(h.series) {
+		series := h.series[labelValue]
+		labels := fmt.Sprintf("%s=%q", h.label, labelValue)
+
+		for index, upperBound := range h.buckets {
+			fmt.Fprintf(
+				w,
+				"%s_bucket{%s,le=\"%s\"} %d\n",
+				h.name,
+				labels,
+				strconv.FormatFloat(upperBound, 'g', -1, 64),
+				series.bucketCounts[index],
+			)
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s_bucket{%s,le=\"+Inf\"} %d\n",
+			h.name,
+			labels,
+			series.count,
+		)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", h.name, labels, series.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels, series.count)
+	}
+}
+
+//  __  __ ___ ____   ____   _   _ _____ ___ _     ___ _____ ___ _____ ____
+// |  \/  |_ _/ ___| / ___| | | | |_   _|_ _| |   |_ _|_   _|_ _| ____/ ___|
+// | |\/| || |\___ \| |     | | | | | |  | || |    | |  | |  | ||  _| \___ \
+// | |  | || | ___) | |___  | |_| | | |  | || |___ | |  | |  | || |___ ___) |
+// |_|  |_|___|____/ \____|  \___/  |_| |___|_____|___| |_| |___|_____|____/
+//
+
+// Reads the entirety of the given request's body, up to maxRequestBodyBytes.
+// Gzipped bodies are decompressed first
+func readRequestBody(
+	w http.ResponseWriter,
+	request *http.Request,
+) ([]byte, error) {
+	body, err := requestBodyReader(w, request, maxRequestBodyBytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// Returns a reader of the given request's body that fails after limit bytes,
+// unless limit is 0, decompressing it when it's gzipped
+func requestBodyReader(
+	w http.ResponseWriter,
+	request *http.Request,
+	limit int64,
+) (io.ReadCloser, error) {
+	body := request.Body
+
+	if limit > 0 {
+		body = http.MaxBytesReader(w, body, limit)
+	}
+
+	if !strings.EqualFold(request.Header.Get("Content-Encoding"), "gzip") {
+		return body, nil
+	}
+
+	gzipReader, err := gzip.NewReader(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The limit applies to the decompressed size as well, otherwise a small
+	// body could expand into a huge one
+	if limit > 0 {
+		return http.MaxBytesReader(w, gzipReader, limit), nil
+	}
+
+	return gzipReader, nil
+}
+
+// Reads the given request's body and unmarshalls it into the given pointer to
+// the JSON schema
+func readUnmarshalRequestBody(
+	w http.ResponseWriter,
+	request *http.Request,
+	schema any,
+) error {
+	requestBodyBytes, err := readRequestBody(w, request)
+
+	if err != nil {
+		return err
+	}
+
+	err = receipt.Unmarshal(requestBodyBytes, schema)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reads the given request's JSON or form encoded receipt body as JSON. Forms
+// are converted to the equivalent JSON, so that they go through exactly the
+// same validation as a JSON body
+func readReceiptRequestBody(
+	w http.ResponseWriter,
+	request *http.Request,
+	mediaType string,
+) ([]byte, error) {
+	requestBodyBytes, err := readRequestBody(w, request)
+
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return requestBodyBytes, err
+	}
+
+	var form url.Values
+	form, err = url.ParseQuery(string(requestBodyBytes))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return receiptJSONFromForm(form)
+}
+
+// Reads the given request's JSON or form encoded body and decodes it into the
+// given receipt with the decoder of the given schema version
+func readDecodeRequestBody(
+	w http.ResponseWriter,
+	request *http.Request,
+	mediaType string,
+	version int,
+	b *ProcessReceiptRequestBody,
+) error {
+	requestBodyBytes, err := readReceiptRequestBody(w, request, mediaType)
+
+	if err != nil {
+		return err
+	}
+
+	b.Receipt, err = decodeReceipt(version, requestBodyBytes)
+	return err
+}
+
+// Reads the given request's JSON or form encoded body into the given receipt
+// and returns every problem with it, rather than failing at the first. A
+// non-nil error means the body couldn't be read at all
+func readValidateRequestBody(
+	w http.ResponseWriter,
+	request *http.Request,
+	mediaType string,
+	b *ProcessReceiptRequestBody,
+) ([]error, error) {
+	requestBodyBytes, err := readReceiptRequestBody(w, request, mediaType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Receipt.ValidateAll(requestBodyBytes, validation), nil
+}
+
+// Maps the item fields, named like "items[0].price", into an array of item
+// objects, and every other field to a top-level string field
+func receiptJSONFromForm(form url.Values) ([]byte, error) {
+	fields := make(map[string]any)
+	itemsByIndex := make(map[int]map[string]string)
+
+	for key := range form {
+		match := formItemKeyRegex.FindStringSubmatch(key)
+
+		if match == nil {
+			fields[key] = form.Get(key)
+			continue
+		}
+
+		index, err := strconv.Atoi(match[1])
+
+		// There can't be more items than fields, which also bounds the size
+		// of the items array below
+		if err != nil || index >= len(form) {
+			return nil, errors.New("Invalid item index")
+		}
+
+		if itemsByIndex[index] == nil {
+			itemsByIndex[index] = make(map[string]string)
+		}
+
+		itemsByIndex[index][match[2]] = form.Get(key)
+	}
+
+	if len(itemsByIndex) > 0 {
+		items := make([]map[string]string, len(itemsByIndex))
+
+		for index, item := range itemsByIndex {
+			if index >= len(items) {
+				return nil, errors.New("Item indices must be consecutive")
+			}
+
+			items[index] = item
+		}
+
+		fields["items"] = items
+	}
+
+	return json.Marshal(fields)
+}
+
+// Returns the media type of the given request's Content-Type header, or an
+// empty string when it's missing
+func requestMediaType(request *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+// Writes the given status and an error body with a machine-readable code
+// alongside the same human-readable message that used to be sent as plain text
+func writeJSONError(
+	w http.ResponseWriter,
+	status int,
+	code string,
+	message string,
+) {
+	// withRequestID has already set the response header by now
+	responseBody, err := json.Marshal(
+		ErrorResponseBody{
+			Error:     message,
+			Code:      code,
+			RequestId: w.Header().Get(requestIDHeader),
+		},
+	)
+
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(responseBody)
+}
+
+// Responds with the generic invalid receipt error, listing each of the given
+// problems alongside it
+func writeValidationErrors(w http.ResponseWriter, problems []error) {
+	responseBody, err := json.Marshal(
+		ErrorResponseBody{
+			Error:     "The receipt is invalid.",
+			Code:      "INVALID_RECEIPT",
+			RequestId: w.Header().Get(requestIDHeader),
+			Errors:    fieldErrors(problems),
+		},
+	)
+
+	if err != nil {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(responseBody)
+}
+
+// Problems that aren't about a particular field are about the whole receipt
+func fieldErrors(problems []error) []receipt.FieldError {
+	fieldErrors := make([]receipt.FieldError, len(problems))
+
+	for index, problem := range problems {
+		if !errors.As(problem, &fieldErrors[index]) {
+			fieldErrors[index] = receipt.FieldError{Message: problem.Error()}
+		}
+	}
+
+	return fieldErrors
+}
+
+// Marshals v as the response body, indented by two spaces when pretty is set,
+// and writes it with the given status. Failures to write it are marked as
+// happening after the response has started
+func writeJSON(w http.ResponseWriter, status int, v any, pretty bool) error {
+	var responseBody []byte
+	var err error
+
+	if pretty {
+		responseBody, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		responseBody, err = json.Marshal(v)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Would otherwise be sniffed as text/plain
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if _, err = w.Write(responseBody); err != nil {
+		return responseStartedError{err}
+	}
+
+	return nil
+}
+
+// Whether to indent JSON responses, for everyone with PRETTY_JSON or for the
+// request with ?pretty=true. Anything else is ignored rather than rejected,
+// since it only affects how the response looks
+func prettyJSON(request *http.Request) bool {
+	pretty, err := boolFromQuery(request.URL.Query(), "pretty")
+
+	return prettyJSONResponses || (err == nil && pretty)
+}
+
+type responseStartedError struct {
+	err error
+}
+
+func (e responseStartedError) Error() string {
+	return e.err.Error()
+}
+
+func (e responseStartedError) Unwrap() error {
+	return e.err
+}
+
+// Responds to a failure to marshal or write a response body with a 500. Once
+// writing has started, the status has already been sent and the client has
+// most likely gone away, so the failure is only logged rather than followed by
+// an error body
+func writeResponseBodyError(w http.ResponseWriter, err error, message string) {
+	var startedError responseStartedError
+
+	if errors.As(err, &startedError) {
+		log.Printf(
+			"Could not write response %s: %v",
+			w.Header().Get(requestIDHeader),
+			err,
+		)
+		return
+	}
+
+	writeJSONError(w, http.StatusInternalServerError, "INTERNAL_ERROR", message)
+}
+
+// Responds to a failure to read the request body with a 413 when it was too
+// large, and with the generic invalid receipt error otherwise
+func writeRequestBodyError(w http.ResponseWriter, err error) {
+	var maxBytesError *http.MaxBytesError
+
+	if errors.As(err, &maxBytesError) {
+		writeJSONError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			"REQUEST_TOO_LARGE",
+			"The request body is too large.",
+		)
+	} else {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		)
+	}
+}
+
+// This path has already been validated as having the format
+// "/receipts/foo", "/receipts/foo/points" or "/receipts/foo/points/breakdown"
+func getReceiptIDFromURLPath(path string) string {
+	pathSegments := strings.Split(path, "/")
+
+	return pathSegments[2]
+}
+
+// Derives the ETag of a points response from everything in it, so that it
+// changes along with the response, and from the receipt ID, so that it
+// differs between receipts with the same points
+func pointsETag(receiptId string, body ReceiptsPointsResponseBody) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf(
+		"%s:%d:%s",
+		receiptId,
+		body.Points,
+		body.Tier,
+	)))
+
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// Reports whether the comma separated ETags of an If-None-Match header
+// include the given one, or are "*". Weak ETags match too, as they should
+// for GET requests
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Receipt IDs are UUIDs unless a store generates them otherwise, as with
+// WithIDGenerator, so any ID that fits in a single path segment is accepted.
+// Dots are left out so that "." and ".." can't name a receipt
+func isValidReceiptID(receiptId string) bool {
+	return receiptIDRegex.MatchString(receiptId)
+}
+
+// Tells clients that the ID in the path is malformed, rather than that there's
+// no receipt with a well-formed ID
+func writeInvalidReceiptIDError(w http.ResponseWriter) {
+	writeJSONError(
+		w,
+		http.StatusBadRequest,
+		"INVALID_RECEIPT_ID",
+		"Invalid receipt ID format.",
+	)
+}
+
+// Builds the address for the server to listen on from the HOST and PORT
+// environment variables, defaulting to port 8000 on all interfaces
+func listenAddress() (string, error) {
+	port := os.Getenv("PORT")
+
+	if port == "" {
+		port = "8000"
+	}
+
+	portNumber, err := strconv.Atoi(port)
+
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return "", fmt.Errorf(
+			"PORT must be a number between 1 and 65535, got %q", port,
+		)
+	}
+
+	return net.JoinHostPort(os.Getenv("HOST"), port), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func loadValidationConfig() (receipt.ValidationConfig, error) {
+	var config receipt.ValidationConfig
+	var err error
+
+	config.RequireMatchingTotal, err = boolFromEnv("REQUIRE_MATCHING_TOTAL")
+
+	if err != nil {
+		return config, err
+	}
+
+	config.RejectFuturePurchaseDate, err = boolFromEnv(
+		"REJECT_FUTURE_PURCHASE_DATES",
+	)
+
+	if err != nil {
+		return config, err
+	}
+
+	config.RejectZeroPrices, err = boolFromEnv("REJECT_ZERO_PRICES")
+
+	if err != nil {
+		return config, err
+	}
+
+	maxItems, err := int64FromEnv("MAX_RECEIPT_ITEMS", defaultMaxReceiptItems)
+	config.MaxItems = int(maxItems)
+
+	return config, err
+}
+
+// Builds the server for the given address and handler with the timeouts in
+// the READ_TIMEOUT, READ_HEADER_TIMEOUT, WRITE_TIMEOUT and IDLE_TIMEOUT
+// environment variables, so that slow clients can't hold connections open
+// forever like they could with the zero value of http.Server
+func newServer(address string, handler http.Handler) (*http.Server, error) {
+	var err error
+
+	server := &http.Server{Addr: address, Handler: handler}
+	timeouts := []struct {
+		name     string
+		fallback time.Duration
+		timeout  *time.Duration
+	}{
+		{"READ_TIMEOUT", 5 * time.Second, &server.ReadTimeout},
+		{"READ_HEADER_TIMEOUT", 5 * time.Second, &server.ReadHeaderTimeout},
+		{"WRITE_TIMEOUT", 10 * time.Second, &server.WriteTimeout},
+		{"IDLE_TIMEOUT", 120 * time.Second, &server.IdleTimeout},
+	}
+
+	for _, t := range timeouts {
+		*t.timeout, err = durationFromEnv(t.name, t.fallback)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return server, nil
+}
+
+// Returns the points awarded to the receipt under the configured rules
+func computeReceiptPoints(r receipt.Receipt) int64 {
+	return r.ComputePoints(rules)
+}
+
+// Buckets the points into the bronze, silver or gold tier, by the tier
+// thresholds of the rule config
+func classifyTier(points int64, cfg receipt.RuleConfig) string {
+	if points >= cfg.GoldTierPoints {
+		return "gold"
+	} else if points >= cfg.SilverTierPoints {
+		return "silver"
+	} else {
+		return "bronze"
+	}
+}
+
+// Parses the query parameter with the given name as a non-negative integer,
+// returning the fallback when it's absent
+func intFromQuery(query url.Values, name string, fallback int) (int, error) {
+	value := query.Get(name)
+
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+
+	return parsed, nil
+}
+
+// Returns false when the query parameter isn't set
+func boolFromQuery(query url.Values, name string) (bool, error) {
+	value := query.Get(name)
+
+	if value == "" {
+		return false, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+
+	return parsed, nil
+}
+
+// Splits the comma separated environment variable with the given name,
+// dropping any empty entries
+func listFromEnv(name string) []string {
+	var values []string
+
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// Parses the integer environment variable with the given name, returning
+// the fallback when it's unset
+func int64FromEnv(name string, fallback int64) (int64, error) {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf(
+			"%s must be a positive integer, got %q", name, value,
+		)
+	}
+
+	return parsed, nil
+}
+
+// Like int64FromEnv, but accepts 0 too, for variables where 0 turns a limit
+// off
+func nonNegativeInt64FromEnv(name string, fallback int64) (int64, error) {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf(
+			"%s must be a non-negative integer, got %q", name, value,
+		)
+	}
+
+	return parsed, nil
+}
+
+// Parses the decimal environment variable with the given name, returning
+// the fallback when it's unset
+func float64FromEnv(name string, fallback float64) (float64, error) {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+
+	if err != nil || parsed <= 0 || math.IsInf(parsed, 0) {
+		return 0, fmt.Errorf(
+			"%s must be a positive number, got %q", name, value,
+		)
+	}
+
+	return parsed, nil
+}
+
+// Parses the duration environment variable with the given name, like "90s"
+// or "24h", returning the fallback when it's unset
+func durationFromEnv(
+	name string,
+	fallback time.Duration,
+) (time.Duration, error) {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf(
+			"%s must be a positive duration, got %q", name, value,
+		)
+	}
+
+	return parsed, nil
+}
+
+// Parses the boolean environment variable with the given name, which is
+// false when unset
+func boolFromEnv(name string) (bool, error) {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return false, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean, got %q", name, value)
+	}
+
+	return parsed, nil
+}
+
+//   ___  _   _ _____ _   _ _____
+//  / _ \| | | | ____| | | | ____|
+// | | | | | | |  _| | | | |  _|
+// | |_| | |_| | |___| |_| | |___
+//  \__\_\\___/|_____|\___/|_____|
+//
+
+// Computes the points of processed receipts in the background, so that
+// processing can respond before they're computed. Only receipts processed one
+// at a time by receiptsProcessHandler are enqueued, and only xDB, which
+// computes points on first lookup, leaves any to compute
+type processingQueue struct {
+	receiptIds chan string
+	mu         sync.Mutex
+	// The receipts enqueued whose points haven't been computed yet
+	pending map[string]bool
+}
+
+// Starts the given number of workers, which run for as long as the process
+// does. Receipts still in the queue when it exits are computed on first lookup
+// instead, like any other receipt
+func newProcessingQueue(size int, workers int) *processingQueue {
+	queue := &processingQueue{
+		receiptIds: make(chan string, size),
+		pending:    make(map[string]bool),
+	}
+
+	for worker := 0; worker < workers; worker++ {
+		go queue.work()
+	}
+
+	return queue
+}
+
+// Returns false without enqueueing the receipt when the queue is full, leaving
+// its points to be computed on first lookup
+func (queue *processingQueue) enqueue(receiptId string) bool {
+	// Held while sending so that a worker can't finish with the receipt
+	// before it's marked pending
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	select {
+	case queue.receiptIds <- receiptId:
+		queue.pending[receiptId] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// A nil queue, when receipts are processed synchronously, has nothing pending
+func (queue *processingQueue) isPending(receiptId string) bool {
+	if queue == nil {
+		return false
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	return queue.pending[receiptId]
+}
+
+func (queue *processingQueue) work() {
+	for receiptId := range queue.receiptIds {
+		// Looking the points up computes and stores them. Receipts deleted
+		// in the meantime are simply skipped
+		_, err := db.getReceiptPoints(context.Background(), receiptId)
+
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("Could not compute the points of %s: %v", receiptId, err)
+		}
+
+		queue.mu.Lock()
+		delete(queue.pending, receiptId)
+		queue.mu.Unlock()
+	}
+}
+
+// __        _______ ____  _   _  ___   ___  _  ______
+// \ \      / / ____| __ )| | | |/ _ \ / _ \| |/ / ___|
+//  \ \ /\ / /|  _| |  _ \| |_| | | | | | | | ' /\___ \
+//   \ V  V / | |___| |_) |  _  | |_| | |_| | . \ ___) |
+//    \_/\_/  |_____|____/|_| |_|\___/ \___/|_|\_\____/
+//
+
+type WebhookPayload struct {
+	ReceiptId string `json:"id"`
+	Points    int64  `json:"points"`
+	Retailer  string `json:"retailer"`
+}
+
+// POSTs a WebhookPayload to the URL for every receipt processed, from a single
+// goroutine so that slow webhooks can't hold up processing
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+	// How many more times a failed notification is sent before it's dropped
+	retries    int
+	receiptIds chan string
+}
+
+// The delay before the first retry, which doubles with every retry after it
+const webhookRetryDelay = 500 * time.Millisecond
+
+// Starts the goroutine sending the notifications, which runs for as long as
+// the process does
+func newWebhookNotifier(
+	url string,
+	timeout time.Duration,
+	retries int,
+	queueSize int,
+) *webhookNotifier {
+	notifier := &webhookNotifier{
+		url:        url,
+		client:     &http.Client{Timeout: timeout},
+		retries:    retries,
+		receiptIds: make(chan string, queueSize),
+	}
+
+	go notifier.work()
+
+	return notifier
+}
+
+// Does nothing on a nil notifier, when no webhook is set. Drops the
+// notification when queueSize of them are already waiting to be sent
+func (notifier *webhookNotifier) notify(receiptId string) {
+	if notifier == nil {
+		return
+	}
+
+	select {
+	case notifier.receiptIds <- receiptId:
+	default:
+		log.Printf("Dropped the webhook notification for %s", receiptId)
+	}
+}
+
+func (notifier *webhookNotifier) work() {
+	for receiptId := range notifier.receiptIds {
+		if err := notifier.send(receiptId); err != nil {
+			log.Printf(
+				"Could not notify the webhook of %s: %v",
+				receiptId,
+				err,
+			)
+		}
+	}
+}
+
+// Sends the notification for the receipt, retrying after failed requests and
+// non-2xx responses. Receipts deleted in the meantime aren't notified
+func (notifier *webhookNotifier) send(receiptId string) error {
+	receiptRow, err := db.getReceiptRow(receiptId)
+
+	if err != nil {
+		return err
+	}
+
+	points, err := db.getReceiptPoints(context.Background(), receiptId)
+
+	if err != nil {
+		return err
+	}
+
+	requestBody, err := json.Marshal(WebhookPayload{
+		ReceiptId: receiptId,
+		Points:    points,
+		Retailer:  string(receiptRow.Retailer),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	delay := webhookRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err = notifier.post(requestBody)
+
+		if err == nil || attempt == notifier.retries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (notifier *webhookNotifier) post(requestBody []byte) error {
+	response, err := notifier.client.Post(
+		notifier.url,
+		"application/json",
+		bytes.NewReader(requestBody),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded with %s", response.Status)
+	}
+
+	return nil
+}
+
+//  _ _ ____  ____ _ _
+// ( | )  _ \| __ | | )
+//  V V| | | |  _ \V V
+//     | |_| | |_) |
+//     |____/|____/
+//
+
+// Narrows down the receipts listed. The zero value lists every receipt
+type ReceiptFilter struct {
+	// Only the receipts of this retailer are listed, unless it's empty
+	Retailer string
+	// Only the receipts awarded at least this many points are listed
+	MinPoints int64
+}
+
+// The operations the handlers need from a receipt store. xDB keeps receipts
+// in memory, optionally backed by a JSON lines file, and sqliteStore keeps
+// them in a SQLite database. The operations taking a context give up once it's
+// done, like when the client disconnects
+type Storage interface {
+	writeReceipt(ctx context.Context, r receipt.Receipt) (string, error)
+	writeReceiptIdempotent(
+		ctx context.Context,
+		key string,
+		r receipt.Receipt,
+	) (string, bool, error)
+	getReceiptRow(receiptId string) (ReceiptRow, error)
+	getReceiptPoints(ctx context.Context, receiptId string) (int64, error)
+	// Leaves out the receipts that don't exist
+	getReceiptsPoints(
+		ctx context.Context,
+		receiptIds []string,
+	) (map[string]int64, error)
+	// Returns the row with its points, breakdown and item points, computing
+	// them all under the configured rules if they haven't been yet
+	getComputedReceiptRow(receiptId string) (ReceiptRow, error)
+	listReceipts(
+		filter ReceiptFilter,
+		limit int,
+		offset int,
+	) ([]ReceiptSummary, int, error)
+	// Returns up to n rows with the most points, sorted by rankedBefore
+	topReceipts(n int) ([]ReceiptRow, error)
+	stats() (ReceiptStats, error)
+	deleteReceipt(receiptId string) error
+	count() (int, error)
+	export(writer io.Writer) error
+	importRows(reader io.Reader) (int, error)
+	updateReceiptRow(row ReceiptRow) error
+	// Applies the patch to the stored receipt with patchReceipt, recomputes
+	// its points and returns them
+	updateReceipt(
+		receiptId string,
+		patch map[string]json.RawMessage,
+	) (int64, error)
+	recomputeReceipt(receiptId string, cfg receipt.RuleConfig) (int64, error)
+	recomputeAllPoints(cfg receipt.RuleConfig) (int, error)
+	Ping(ctx context.Context) error
+	StartEviction(ttl time.Duration, interval time.Duration)
+	Stop()
+}
+
+// Returned when there's no receipt with the given ID
+var ErrNotFound = errors.New("No receipt with given ID exists")
+
+// Returned by updateReceipt when the patched receipt is invalid, wrapped along
+// with the problem with it
+var ErrInvalidPatch = errors.New("Patched receipt is invalid")
+
+// Returned by updateReceiptRow when the row was changed or deleted since it
+// was read, in which case it can be read again and the update retried
+var ErrConflict = errors.New("Receipt row was changed by another write")
+
+type xDB struct {
+	// Keyed by receipt ID
+	Receipts map[string]ReceiptRow
+	// Maps idempotency keys to the ID of the receipt written with them
+	IdempotencyKeys map[string]string
+	// Maps retailer names to the IDs of their receipts
+	ReceiptIdsByRetailer map[string][]string
+	Mu                   sync.RWMutex
+	// Receipt rows are appended to this file as JSON lines when it's set
+	File *os.File
+	// The number of lines in File, counting rows since replaced or evicted
+	fileLines int
+	// Closed to stop the eviction goroutine, nil when it isn't running
+	stopEviction chan struct{}
+	// Generates the ID of every receipt written
+	IDGenerator func() string
+	// The most receipts kept, beyond which the least recently used are
+	// evicted. Unlimited when 0. Set with SetMaxReceipts
+	maxReceipts int
+	// Receipt IDs from the most to the least recently written or looked up.
+	// Guarded by recencyMu as well as Mu, since lookups only hold the read
+	// lock. Mu is always locked first
+	recency         *list.List
+	recencyElements map[string]*list.Element
+	recencyMu       sync.Mutex
+}
+
+type XDBOption func(*xDB)
+
+// Generates receipt IDs with the given function rather than uuid.NewString,
+// like a counter or prefixed IDs. The IDs have to be made of letters, digits,
+// underscores and hyphens for isValidReceiptID to accept them. Only xDB takes
+// options, so sqliteStore always generates UUIDs
+func WithIDGenerator(generator func() string) XDBOption {
+	return func(db *xDB) {
+		db.IDGenerator = generator
+	}
+}
+
+func NewXDB(opts ...XDBOption) *xDB {
+	db := &xDB{
+		Receipts:             make(map[string]ReceiptRow),
+		IdempotencyKeys:      make(map[string]string),
+		ReceiptIdsByRetailer: make(map[string][]string),
+		IDGenerator:          uuid.NewString,
+	}
+
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	return db
+}
+
+// Loads the receipt rows in the JSON lines file at the given path, creating
+// it if it doesn't exist yet, and appends every receipt written from then on
+func NewXDBFromFile(path string, opts ...XDBOption) (*xDB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	db := NewXDB(opts...)
+	decoder := json.NewDecoder(file)
+
+	for {
+		var line json.RawMessage
+		err = decoder.Decode(&line)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		db.fileLines += 1
+
+		if err := db.loadFileLine(line); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	db.File = file
+	return db, nil
+}
+
+// Appended to the file when a receipt is evicted, which takes the receipt back
+// out when the file is loaded
+type evictedLine struct {
+	ReceiptId string `json:"id"`
+	Evicted   bool   `json:"evicted"`
+}
+
+// Stores the row on the line, or removes the receipt evicted by it. Assumes
+// the caller holds the write lock
+func (db *xDB) loadFileLine(line json.RawMessage) error {
+	var evicted evictedLine
+
+	if err := json.Unmarshal(line, &evicted); err != nil {
+		return err
+	}
+
+	if evicted.Evicted {
+		if row, exists := db.Receipts[evicted.ReceiptId]; exists {
+			db.removeReceiptRow(row)
+		}
+
+		return nil
+	}
+
+	var row ReceiptRow
+
+	if err := json.Unmarshal(line, &row); err != nil {
+		return err
+	}
+
+	// Rows written before item points were stored have them attributed under
+	// the configured rules instead
+	if row.Computed && row.ItemPoints == nil {
+		row.ItemPoints = row.Receipt.ComputeItemPoints(rules)
+	}
+
+	db.putReceiptRow(row)
+	return nil
+}
+
+type ReceiptRow struct {
+	receipt.Receipt
+	ReceiptId    string                  `json:"id"`
+	Points       int64                   `json:"points"`
+	Breakdown    receipt.PointsBreakdown `json:"breakdown"`
+	CreationDate time.Time               `json:"creationDate"`
+	// Attributes the points of the breakdown's item description rule to each
+	// item, computed under the same rules as the breakdown
+	ItemPoints []receipt.ItemPoints `json:"itemPoints"`
+	// Points are computed on first lookup rather than on write, since many
+	// receipts are never queried
+	Computed bool `json:"computed"`
+	// Set when the receipt was written with an Idempotency-Key header
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Incremented by every update, which only goes through when the stored
+	// row still has the version the update was made from
+	Version int `json:"version"`
+}
+
+func (db *xDB) writeReceipt(
+	ctx context.Context,
+	r receipt.Receipt,
+) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	row, err := newReceiptRow(r, db.IDGenerator())
+
+	if err != nil {
+		return "", err
+	}
+
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	// Waiting for the lock may have taken a while
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return row.ReceiptId, db.insertReceiptRow(row)
+}
+
+// Writes the receipt unless one was already written with the given
+// idempotency key, in which case the ID of that receipt is returned instead.
+// The returned bool is true when it was a replay
+func (db *xDB) writeReceiptIdempotent(
+	ctx context.Context,
+	key string,
+	r receipt.Receipt,
+) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	// Waiting for the lock may have taken a while
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	if receiptId, exists := db.IdempotencyKeys[key]; exists {
+		return receiptId, true, nil
+	}
+
+	row, err := newReceiptRow(r, db.IDGenerator())
+
+	if err != nil {
+		return "", false, err
+	}
+
+	row.IdempotencyKey = key
+
+	return row.ReceiptId, false, db.insertReceiptRow(row)
+}
+
+func newReceiptRow(r receipt.Receipt, receiptId string) (ReceiptRow, error) {
+	if err := r.Validate(validation); err != nil {
+		return ReceiptRow{}, err
+	}
+
+	return ReceiptRow{
+		Receipt:      r,
+		ReceiptId:    receiptId,
+		CreationDate: time.Now().UTC(),
+	}, nil
+}
+
+// Computes the points under the configured rules
+func (row *ReceiptRow) computePoints() {
+	row.computePointsWithConfig(rules)
+}
+
+func (row *ReceiptRow) computePointsWithConfig(cfg receipt.RuleConfig) {
+	row.Breakdown = row.Receipt.ComputePointsBreakdown(cfg)
+	row.ItemPoints = row.Receipt.ComputeItemPoints(cfg)
+	row.Points = row.Breakdown.Total()
+	row.Computed = true
+}
+
+// The file is compacted once it holds more than this many lines per receipt
+// kept, while the number kept is capped
+const maxFileLinesPerReceipt = 2
+
+// Assumes the caller holds the write lock
+func (db *xDB) insertReceiptRow(row ReceiptRow) error {
+	if err := db.appendLineToFile(row); err != nil {
+		return err
+	}
+
+	db.putReceiptRow(row)
+
+	for _, receiptId := range db.evictLeastRecentlyUsed() {
+		line := evictedLine{ReceiptId: receiptId, Evicted: true}
+
+		if err := db.appendLineToFile(line); err != nil {
+			return err
+		}
+	}
+
+	// Compacting on every eviction would rewrite the whole file on every
+	// write once the store is full
+	limit := maxFileLinesPerReceipt * db.maxReceipts
+
+	if db.maxReceipts > 0 && db.fileLines > limit {
+		return db.rewriteFile()
+	}
+
+	return nil
+}
+
+// Stores the row along with its idempotency key mapping, if it has one, and
+// its retailer index entry, replacing any row already stored under the same
+// ID. Assumes the caller holds the write lock
+func (db *xDB) putReceiptRow(row ReceiptRow) {
+	if existing, exists := db.Receipts[row.ReceiptId]; exists {
+		db.removeReceiptRow(existing)
+	}
+
+	db.Receipts[row.ReceiptId] = row
+	retailer := string(row.Retailer)
+	db.ReceiptIdsByRetailer[retailer] = append(
+		db.ReceiptIdsByRetailer[retailer],
+		row.ReceiptId,
+	)
+
+	if row.IdempotencyKey != "" {
+		db.IdempotencyKeys[row.IdempotencyKey] = row.ReceiptId
+	}
+
+	db.touchReceipt(row.ReceiptId)
+}
+
+// Removes the row along with its idempotency key mapping, if it has one, and
+// its retailer index entry. Assumes the caller holds the write lock
+func (db *xDB) removeReceiptRow(row ReceiptRow) {
+	delete(db.Receipts, row.ReceiptId)
+	retailer := string(row.Retailer)
+	receiptIds := slices.DeleteFunc(
+		db.ReceiptIdsByRetailer[retailer],
+		func(receiptId string) bool { return receiptId == row.ReceiptId },
+	)
+
+	if len(receiptIds) == 0 {
+		delete(db.ReceiptIdsByRetailer, retailer)
+	} else {
+		db.ReceiptIdsByRetailer[retailer] = receiptIds
+	}
+
+	if row.IdempotencyKey != "" {
+		delete(db.IdempotencyKeys, row.IdempotencyKey)
+	}
+
+	db.recencyMu.Lock()
+	defer db.recencyMu.Unlock()
+
+	if element, exists := db.recencyElements[row.ReceiptId]; exists {
+		db.recency.Remove(element)
+		delete(db.recencyElements, row.ReceiptId)
+	}
+}
+
+// Marks the receipt as the most recently used. Assumes the caller holds
+// either lock
+func (db *xDB) touchReceipt(receiptId string) {
+	db.recencyMu.Lock()
+	defer db.recencyMu.Unlock()
+
+	if db.recency == nil {
+		db.recency = list.New()
+		db.recencyElements = make(map[string]*list.Element)
+	}
+
+	if element, exists := db.recencyElements[receiptId]; exists {
+		db.recency.MoveToFront(element)
+	} else {
+		db.recencyElements[receiptId] = db.recency.PushFront(receiptId)
+	}
+}
+
+// Removes the least recently used receipts until there are at most
+// maxReceipts, without rewriting the file. Assumes the caller holds the write
+// lock. Returns the IDs of the receipts evicted
+func (db *xDB) evictLeastRecentlyUsed() []string {
+	var evicted []string
+
+	for db.maxReceipts > 0 && len(db.Receipts) > db.maxReceipts {
+		db.recencyMu.Lock()
+		receiptId := db.recency.Back().Value.(string)
+		db.recencyMu.Unlock()
+
+		db.removeReceiptRow(db.Receipts[receiptId])
+		evicted = append(evicted, receiptId)
+	}
+
+	return evicted
+}
+
+// Caps the number of receipts kept at n, evicting the least recently written
+// or looked up receipts whenever another is written. Receipts loaded from a
+// file count as used in the order they were last written, or were used as of
+// the file's last compaction. Unlimited when n is 0
+func (db *xDB) SetMaxReceipts(n int) error {
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	db.maxReceipts = n
+
+	if len(db.evictLeastRecentlyUsed()) > 0 {
+		return db.rewriteFile()
+	}
+
+	return nil
+}
+
+// Assumes the caller holds the write lock
+func (db *xDB) appendLineToFile(value any) error {
+	if db.File == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(value)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.File.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	db.fileLines += 1
+	return nil
+}
+
+// Replaces the file with one holding only the rows currently stored, from the
+// least to the most recently used so that loading it keeps their order.
+// Compacts away replaced and evicted rows. Assumes the caller holds the write
+// lock
+func (db *xDB) rewriteFile() error {
+	if db.File == nil {
+		return nil
+	}
+
+	path := db.File.Name()
+	temporaryFile, err := os.CreateTemp(
+		filepath.Dir(path),
+		filepath.Base(path)+".*",
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(temporaryFile.Name())
+	encoder := json.NewEncoder(temporaryFile)
+	db.recencyMu.Lock()
+	defer db.recencyMu.Unlock()
+	var element *list.Element
+
+	if db.recency != nil {
+		element = db.recency.Back()
+	}
+
+	for element != nil {
+		row := db.Receipts[element.Value.(string)]
+
+		if err := encoder.Encode(row); err != nil {
+			temporaryFile.Close()
+			return err
+		}
+
+		element = element.Prev()
+	}
+
+	if err := temporaryFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temporaryFile.Name(), path); err != nil {
+		return err
+	}
+
+	db.File.Close()
+	db.File, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	db.fileLines = len(db.Receipts)
+	return err
+}
+
+// Deletes every receipt created more than ttl ago every interval, until Stop
+// is called
+func (db *xDB) StartEviction(ttl time.Duration, interval time.Duration) {
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	if db.stopEviction != nil {
+		return
+	}
+
+	db.stopEviction = make(chan struct{})
+	go runEviction(db.evictExpiredReceipts, ttl, interval, db.stopEviction)
+}
+
+// Calls evict with the given ttl every interval until stop is closed
+func runEviction(
+	evict func(ttl time.Duration) (int, error),
+	ttl time.Duration,
+	interval time.Duration,
+	stop <-chan struct{},
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			evicted, err := evict(ttl)
+
+			if err != nil {
+				log.Printf("Could not evict expired receipts: %v", err)
+			} else if evicted > 0 {
+				log.Printf("Evicted %d expired receipts", evicted)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (db *xDB) Stop() {
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	if db.stopEviction != nil {
+		close(db.stopEviction)
+		db.stopEviction = nil
+	}
+}
+
+// Returns the number of receipts deleted
+func (db *xDB) evictExpiredReceipts(ttl time.Duration) (int, error) {
+	cutoff := time.Now().UTC().Add(-ttl)
+
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	evicted := 0
+
+	for _, row := range db.Receipts {
+		if row.CreationDate.Before(cutoff) {
+			db.removeReceiptRow(row)
+			evicted += 1
+		}
+	}
+
+	if evicted == 0 {
+		return 0, nil
+	}
+
+	return evicted, db.rewriteFile()
+}
+
+func (db *xDB) deleteReceipt(receiptId string) error {
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	row, exists := db.Receipts[receiptId]
+
+	if !exists {
+		return ErrNotFound
+	}
+
+	db.removeReceiptRow(row)
+	return db.rewriteFile()
+}
+
+func (db *xDB) getReceiptRow(receiptId string) (ReceiptRow, error) {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+
+	if receiptRow, exists := db.Receipts[receiptId]; exists {
+		db.touchReceipt(receiptId)
+		return receiptRow, nil
+	}
 
-	return s
+	return ReceiptRow{}, ErrNotFound
 }
 
-func main() {
-	timer.WithTimer("server", func() {
-		var s *http.ServeMux = defineResources()
-		log.Fatal(http.ListenAndServe(":8000", s))
-	})
-}
+// Returns the requested page of the receipts matching the filter, sorted by
+// creation date and then ID, which keeps the pages stable since map iteration
+// order is random, along with the total number of matching receipts
+func (db *xDB) listReceipts(
+	filter ReceiptFilter,
+	limit int,
+	offset int,
+) ([]ReceiptSummary, int, error) {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
 
-//  ____  _____ ____   ___  _   _ ____   ____ _____
-// |  _ \| ____/ ___| / _ \| | | |  _ \ / ___| ____|
-// | |_) |  _| \___ \| | | | | | | |_) | |   |  _|
-// |  _ <| |___ ___) | |_| | |_| |  _ <| |___| |___
-// |_| \_\_____|____/ \___/ \___/|_| \_\\____|_____|
-//
-//  _   _    _    _   _ ____  _     _____ ____  ____
-// | | | |  / \  | \ | |  _ \| |   | ____|  _ \/ ___|
-// | |_| | / _ \ |  \| | | | | |   |  _| | |_) \___ \
-// |  _  |/ ___ \| |\  | |_| | |___| |___|  _ < ___) |
-// |_| |_/_/   \_\_| \_|____/|_____|_____|_| \_\____/
-//
+	var rows []ReceiptRow
 
-func healthHandler() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("go fetch !"))
-	})
-}
+	if filter.Retailer != "" {
+		rows = db.getReceiptsByRetailer(filter.Retailer)
+	} else {
+		rows = make([]ReceiptRow, 0, len(db.Receipts))
 
-func receiptsSubresourceHandler() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Guaranteed to have at least 3 elements, "", "receipts", and ""
-		pathSegments := strings.Split(r.URL.Path, "/")
+		for _, receiptRow := range db.Receipts {
+			rows = append(rows, receiptRow)
+		}
+	}
 
-		if len(pathSegments) == 3 && pathSegments[2] == "process" {
-			receiptsProcessHandler(w, r)
-		} else if len(pathSegments) == 4 && pathSegments[3] == "points" {
-			receiptsPointsHandler(w, r)
+	if filter.MinPoints > 0 {
+		// Every row has to be computed to be filtered by its points
+		for index := range rows {
+			if !rows[index].Computed {
+				rows[index].computePoints()
+			}
 		}
-	})
-}
 
-func receiptsProcessHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
-		return
+		rows = slices.DeleteFunc(rows, func(row ReceiptRow) bool {
+			return row.Points < filter.MinPoints
+		})
 	}
 
-	var b ProcessReceiptRequestBody
+	sortReceiptRows(rows)
+	summaries := make([]ReceiptSummary, 0, limit)
 
-	timer.WithTimer("reading/unmarshalling request body", func() {
-		err = readUnmarshalRequestBody(r, &b)
-	})
+	for index := offset; index < len(rows) && index < offset+limit; index++ {
+		// Only a read lock is held here, so points that have not been computed
+		// yet are computed for the summary without being cached
+		if !rows[index].Computed {
+			rows[index].computePoints()
+		}
 
-	if err != nil {
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
-		return
+		summaries = append(summaries, ReceiptSummary{
+			ReceiptId:    rows[index].ReceiptId,
+			Points:       rows[index].Points,
+			CreationDate: rows[index].CreationDate.Format(time.RFC3339),
+		})
 	}
 
-	var receiptId string
+	return summaries, len(rows), nil
+}
 
-	timer.WithTimer("writing receipt to storage", func() {
-		receiptId, err = db.writeReceipt(b.Receipt)
-	})
+// Keeps the n rows with the most points seen so far in a heap whose root is
+// the lowest ranked of them, so that finding them takes O(len * log n) rather
+// than sorting every row
+func (db *xDB) topReceipts(n int) ([]ReceiptRow, error) {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
 
-	if err != nil {
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
-		return
+	if n == 0 {
+		return []ReceiptRow{}, nil
 	}
 
-	timer.WithTimer("writing receipt ID to response body", func() {
-		responseBody, err := json.Marshal(
-			ProcessReceiptsResponseBody{ReceiptId: receiptId},
-		)
+	top := make(receiptRowHeap, 0, min(n, len(db.Receipts)))
 
-		if err != nil {
-			return
+	for _, row := range db.Receipts {
+		// Only a read lock is held here, so points that have not been computed
+		// yet are computed without being cached
+		if !row.Computed {
+			row.computePoints()
+		}
+
+		if len(top) < n {
+			heap.Push(&top, row)
+		} else if rankedBefore(row, top[0]) {
+			top[0] = row
+			heap.Fix(&top, 0)
+		}
+	}
+
+	slices.SortFunc(top, func(a ReceiptRow, b ReceiptRow) int {
+		if rankedBefore(a, b) {
+			return -1
 		}
 
-		_, err = w.Write(responseBody)
+		return 1
 	})
 
-	if err != nil {
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
-	}
+	return top, nil
 }
 
-func receiptsPointsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
-		return
-	}
+// Computes every statistic in a single pass over the rows
+func (db *xDB) stats() (ReceiptStats, error) {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
 
-	var receiptId string
+	stats := ReceiptStats{
+		Receipts:           len(db.Receipts),
+		ReceiptsByRetailer: make(map[string]int, len(db.ReceiptIdsByRetailer)),
+	}
 
-	timer.WithTimer("getting receipt ID from request URL path", func() {
-		receiptId = getReceiptIDFromURLPath(r.URL.Path)
-	})
+	first := true
 
-	var receiptPoints int64
+	for _, row := range db.Receipts {
+		// Only a read lock is held here, so points that have not been computed
+		// yet are computed without being cached
+		if !row.Computed {
+			row.computePoints()
+		}
 
-	timer.WithTimer("getting the points awarded for the given receipt", func() {
-		receiptPoints, err = db.getReceiptPoints(receiptId)
-	})
+		if first || row.Points < stats.MinPoints {
+			stats.MinPoints = row.Points
+		}
 
-	if err != nil {
-		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
-		return
+		first = false
+		stats.MaxPoints = max(stats.MaxPoints, row.Points)
+		stats.TotalPoints += row.Points
+		stats.ReceiptsByRetailer[string(row.Receipt.Retailer)]++
 	}
 
-	timer.WithTimer("writing points to response body", func() {
-		responseBody, err := json.Marshal(
-			ReceiptsPointsResponseBody{Points: receiptPoints},
-		)
+	if stats.Receipts > 0 {
+		stats.AveragePoints = float64(stats.TotalPoints) /
+			float64(stats.Receipts)
+	}
 
-		if err != nil {
-			return
-		}
+	return stats, nil
+}
 
-		_, err = w.Write(responseBody)
-	})
+// Ranks rows with more points first. Ties go to the earlier receipt and then
+// to the lower ID, so that the leaderboard doesn't change between requests
+func rankedBefore(a ReceiptRow, b ReceiptRow) bool {
+	if a.Points != b.Points {
+		return a.Points > b.Points
+	}
 
-	if err != nil {
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+	if !a.CreationDate.Equal(b.CreationDate) {
+		return a.CreationDate.Before(b.CreationDate)
 	}
+
+	return a.ReceiptId < b.ReceiptId
 }
 
-//  ____  _____ ___      ______  _____ ____  ____
-// |  _ \| ____/ _ \    / /  _ \| ____/ ___||  _ \
-// | |_) |  _|| | | |  / /| |_) |  _| \___ \| |_) |
-// |  _ <| |__| |_| | / / |  _ <| |___ ___) |  __/
-// |_| \_\_____\__\_\/_/  |_| \_\_____|____/|_|
-//
-//  ____   ____ _   _ _____ __  __    _    ____
-// / ___| / ___| | | | ____|  \/  |  / \  / ___|
-// \___ \| |   | |_| |  _| | |\/| | / _ \ \___ \
-//  ___) | |___|  _  | |___| |  | |/ ___ \ ___) |
-// |____/ \____|_| |_|_____|_|  |_/_/   \_\____/
-//
+// A min-heap of rows under rankedBefore, implementing heap.Interface
+type receiptRowHeap []ReceiptRow
 
-type ProcessReceiptRequestBody struct {
-	Receipt
+func (h receiptRowHeap) Len() int {
+	return len(h)
 }
 
-type ProcessReceiptsResponseBody struct {
-	ReceiptId string `json:"id"`
+func (h receiptRowHeap) Less(i int, j int) bool {
+	return rankedBefore(h[j], h[i])
 }
 
-type ReceiptsPointsResponseBody struct {
-	Points int64 `json:"points"`
+func (h receiptRowHeap) Swap(i int, j int) {
+	h[i], h[j] = h[j], h[i]
 }
 
-//  __  __ ___ ____   ____   ____   ____ _   _ _____ __  __    _    ____
-// |  \/  |_ _/ ___| / ___| / ___| / ___| | | | ____|  \/  |  / \  / ___|
-// | |\/| || |\___ \| |     \___ \| |   | |_| |  _| | |\/| | / _ \ \___ \
-// | |  | || | ___) | |___   ___) | |___|  _  | |___| |  | |/ ___ \ ___) |
-// |_|  |_|___|____/ \____| |____/ \____|_| |_|_____|_|  |_/_/   \_\____/
-//
+func (h *receiptRowHeap) Push(row any) {
+	*h = append(*h, row.(ReceiptRow))
+}
 
-type Retailer string
+func (h *receiptRowHeap) Pop() any {
+	old := *h
+	row := old[len(old)-1]
+	*h = old[:len(old)-1]
 
-func (r *Retailer) UnmarshalJSON(data []byte) error {
-	str, err := obtainQuotedString(&data)
+	return row
+}
 
-	if err != nil {
-		return err
+// Sorts the rows by creation date and then ID
+func sortReceiptRows(rows []ReceiptRow) {
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].CreationDate.Equal(rows[j].CreationDate) {
+			return rows[i].CreationDate.Before(rows[j].CreationDate)
+		}
+
+		return rows[i].ReceiptId < rows[j].ReceiptId
+	})
+}
+
+// Writes every row as a JSON line, in the same format as the file, sorted by
+// creation date. The rows are copied first so that a slow writer doesn't hold
+// up the writes of other requests
+func (db *xDB) export(writer io.Writer) error {
+	db.Mu.RLock()
+	rows := make([]ReceiptRow, 0, len(db.Receipts))
+
+	for _, receiptRow := range db.Receipts {
+		rows = append(rows, receiptRow)
 	}
 
-	if !retailerRegex.MatchString(str) {
-		return errors.New("Invalid retailer name")
+	db.Mu.RUnlock()
+	sortReceiptRows(rows)
+	encoder := json.NewEncoder(writer)
+
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
 	}
 
-	*r = Retailer(str)
 	return nil
 }
 
-type Date time.Time
-
-func (d *Date) UnmarshalJSON(data []byte) error {
-	str, err := obtainQuotedString(&data)
+// Replaces every row with the JSON lines rows read from the given reader, as
+// written by export. Nothing is replaced unless every row can be read.
+// Returns the number of rows imported
+func (db *xDB) importRows(reader io.Reader) (int, error) {
+	rows, err := readReceiptRows(reader)
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	var parsedDate time.Time
-	parsedDate, err = time.Parse("2006-01-02", str)
+	imported := NewXDB()
 
-	if err != nil {
-		return errors.New("Invalid date format")
+	for _, row := range rows {
+		imported.putReceiptRow(row)
 	}
 
-	*d = Date(parsedDate)
-	return nil
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	db.Receipts = imported.Receipts
+	db.IdempotencyKeys = imported.IdempotencyKeys
+	db.ReceiptIdsByRetailer = imported.ReceiptIdsByRetailer
+	db.recencyMu.Lock()
+	db.recency = imported.recency
+	db.recencyElements = imported.recencyElements
+	db.recencyMu.Unlock()
+	db.evictLeastRecentlyUsed()
+
+	return len(db.Receipts), db.rewriteFile()
 }
 
-type Time time.Time
+// The number of rows read at a time when recomputing points, so that only a
+// batch of rows is copied out of the store at once
+const recomputeBatchSize = 1000
 
-func (t *Time) UnmarshalJSON(data []byte) error {
-	str, err := obtainQuotedString(&data)
+// Recomputes the points of every row under the given rules, a batch at a
+// time. The points of each batch are computed without holding the lock, so
+// rows may be changed in the meantime, in which case they're recomputed from
+// their latest version. Rows deleted while it runs are skipped. Returns the
+// number of rows recomputed
+func (db *xDB) recomputeAllPoints(cfg receipt.RuleConfig) (int, error) {
+	db.Mu.RLock()
+	receiptIds := sortedKeys(db.Receipts)
+	db.Mu.RUnlock()
 
-	if err != nil {
-		return err
-	}
+	recomputed := 0
 
-	var parsedTime time.Time
-	parsedTime, err = time.Parse("15:04", str)
+	for start := 0; start < len(receiptIds); start += recomputeBatchSize {
+		end := min(start+recomputeBatchSize, len(receiptIds))
+		rows := make([]ReceiptRow, 0, end-start)
+		db.Mu.RLock()
 
-	if err != nil {
-		return errors.New("Invalid time format")
+		for _, receiptId := range receiptIds[start:end] {
+			if receiptRow, exists := db.Receipts[receiptId]; exists {
+				rows = append(rows, receiptRow)
+			}
+		}
+
+		db.Mu.RUnlock()
+		batchRecomputed, err := recomputeRows(db, rows, cfg)
+		recomputed += batchRecomputed
+
+		if err != nil {
+			return recomputed, err
+		}
 	}
 
-	*t = Time(parsedTime)
-	return nil
+	// Rows are read back from the file as they were written, so it has to be
+	// rewritten for them not to come back with their old points
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	return recomputed, db.rewriteFile()
 }
 
-type Amount float64
+// Stores the row in place of the one with its ID, with its version
+// incremented, as long as the stored row still has the same version. The
+// file isn't touched, since rows are only appended to it when they're written
+func (db *xDB) updateReceiptRow(row ReceiptRow) error {
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
 
-func (a *Amount) UnmarshalJSON(data []byte) error {
-	str, err := obtainQuotedString(&data)
+	storedRow, exists := db.Receipts[row.ReceiptId]
 
-	if err != nil {
-		return err
+	if !exists || storedRow.Version != row.Version {
+		return ErrConflict
 	}
 
-	if !twoDecimalFloatRegex.MatchString(str) {
-		return errors.New("Invalid amount")
-	}
+	row.Version++
+	db.Receipts[row.ReceiptId] = row
+	return nil
+}
 
-	value, err := strconv.ParseFloat(str, 64)
+func (db *xDB) recomputeReceipt(
+	receiptId string,
+	cfg receipt.RuleConfig,
+) (int64, error) {
+	points, err := recomputeStoredReceipt(db, receiptId, cfg)
 
 	if err != nil {
-		return errors.New("Amount is not a valid float")
+		return 0, err
 	}
 
-	*a = Amount(value)
-	return nil
-}
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
 
-type Receipt struct {
-	Retailer     Retailer `json:"retailer"`
-	PurchaseDate Date     `json:"purchaseDate"`
-	PurchaseTime Time     `json:"purchaseTime"`
-	Items        []Item   `json:"items"`
-	Total        Amount   `json:"total"`
-}
+	// Rows are read back last one wins, so appending the row as it's stored
+	// now is enough for it not to come back with its old points. It may have
+	// been deleted in the meantime, in which case there's nothing to keep
+	row, exists := db.Receipts[receiptId]
+
+	if !exists {
+		return points, nil
+	}
 
-func (r *Receipt) computeReceiptPoints() int64 {
-	return r.alphanumericRetailerPoints() +
-		r.totalRoundDollarAmountPoints() +
-		r.totalMultipleOf25CentsPoints() +
-		r.every2ItemsPoints() +
-		r.itemDescriptionLengthsPoints() +
-		r.purchaseDayOddPoints() +
-		r.purchaseTimeBetween2And4Points()
+	return points, db.appendLineToFile(row)
 }
 
-func (r *Receipt) alphanumericRetailerPoints() int64 {
-	var points int64 = 0
+func (db *xDB) updateReceipt(
+	receiptId string,
+	patch map[string]json.RawMessage,
+) (int64, error) {
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
 
-	for _, char := range r.Retailer {
-		if unicode.IsLetter(char) || unicode.IsDigit(char) {
-			points += 1
-		}
+	row, exists := db.Receipts[receiptId]
+
+	if !exists {
+		return 0, ErrNotFound
 	}
 
-	return points
-}
+	patched, err := patchReceipt(row.Receipt, patch)
 
-func (r *Receipt) totalRoundDollarAmountPoints() int64 {
-	if float64(r.Total) == math.Trunc(float64(r.Total)) {
-		return 50
-	} else {
-		return 0
+	if err != nil {
+		return 0, err
 	}
-}
 
-func (r *Receipt) totalMultipleOf25CentsPoints() int64 {
-	if math.Abs(math.Mod(float64(r.Total), 0.25)) < 1e-4 {
-		return 25
-	} else {
-		return 0
+	updatedRow := row
+	updatedRow.Receipt = patched
+	updatedRow.computePoints()
+	updatedRow.Version++
+
+	// Rows are read back last one wins, and putting a row again replaces its
+	// retailer index entry, so appending the updated row is enough to replace
+	// the old one in the file
+	if err := db.appendLineToFile(updatedRow); err != nil {
+		return 0, err
 	}
-}
 
-func (r *Receipt) every2ItemsPoints() int64 {
-	return int64(5 * (len(r.Items) / 2))
+	db.putReceiptRow(updatedRow)
+	return updatedRow.Points, nil
 }
 
-func (r *Receipt) itemDescriptionLengthsPoints() int64 {
-	var points int64 = 0
+// The receipt fields a patch may set, by their JSON names
+var receiptPatchFields = []string{
+	"retailer",
+	"purchaseDate",
+	"purchaseTime",
+	"items",
+	"total",
+}
 
-	for _, item := range r.Items {
-		trimmedDescription := strings.TrimSpace(string(item.Description))
-		if len(trimmedDescription)%3 == 0 {
-			points += int64(math.Ceil(float64(item.Price) * 0.2))
+// Returns the receipt with the fields in the patch replaced by theirs. Only
+// those fields are unmarshalled, so only their formats are checked, while the
+// patched receipt as a whole is validated like a processed one. A patched
+// "items" replaces every item. Fields that aren't part of the receipt are
+// rejected whether or not STRICT_RECEIPT_FIELDS is set, since a misspelled
+// field would otherwise leave the receipt unchanged without any sign of it.
+// Every error wraps ErrInvalidPatch
+func patchReceipt(
+	r receipt.Receipt,
+	patch map[string]json.RawMessage,
+) (receipt.Receipt, error) {
+	for field := range patch {
+		if !slices.Contains(receiptPatchFields, field) {
+			return r, fmt.Errorf("%w: unknown field %q", ErrInvalidPatch, field)
 		}
 	}
 
-	return points
-}
-
-func (r *Receipt) purchaseDayOddPoints() int64 {
-	if time.Time(r.PurchaseDate).Day()%2 == 1 {
-		return 6
-	} else {
-		return 0
+	// The stored items mustn't be unmarshalled into, since an item without
+	// a description would keep the one it replaces
+	if _, exists := patch["items"]; exists {
+		r.Items = nil
 	}
-}
 
-func (r *Receipt) purchaseTimeBetween2And4Points() int64 {
-	purchaseHour := time.Time(r.PurchaseTime).Hour()
+	data, err := json.Marshal(patch)
 
-	if purchaseHour >= 14 && purchaseHour < 16 {
-		return 10
-	} else {
-		return 0
+	if err == nil {
+		err = json.Unmarshal(data, &r)
 	}
-}
-
-type Description string
 
-func (d *Description) UnmarshalJSON(data []byte) error {
-	str, err := obtainQuotedString(&data)
-
-	if err != nil {
-		return err
+	if err == nil {
+		err = r.Validate(validation)
 	}
 
-	if !descriptionRegex.MatchString(str) {
-		return errors.New("Invalid item description")
+	if err != nil {
+		return r, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
 	}
 
-	*d = Description(str)
-	return nil
+	return r, nil
 }
 
-type Item struct {
-	Description Description `json:"shortDescription"`
-	Price       Amount      `json:"price"`
-}
+// How many times a row is updated before giving up on conflicting writes
+const maxUpdateAttempts = 3
 
-//  __  __ ___ ____  ____  _     _______        ___    ____  _____
-// |  \/  |_ _|  _ \|  _ \| |   | ____\ \      / / \  |  _ \| ____|
-// | |\/| || || | | | | | | |   |  _|  \ \ /\ / / _ \ | |_) |  _|
-// | |  | || || |_| | |_| | |___| |___  \ V  V / ___ \|  _ <| |___
-// |_|  |_|___|____/|____/|_____|_____|  \_/\_/_/   \_\_| \_\_____|
-//
+// Recomputes the points of the given rows under the given rules and updates
+// them in the store they were read from. Returns the number of rows updated
+func recomputeRows(
+	store Storage,
+	rows []ReceiptRow,
+	cfg receipt.RuleConfig,
+) (int, error) {
+	recomputed := 0
 
-func newLoggingHandler(destination io.Writer) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return handlers.LoggingHandler(destination, next)
-	}
-}
+	for _, row := range rows {
+		_, err := recomputeRow(store, row, cfg)
 
-//  __  __ ___ ____   ____   _   _ _____ ___ _     ___ _____ ___ _____ ____
-// |  \/  |_ _/ ___| / ___| | | | |_   _|_ _| |   |_ _|_   _|_ _| ____/ ___|
-// | |\/| || |\___ \| |     | | | | | |  | || |    | |  | |  | ||  _| \___ \
-// | |  | || | ___) | |___  | |_| | | |  | || |___ | |  | |  | || |___ ___) |
-// |_|  |_|___|____/ \____|  \___/  |_| |___|_____|___| |_| |___|_____|____/
-//
+		// Rows deleted since they were read are skipped
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
 
-// Reads the entirety of the given request's body and unmarshalls it into
-// the given pointer to the JSON schema
-func readUnmarshalRequestBody(request *http.Request, schema any) error {
-	var requestBodyBytes []byte
-	requestBodyBytes, err = io.ReadAll(request.Body)
+		if err != nil {
+			return recomputed, err
+		}
 
-	if err != nil {
-		return err
+		recomputed++
 	}
 
-	err = json.Unmarshal(requestBodyBytes, schema)
+	return recomputed, nil
+}
+
+// Recomputes the points of the row with the given ID in the given store and
+// returns them
+func recomputeStoredReceipt(
+	store Storage,
+	receiptId string,
+	cfg receipt.RuleConfig,
+) (int64, error) {
+	row, err := store.getReceiptRow(receiptId)
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	row, err = recomputeRow(store, row, cfg)
+
+	return row.Points, err
 }
 
-// This path has already been validated as having the format
-// "/receipts/foo/points"
-func getReceiptIDFromURLPath(path string) string {
-	pathSegments := strings.Split(path, "/")
+// Reads the row back and recomputes it again whenever the update conflicts,
+// up to maxUpdateAttempts times, after which ErrConflict is returned. Returns
+// the row as it was updated, or ErrNotFound when it was deleted in the
+// meantime
+func recomputeRow(
+	store Storage,
+	row ReceiptRow,
+	cfg receipt.RuleConfig,
+) (ReceiptRow, error) {
+	for attempt := 1; ; attempt++ {
+		row.computePointsWithConfig(cfg)
+		err := store.updateReceiptRow(row)
 
-	return pathSegments[2]
-}
+		if err == nil {
+			return row, nil
+		}
+
+		if !errors.Is(err, ErrConflict) || attempt == maxUpdateAttempts {
+			return ReceiptRow{}, err
+		}
 
-// Returns true if the length of the given string is at least 2 and
-// it is wrapped in double quotes
-func isQuotedString(s string) bool {
-	return len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"'
+		row, err = store.getReceiptRow(row.ReceiptId)
+
+		if err != nil {
+			return ReceiptRow{}, err
+		}
+	}
 }
 
-// 1) Converts the byte slice to a string
-// 2) Checks if the string is surrounded by double quotes
-// 3) Returns the substring in between the double quotes
-func obtainQuotedString(data *[]byte) (string, error) {
-	str := string(*data)
+// Reads the JSON lines rows of an export. When several rows have the same ID,
+// the last one wins
+func readReceiptRows(reader io.Reader) ([]ReceiptRow, error) {
+	var rows []ReceiptRow
+	indexesById := make(map[string]int)
+	decoder := json.NewDecoder(reader)
+
+	for {
+		var row ReceiptRow
+		err := decoder.Decode(&row)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if row.ReceiptId == "" {
+			return nil, errors.New("Receipt row is missing an ID")
+		}
 
-	if !isQuotedString(str) {
-		return "", errors.New("Field must be a quoted string")
+		if index, exists := indexesById[row.ReceiptId]; exists {
+			rows[index] = row
+		} else {
+			indexesById[row.ReceiptId] = len(rows)
+			rows = append(rows, row)
+		}
 	}
 
-	return str[1 : len(str)-1], nil
+	return rows, nil
 }
 
-//  _ _ ____  ____ _ _
-// ( | )  _ \| __ | | )
-//  V V| | | |  _ \V V
-//     | |_| | |_) |
-//     |____/|____/
-//
+// Returns an empty slice for a retailer without any receipts. Assumes the
+// caller holds the read lock
+func (db *xDB) getReceiptsByRetailer(name string) []ReceiptRow {
+	receiptIds := db.ReceiptIdsByRetailer[name]
+	rows := make([]ReceiptRow, 0, len(receiptIds))
 
-type xDB struct {
-	Data map[string]any
-	Mu   sync.RWMutex
+	for _, receiptId := range receiptIds {
+		rows = append(rows, db.Receipts[receiptId])
+	}
+
+	return rows
 }
 
-func NewXDB() *xDB {
-	return &xDB{
-		Data: make(map[string]any),
-	}
+// Only fails once the context is done, since there's nothing to connect to
+func (db *xDB) Ping(ctx context.Context) error {
+	return ctx.Err()
 }
 
-type ReceiptRow struct {
-	Receipt
-	ReceiptId string
-	Points    int64
-	// TODO: A CreationDate field here might be nice
+func (db *xDB) count() (int, error) {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+
+	return len(db.Receipts), nil
 }
 
-const ReceiptTableName = "receipt"
+func (db *xDB) getReceipt(receiptId string) (receipt.Receipt, error) {
+	receiptRow, err := db.getReceiptRow(receiptId)
 
-func (db *xDB) writeReceipt(r Receipt) (string, error) {
-	receiptId := uuid.NewString()
-	row := ReceiptRow{
-		Receipt:   r,
-		ReceiptId: receiptId,
-		Points:    r.computeReceiptPoints(),
+	return receiptRow.Receipt, err
+}
+
+// Returns the row with its points computed, computing and caching them on
+// first access. The read lock cannot be promoted in place, so on a cache miss
+// it is released and the write lock is acquired, after which the row is looked
+// up again in case it was computed or deleted in between
+func (db *xDB) getComputedReceiptRow(receiptId string) (ReceiptRow, error) {
+	receiptRow, err := db.getReceiptRow(receiptId)
+
+	if err != nil || receiptRow.Computed {
+		return receiptRow, err
 	}
 
 	db.Mu.Lock()
 	defer db.Mu.Unlock()
 
-	db.Data[ReceiptTableName+"."+receiptId] = row
+	receiptRow, exists := db.Receipts[receiptId]
+
+	if !exists {
+		return ReceiptRow{}, ErrNotFound
+	}
+
+	if !receiptRow.Computed {
+		receiptRow.computePoints()
+		receiptRow.Version++
+		db.Receipts[receiptId] = receiptRow
+	}
+
+	return receiptRow, nil
+}
+
+func (db *xDB) getReceiptPoints(
+	ctx context.Context,
+	receiptId string,
+) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	receiptRow, err := db.getComputedReceiptRow(receiptId)
 
-	return receiptId, nil
+	return receiptRow.Points, err
 }
 
-func (db *xDB) getReceiptPoints(receiptId string) (int64, error) {
+// Looks every receipt up under a single read lock rather than locking for each
+// one. Points that have not been computed yet are computed without being
+// cached, the same as listReceipts does
+func (db *xDB) getReceiptsPoints(
+	ctx context.Context,
+	receiptIds []string,
+) (map[string]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	db.Mu.RLock()
 	defer db.Mu.RUnlock()
 
-	key := ReceiptTableName + "." + receiptId
+	pointsByReceiptId := make(map[string]int64, len(receiptIds))
 
-	if value, exists := db.Data[key]; exists {
-		// Casting here, I never really liked the syntax for it in Go
-		receiptRow, ok := value.(ReceiptRow)
+	for _, receiptId := range receiptIds {
+		receiptRow, exists := db.Receipts[receiptId]
+
+		if !exists {
+			continue
+		}
 
-		if ok {
-			return receiptRow.Points, nil
+		if !receiptRow.Computed {
+			receiptRow.computePoints()
 		}
 
-		return 0, errors.New("Receipt with given ID was malformed")
+		pointsByReceiptId[receiptId] = receiptRow.Points
 	}
 
-	return 0, errors.New("No receipt with given ID exists")
+	return pointsByReceiptId, nil
 }
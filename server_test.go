@@ -0,0 +1,6301 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-fetch/receipt"
+
+	"github.com/google/uuid"
+)
+
+// The receipts of the examples of the original challenge, along with the
+// points the original rules award them
+const targetReceipt = `{
+	"retailer": "Target",
+	"purchaseDate": "2022-01-01",
+	"purchaseTime": "13:01",
+	"items": [
+		{"shortDescription": "Mountain Dew 12PK", "price": "6.49"},
+		{"shortDescription": "Emils Cheese Pizza", "price": "12.25"},
+		{"shortDescription": "Knorr Creamy Chicken", "price": "1.26"},
+		{"shortDescription": "Doritos Nacho Cheese", "price": "3.35"},
+		{"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ", "price": "12.00"}
+	],
+	"total": "35.35"
+}`
+const targetReceiptPoints = 28
+
+const cornerMarketReceipt = `{
+	"retailer": "M&M Corner Market",
+	"purchaseDate": "2022-03-20",
+	"purchaseTime": "14:33",
+	"items": [
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"},
+		{"shortDescription": "Gatorade", "price": "2.25"}
+	],
+	"total": "9.00"
+}`
+const cornerMarketReceiptPoints = 109
+
+func unmarshalTestReceipt(t *testing.T, data string) receipt.Receipt {
+	t.Helper()
+	var r receipt.Receipt
+
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func serveTestRequest(
+	handler http.Handler,
+	method string,
+	path string,
+	body string,
+) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// Meant to be run with -race, which fails it on any unsynchronized access to
+// the store, while the points and count catch lost or mixed up writes
+func TestConcurrentWritesAndReads(t *testing.T) {
+	store := NewXDB()
+	receipts := []struct {
+		receipt receipt.Receipt
+		points  int64
+	}{
+		{unmarshalTestReceipt(t, targetReceipt), targetReceiptPoints},
+		{
+			unmarshalTestReceipt(t, cornerMarketReceipt),
+			cornerMarketReceiptPoints,
+		},
+	}
+
+	const workers = 32
+	const writesPerWorker = 25
+	ctx := context.Background()
+	errs := make(chan error, workers*writesPerWorker)
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for write := 0; write < writesPerWorker; write++ {
+				expected := receipts[(worker+write)%len(receipts)]
+				receiptId, err := store.writeReceipt(ctx, expected.receipt)
+
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				points, err := store.getReceiptPoints(ctx, receiptId)
+
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if points != expected.points {
+					errs <- fmt.Errorf(
+						"receipt %s has %d points, expected %d",
+						receiptId,
+						points,
+						expected.points,
+					)
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	count, err := store.count()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := workers * writesPerWorker; count != expected {
+		t.Errorf("%d receipts stored, expected %d", count, expected)
+	}
+}
+
+// Valid and invalid receipts are processed and looked up all at once, so that
+// the error of one request leaking into another, like it could through a
+// variable shared by every request, shows up as a wrong status besides a race
+func TestConcurrentProcessAndPointsRequests(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	const workers = 16
+	const requestsPerWorker = 20
+	errs := make(chan error, workers*requestsPerWorker)
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for request := 0; request < requestsPerWorker; request++ {
+				if (worker+request)%2 == 0 {
+					errs <- checkInvalidRequests(handler)
+				} else {
+					errs <- checkValidRequests(handler)
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func checkValidRequests(handler http.Handler) error {
+	recorder := serveTestRequest(
+		handler,
+		http.MethodPost,
+		"/receipts/process",
+		targetReceipt,
+	)
+
+	if recorder.Code != http.StatusCreated {
+		return fmt.Errorf("processing responded with %d", recorder.Code)
+	}
+
+	var processed ProcessReceiptsResponseBody
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &processed); err != nil {
+		return err
+	}
+
+	recorder = serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/"+processed.ReceiptId+"/points",
+		"",
+	)
+
+	if recorder.Code != http.StatusOK {
+		return fmt.Errorf("looking up points responded with %d", recorder.Code)
+	}
+
+	var points ReceiptsPointsResponseBody
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &points); err != nil {
+		return err
+	}
+
+	if points.Points != targetReceiptPoints {
+		return fmt.Errorf(
+			"receipt has %d points, expected %d",
+			points.Points,
+			targetReceiptPoints,
+		)
+	}
+
+	return nil
+}
+
+func checkInvalidRequests(handler http.Handler) error {
+	recorder := serveTestRequest(
+		handler,
+		http.MethodPost,
+		"/receipts/process",
+		`{"retailer":"Target","purchaseDate":"not-a-date"}`,
+	)
+
+	if recorder.Code != http.StatusBadRequest {
+		return fmt.Errorf(
+			"processing an invalid receipt responded with %d",
+			recorder.Code,
+		)
+	}
+
+	recorder = serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/00000000-0000-0000-0000-000000000000/points",
+		"",
+	)
+
+	if recorder.Code != http.StatusNotFound {
+		return fmt.Errorf(
+			"looking up a missing receipt responded with %d",
+			recorder.Code,
+		)
+	}
+
+	return nil
+}
+
+// Rows are put again under the same ID when the file holds several versions
+// of a receipt, which must only leave it indexed under its latest retailer
+func TestPutReceiptRowReplacesRetailerIndexEntry(t *testing.T) {
+	store := NewXDB()
+	row, err := newReceiptRow(
+		unmarshalTestReceipt(t, targetReceipt),
+		"receipt",
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.putReceiptRow(row)
+	store.putReceiptRow(row)
+	row.Retailer = "Walgreens"
+	store.putReceiptRow(row)
+
+	tests := []struct {
+		retailer string
+		expected int
+	}{
+		{"Target", 0},
+		{"Walgreens", 1},
+	}
+
+	for _, test := range tests {
+		rows := store.getReceiptsByRetailer(test.retailer)
+
+		if len(rows) != test.expected {
+			t.Errorf(
+				"%d receipts indexed under %s, expected %d",
+				len(rows),
+				test.retailer,
+				test.expected,
+			)
+		}
+	}
+
+	if _, exists := store.ReceiptIdsByRetailer["Target"]; exists {
+		t.Error("Target is still in the retailer index")
+	}
+}
+
+// Processes the receipt through the given subresource handler, failing the
+// test unless it's created, and returns its ID
+func processTestReceipt(
+	t *testing.T,
+	handler http.Handler,
+	body string,
+) string {
+	t.Helper()
+	recorder := serveTestRequest(
+		handler,
+		http.MethodPost,
+		"/receipts/process",
+		body,
+	)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf(
+			"processing responded with %d: %s",
+			recorder.Code,
+			recorder.Body,
+		)
+	}
+
+	var processed ProcessReceiptsResponseBody
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &processed); err != nil {
+		t.Fatal(err)
+	}
+
+	return processed.ReceiptId
+}
+
+func TestListReceiptsByRetailer(t *testing.T) {
+	db = NewXDB()
+	subresourceHandler := receiptsSubresourceHandler()
+	targetId := processTestReceipt(t, subresourceHandler, targetReceipt)
+	processTestReceipt(t, subresourceHandler, cornerMarketReceipt)
+	processTestReceipt(t, subresourceHandler, cornerMarketReceipt)
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"", 3},
+		{"?retailer=Target", 1},
+		{"?retailer=M%26M+Corner+Market", 2},
+		{"?retailer=target", 0},
+		{"?retailer=Walgreens", 0},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			receiptsHandler(),
+			http.MethodGet,
+			"/receipts"+test.query,
+			"",
+		)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%q responded with %d", test.query, recorder.Code)
+		}
+
+		var body ListReceiptsResponseBody
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		if body.Total != test.expected || len(body.Receipts) != body.Total {
+			t.Errorf(
+				"%q listed %d of %d receipts, expected %d",
+				test.query,
+				len(body.Receipts),
+				body.Total,
+				test.expected,
+			)
+		}
+
+		if test.query == "?retailer=Target" &&
+			len(body.Receipts) == 1 &&
+			body.Receipts[0].ReceiptId != targetId {
+			t.Errorf(
+				"listed %s, expected %s",
+				body.Receipts[0].ReceiptId,
+				targetId,
+			)
+		}
+	}
+}
+
+func TestUpdateReceipt(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+
+	tests := []struct {
+		name           string
+		receiptId      string
+		patch          string
+		expectedStatus int
+		expectedPoints int64
+	}{
+		{
+			"retailer",
+			receiptId,
+			`{"retailer": "Walgreens"}`,
+			http.StatusOK,
+			targetReceiptPoints + 3,
+		},
+		{
+			"purchase time",
+			receiptId,
+			`{"purchaseTime": "14:30"}`,
+			http.StatusOK,
+			targetReceiptPoints + 3 + 10,
+		},
+		{
+			"total",
+			receiptId,
+			`{"total": "35.00"}`,
+			http.StatusOK,
+			targetReceiptPoints + 3 + 10 + 50 + 25,
+		},
+		{
+			"invalid total",
+			receiptId,
+			`{"total": "35"}`,
+			http.StatusBadRequest,
+			0,
+		},
+		{
+			"unknown field",
+			receiptId,
+			`{"store": "Walgreens"}`,
+			http.StatusBadRequest,
+			0,
+		},
+		{
+			"invalid retailer",
+			receiptId,
+			`{"retailer": ""}`,
+			http.StatusBadRequest,
+			0,
+		},
+		{
+			"missing receipt",
+			"00000000-0000-0000-0000-000000000000",
+			`{"retailer": "Walgreens"}`,
+			http.StatusNotFound,
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodPatch,
+			"/receipts/"+test.receiptId,
+			test.patch,
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if recorder.Code != http.StatusOK {
+			continue
+		}
+
+		var body ReceiptsPointsResponseBody
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		if body.Points != test.expectedPoints {
+			t.Errorf(
+				"%s: %d points, expected %d",
+				test.name,
+				body.Points,
+				test.expectedPoints,
+			)
+		}
+	}
+
+	// The points looked up afterwards are those of the last valid patch
+	var expected int64 = targetReceiptPoints + 3 + 10 + 50 + 25
+	points := getTestReceiptPoints(t, handler, receiptId)
+
+	if points != expected {
+		t.Errorf("looked up %d points, expected %d", points, expected)
+	}
+}
+
+// The patched row is appended after the processed one, so loading the file
+// again puts the receipt twice, which must leave it under its new retailer
+func TestUpdatedReceiptSurvivesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.jsonl")
+	store, err := NewXDBFromFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiptId, err := store.writeReceipt(
+		context.Background(),
+		unmarshalTestReceipt(t, targetReceipt),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := map[string]json.RawMessage{
+		"retailer": json.RawMessage(`"Walgreens"`),
+	}
+
+	if _, err := store.updateReceipt(receiptId, patch); err != nil {
+		t.Fatal(err)
+	}
+
+	store.File.Close()
+	store, err = NewXDBFromFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.File.Close()
+
+	if rows := store.getReceiptsByRetailer("Target"); len(rows) != 0 {
+		t.Errorf("%d receipts still indexed under Target", len(rows))
+	}
+
+	rows := store.getReceiptsByRetailer("Walgreens")
+
+	if len(rows) != 1 || rows[0].ReceiptId != receiptId {
+		t.Fatalf("%d receipts indexed under Walgreens, expected 1", len(rows))
+	}
+
+	if expected := int64(targetReceiptPoints + 3); rows[0].Points != expected {
+		t.Errorf("%d points, expected %d", rows[0].Points, expected)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		forwarded   []string
+		realIP      string
+		behindProxy bool
+		expected    string
+	}{
+		{"remote address", nil, "", true, "192.0.2.1"},
+		{"ignored headers", []string{"198.51.100.7"}, "", false, "192.0.2.1"},
+		{"forwarded", []string{"198.51.100.7"}, "", true, "198.51.100.7"},
+		{
+			"spoofed first address",
+			[]string{"203.0.113.9, 198.51.100.7"},
+			"",
+			true,
+			"198.51.100.7",
+		},
+		// The last address rather than the first, the original client's,
+		// since only the last was appended by the proxy the server trusts
+		{
+			"multiple hops",
+			[]string{"203.0.113.9, 198.51.100.7, 192.0.2.44"},
+			"",
+			true,
+			"192.0.2.44",
+		},
+		{
+			"last header",
+			[]string{"203.0.113.9", "198.51.100.7"},
+			"",
+			true,
+			"198.51.100.7",
+		},
+		{"real IP", nil, "198.51.100.7", true, "198.51.100.7"},
+		{"not an IP", []string{"unknown"}, "", true, "192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+
+		for _, forwarded := range test.forwarded {
+			request.Header.Add("X-Forwarded-For", forwarded)
+		}
+
+		if test.realIP != "" {
+			request.Header.Set("X-Real-IP", test.realIP)
+		}
+
+		if ip := clientIP(request, test.behindProxy); ip != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, ip, test.expected)
+		}
+	}
+}
+
+// A client can't get around the rate limit behind a proxy by putting a new
+// address first in every request, since only the last one counts
+func TestRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	stop := make(chan struct{})
+	defer close(stop)
+	handler := newRateLimitHandler(0.5, 3, stop)(ok)
+
+	tests := []struct {
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"192.0.2.1:1234", http.StatusOK},
+		{"192.0.2.1:5678", http.StatusOK},
+		{"192.0.2.1:1234", http.StatusTooManyRequests},
+		{"192.0.2.1:5678", http.StatusTooManyRequests},
+		// Every client has a bucket of its own
+		{"192.0.2.2:1234", http.StatusOK},
+	}
+
+	for index, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = test.remoteAddr
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"request %d from %s responded with %d, expected %d",
+				index,
+				test.remoteAddr,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if test.expectedStatus != http.StatusTooManyRequests {
+			continue
+		}
+
+		retryAfter := recorder.Header().Get("Retry-After")
+
+		if retryAfter != "2" || testErrorCode(t, recorder) != "RATE_LIMITED" {
+			t.Errorf(
+				"request %d was limited with Retry-After %q: %s",
+				index,
+				retryAfter,
+				recorder.Body,
+			)
+		}
+	}
+}
+
+func TestRateLimiterRefillsAndEvicts(t *testing.T) {
+	limiter := &rateLimiter{
+		rate:    2,
+		burst:   2,
+		buckets: make(map[string]*tokenBucket),
+	}
+	start := time.Now()
+
+	tests := []struct {
+		elapsed       time.Duration
+		expected      bool
+		expectedRetry time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+		{250 * time.Millisecond, false, 250 * time.Millisecond},
+		{500 * time.Millisecond, true, 0},
+		{time.Minute, true, 0},
+		{time.Minute, true, 0},
+		{time.Minute, false, 500 * time.Millisecond},
+	}
+
+	for index, test := range tests {
+		allowed, retryAfter := limiter.take(
+			"192.0.2.1",
+			start.Add(test.elapsed),
+		)
+
+		if allowed != test.expected || retryAfter != test.expectedRetry {
+			t.Errorf(
+				"take %d returned %t after %v, expected %t after %v",
+				index,
+				allowed,
+				retryAfter,
+				test.expected,
+				test.expectedRetry,
+			)
+		}
+	}
+
+	limiter.evictFullBuckets(start.Add(time.Minute))
+
+	if len(limiter.buckets) != 1 {
+		t.Error("evicted a bucket that's still refilling")
+	}
+
+	limiter.evictFullBuckets(start.Add(time.Minute + time.Second))
+
+	if len(limiter.buckets) != 0 {
+		t.Error("kept a bucket that's full again")
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	stop := make(chan struct{})
+	defer close(stop)
+	handler := newProxyHandler(true)(newRateLimitHandler(1, 2, stop)(ok))
+
+	for request := 0; request < 3; request++ {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(
+			"X-Forwarded-For",
+			fmt.Sprintf("203.0.113.%d, 198.51.100.7", request),
+		)
+		handler.ServeHTTP(recorder, r)
+
+		expected := http.StatusOK
+
+		if request == 2 {
+			expected = http.StatusTooManyRequests
+		}
+
+		if recorder.Code != expected {
+			t.Errorf(
+				"request %d responded with %d, expected %d",
+				request,
+				recorder.Code,
+				expected,
+			)
+		}
+	}
+}
+
+func TestNonNegativeInt64FromEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+		valid    bool
+	}{
+		{"", 5, true},
+		{"0", 0, true},
+		{"12", 12, true},
+		{"-1", 0, false},
+		{"twelve", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("TEST_LIMIT", test.value)
+		value, err := nonNegativeInt64FromEnv("TEST_LIMIT", 5)
+
+		if (err == nil) != test.valid || value != test.expected {
+			t.Errorf(
+				"%q parsed as %d with error %v, expected %d",
+				test.value,
+				value,
+				err,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestLoadCORSMaxAge(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+		valid    bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"600", 600, true},
+		{"601", 0, false},
+		{"-1", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("CORS_MAX_AGE", test.value)
+		config, err := loadCORSConfig()
+
+		if (err == nil) != test.valid {
+			t.Errorf("%q loaded with error %v", test.value, err)
+		} else if test.valid && config.MaxAge != test.expected {
+			t.Errorf(
+				"%q loaded as %d, expected %d",
+				test.value,
+				config.MaxAge,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestMaxReceiptsEvictsLeastRecentlyUsed(t *testing.T) {
+	tests := []struct {
+		maxReceipts int
+		expected    int
+	}{
+		{0, 3},
+		{2, 2},
+	}
+
+	for _, test := range tests {
+		store := NewXDB()
+
+		if err := store.SetMaxReceipts(test.maxReceipts); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		r := unmarshalTestReceipt(t, targetReceipt)
+		var receiptIds []string
+
+		for write := 0; write < 3; write++ {
+			receiptId, err := store.writeReceipt(ctx, r)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiptIds = append(receiptIds, receiptId)
+		}
+
+		count, err := store.count()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != test.expected {
+			t.Errorf(
+				"MAX_RECEIPTS=%d kept %d receipts, expected %d",
+				test.maxReceipts,
+				count,
+				test.expected,
+			)
+		}
+
+		_, err = store.getReceiptRow(receiptIds[0])
+		evicted := test.maxReceipts > 0
+
+		if errors.Is(err, ErrNotFound) != evicted {
+			t.Errorf(
+				"MAX_RECEIPTS=%d looked up the first receipt with error %v",
+				test.maxReceipts,
+				err,
+			)
+		}
+	}
+}
+
+// Loading the file has to keep the order receipts were used in, and leave out
+// the receipts evicted since it was last compacted
+func TestMaxReceiptsEvictionOrderSurvivesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.jsonl")
+	ctx := context.Background()
+	r := unmarshalTestReceipt(t, targetReceipt)
+	var receiptIds []string
+
+	loadStore := func() *xDB {
+		store, err := NewXDBFromFile(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.SetMaxReceipts(3); err != nil {
+			t.Fatal(err)
+		}
+
+		return store
+	}
+
+	writeReceipts := func(store *xDB, n int) {
+		for write := 0; write < n; write++ {
+			receiptId, err := store.writeReceipt(ctx, r)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiptIds = append(receiptIds, receiptId)
+		}
+	}
+
+	// Evicts the first and then the third receipt, since the second is looked
+	// up before the fifth is written, which compacts the file
+	store := loadStore()
+	writeReceipts(store, 4)
+
+	if _, err := store.getReceiptRow(receiptIds[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	writeReceipts(store, 1)
+	store.File.Close()
+
+	// Evicts the fourth receipt rather than the second, which was used after
+	// it, and leaves the eviction in the file
+	store = loadStore()
+	writeReceipts(store, 1)
+	store.File.Close()
+
+	store = loadStore()
+	defer store.File.Close()
+	kept := []bool{false, true, false, false, true, true}
+
+	for i, receiptId := range receiptIds {
+		_, err := store.getReceiptRow(receiptId)
+
+		if errors.Is(err, ErrNotFound) == kept[i] {
+			t.Errorf(
+				"receipt %d was looked up with error %v, expected it kept: %t",
+				i+1,
+				err,
+				kept[i],
+			)
+		}
+	}
+}
+
+// Recomputed points have to be written to the file too, or the receipt comes
+// back with its old points when the file is loaded again
+func TestRecomputedReceiptSurvivesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.jsonl")
+	store, err := NewXDBFromFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiptId, err := store.writeReceipt(
+		context.Background(),
+		unmarshalTestReceipt(t, targetReceipt),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := receipt.DefaultRuleConfig()
+	cfg.RetailerCharacterPoints = 2
+	const expected = targetReceiptPoints + 6
+	points, err := store.recomputeReceipt(receiptId, cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if points != expected {
+		t.Errorf("recomputed %d points, expected %d", points, expected)
+	}
+
+	store.File.Close()
+	store, err = NewXDBFromFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.File.Close()
+	row, err := store.getReceiptRow(receiptId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row.Points != expected {
+		t.Errorf("reloaded %d points, expected %d", row.Points, expected)
+	}
+}
+
+// The constraints of receipt.schema.json that can be checked through
+// ValidateAll
+type testReceiptSchema struct {
+	Required   []string `json:"required"`
+	Properties map[string]struct {
+		Pattern  string `json:"pattern"`
+		MinItems int    `json:"minItems"`
+		MaxItems int    `json:"maxItems"`
+	} `json:"properties"`
+	Definitions struct {
+		Item struct {
+			Required   []string `json:"required"`
+			Properties map[string]struct {
+				Pattern string `json:"pattern"`
+			} `json:"properties"`
+		} `json:"item"`
+		Amount struct {
+			OneOf []struct {
+				Type    string `json:"type"`
+				Pattern string `json:"pattern"`
+			} `json:"oneOf"`
+		} `json:"amount"`
+	} `json:"definitions"`
+}
+
+// A receipt with a single item, whose price is the total, so that either
+// can be replaced by the same amount
+func testSchemaReceipt() map[string]any {
+	return map[string]any{
+		"retailer":     "Target",
+		"purchaseDate": "2022-01-01",
+		"purchaseTime": "13:01",
+		"items": []any{
+			map[string]any{"shortDescription": "Gatorade", "price": "2.25"},
+		},
+		"total": "2.25",
+	}
+}
+
+func validTestSchemaReceipt(t *testing.T, fields map[string]any) bool {
+	t.Helper()
+	data, err := json.Marshal(fields)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r receipt.Receipt
+	cfg := receipt.ValidationConfig{MaxItems: defaultMaxReceiptItems}
+	return len(r.ValidateAll(data, cfg)) == 0
+}
+
+// receipt.schema.json is kept up to date by hand, so it's checked against
+// the receipts ValidateAll accepts under the default configuration: every
+// sample value has to match the pattern of its field exactly when the
+// receipt holding it is valid, and every field ValidateAll rejects receipts
+// without has to be required. The schema may require more, since receipts
+// missing fields like the retailer are accepted with the field left empty
+func TestReceiptSchemaMatchesValidation(t *testing.T) {
+	var schema testReceiptSchema
+
+	if err := json.Unmarshal(receiptSchema, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	if !validTestSchemaReceipt(t, testSchemaReceipt()) {
+		t.Fatal("the sample receipt is invalid")
+	}
+
+	for field := range schema.Properties {
+		fields := testSchemaReceipt()
+		delete(fields, field)
+		required := slices.Contains(schema.Required, field)
+
+		if !validTestSchemaReceipt(t, fields) && !required {
+			t.Errorf("%s isn't required by the schema", field)
+		}
+	}
+
+	for field := range schema.Definitions.Item.Properties {
+		fields := testSchemaReceipt()
+		delete(fields["items"].([]any)[0].(map[string]any), field)
+		required := slices.Contains(schema.Definitions.Item.Required, field)
+
+		if !validTestSchemaReceipt(t, fields) && !required {
+			t.Errorf("%s isn't required by the schema", field)
+		}
+	}
+
+	var amountPattern string
+
+	for _, amount := range schema.Definitions.Amount.OneOf {
+		if amount.Type == "string" {
+			amountPattern = amount.Pattern
+		}
+	}
+
+	setItemField := func(field string) func(map[string]any, string) {
+		return func(fields map[string]any, value string) {
+			item := fields["items"].([]any)[0].(map[string]any)
+			item[field] = value
+		}
+	}
+
+	tests := []struct {
+		field   string
+		pattern string
+		set     func(fields map[string]any, value string)
+		values  []string
+	}{
+		{
+			"retailer",
+			schema.Properties["retailer"].Pattern,
+			func(fields map[string]any, value string) {
+				fields["retailer"] = value
+			},
+			[]string{
+				"Target",
+				"M&M Corner Market",
+				"Café Müller",
+				"Walgreens_2",
+				"Target!",
+				"Target 🎯",
+			},
+		},
+		{
+			"purchaseTime",
+			schema.Properties["purchaseTime"].Pattern,
+			func(fields map[string]any, value string) {
+				fields["purchaseTime"] = value
+			},
+			[]string{"13:01", "00:00", "1:01", "13:01:00", "1:01 PM"},
+		},
+		{
+			"shortDescription",
+			schema.Definitions.Item.Properties["shortDescription"].Pattern,
+			setItemField("shortDescription"),
+			[]string{
+				"Gatorade",
+				"   Klarbrunn 12-PK 12 FL OZ  ",
+				"Emils_Pizza",
+				"Café",
+				"Gatorade!",
+			},
+		},
+		{
+			"amount",
+			amountPattern,
+			func(fields map[string]any, value string) {
+				setItemField("price")(fields, value)
+				fields["total"] = value
+			},
+			[]string{"2.25", "0.00", "2", "2.2", "2.250", "$2.25", "-2.25"},
+		},
+	}
+
+	for _, test := range tests {
+		pattern, err := regexp.Compile(test.pattern)
+
+		if err != nil {
+			t.Errorf("%s pattern %q: %v", test.field, test.pattern, err)
+			continue
+		}
+
+		for _, value := range test.values {
+			fields := testSchemaReceipt()
+			test.set(fields, value)
+			matched := pattern.MatchString(value)
+
+			if valid := validTestSchemaReceipt(t, fields); valid != matched {
+				t.Errorf(
+					"%s %q is valid %t but matched by the schema %t",
+					test.field,
+					value,
+					valid,
+					matched,
+				)
+			}
+		}
+	}
+
+	items := schema.Properties["items"]
+
+	if items.MaxItems != defaultMaxReceiptItems {
+		t.Errorf(
+			"the schema allows %d items, expected %d",
+			items.MaxItems,
+			defaultMaxReceiptItems,
+		)
+	}
+
+	fields := testSchemaReceipt()
+	fields["items"] = []any{}
+
+	if validTestSchemaReceipt(t, fields) != (items.MinItems == 0) {
+		t.Errorf("the schema requires %d items", items.MinItems)
+	}
+}
+
+func TestServeReceiptSchema(t *testing.T) {
+	recorder := serveTestRequest(
+		receiptsSubresourceHandler(),
+		http.MethodGet,
+		"/receipts/schema",
+		"",
+	)
+	var schema struct {
+		Schema   string   `json:"$schema"`
+		Type     string   `json:"type"`
+		Required []string `json:"required"`
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &schema)
+
+	if err != nil ||
+		recorder.Code != http.StatusOK ||
+		recorder.Header().Get("Content-Type") != "application/schema+json" {
+		t.Fatalf(
+			"responded with %d and %q: %v",
+			recorder.Code,
+			recorder.Header().Get("Content-Type"),
+			err,
+		)
+	}
+
+	if schema.Schema != "http://json-schema.org/draft-07/schema#" ||
+		schema.Type != "object" ||
+		!slices.Contains(schema.Required, "items") {
+		t.Errorf("served the schema %+v", schema)
+	}
+
+	recorder = serveTestRequest(
+		receiptsSubresourceHandler(),
+		http.MethodPost,
+		"/receipts/schema",
+		"",
+	)
+
+	if recorder.Code == http.StatusOK {
+		t.Error("a POST served the schema")
+	}
+}
+
+// Looks up the points of the receipt with the given ID through the given
+// subresource handler, failing the test unless they're found
+func getTestReceiptPoints(
+	t *testing.T,
+	handler http.Handler,
+	receiptId string,
+) int64 {
+	t.Helper()
+	recorder := serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/"+receiptId+"/points",
+		"",
+	)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("points lookup responded with %d", recorder.Code)
+	}
+
+	var body ReceiptsPointsResponseBody
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.Points
+}
+
+// The Target receipt under other retailer names, which are only accepted
+// when they're made of letters and digits of any script
+func TestProcessUnicodeRetailers(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		retailer       string
+		expectedStatus int
+		expectedPoints int64
+	}{
+		{"Target", http.StatusCreated, targetReceiptPoints},
+		{"Café", http.StatusCreated, targetReceiptPoints - 6 + 4},
+		{"Müller", http.StatusCreated, targetReceiptPoints},
+		{"Target 🎯", http.StatusBadRequest, 0},
+		{"☕", http.StatusBadRequest, 0},
+	}
+
+	for _, test := range tests {
+		body := strings.Replace(
+			targetReceipt,
+			`"Target"`,
+			strconv.Quote(test.retailer),
+			1,
+		)
+		recorder := serveTestRequest(
+			handler,
+			http.MethodPost,
+			"/receipts/process",
+			body,
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%q responded with %d, expected %d",
+				test.retailer,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if recorder.Code != http.StatusCreated {
+			continue
+		}
+
+		var processed ProcessReceiptsResponseBody
+		err := json.Unmarshal(recorder.Body.Bytes(), &processed)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points := getTestReceiptPoints(t, handler, processed.ReceiptId)
+
+		if points != test.expectedPoints {
+			t.Errorf(
+				"%q was awarded %d points, expected %d",
+				test.retailer,
+				points,
+				test.expectedPoints,
+			)
+		}
+	}
+}
+
+// Returns the code of the JSON error the recorder holds, failing the test
+// when it doesn't hold one
+func testErrorCode(
+	t *testing.T,
+	recorder *httptest.ResponseRecorder,
+) string {
+	t.Helper()
+	var body ErrorResponseBody
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, recorder.Body)
+	}
+
+	return body.Code
+}
+
+func TestGetReceipt(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, cornerMarketReceipt)
+
+	tests := []struct {
+		name           string
+		receiptId      string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"stored", receiptId, http.StatusOK, ""},
+		{
+			"missing",
+			"00000000-0000-0000-0000-000000000000",
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+		},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodGet,
+			"/receipts/"+test.receiptId,
+			"",
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if test.expectedCode != "" {
+			if code := testErrorCode(t, recorder); code != test.expectedCode {
+				t.Errorf("%s: responded with %s", test.name, code)
+			}
+
+			continue
+		}
+
+		var body map[string]any
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]any{
+			"retailer":     "M&M Corner Market",
+			"purchaseDate": "2022-03-20",
+			"purchaseTime": "14:33",
+			"total":        "9.00",
+		}
+
+		for field, value := range expected {
+			if body[field] != value {
+				t.Errorf("%s is %v, expected %v", field, body[field], value)
+			}
+		}
+
+		if items, _ := body["items"].([]any); len(items) != 4 {
+			t.Errorf("%d items, expected 4", len(items))
+		}
+
+		creationDate, _ := body["creationDate"].(string)
+
+		if _, err := time.Parse(time.RFC3339, creationDate); err != nil {
+			t.Errorf("creationDate: %v", err)
+		}
+	}
+}
+
+func TestGetPointsBreakdown(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		name     string
+		receipt  string
+		expected map[string]int64
+	}{
+		{
+			"Target",
+			targetReceipt,
+			map[string]int64{
+				"alphanumericRetailerPoints":   6,
+				"every2ItemsPoints":            10,
+				"itemDescriptionLengthsPoints": 6,
+				"purchaseDayOddPoints":         6,
+			},
+		},
+		{
+			"M&M Corner Market",
+			cornerMarketReceipt,
+			map[string]int64{
+				"alphanumericRetailerPoints":     14,
+				"totalRoundDollarAmountPoints":   50,
+				"totalMultipleOf25CentsPoints":   25,
+				"every2ItemsPoints":              10,
+				"purchaseTimeBetween2And4Points": 10,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		receiptId := processTestReceipt(t, handler, test.receipt)
+		recorder := serveTestRequest(
+			handler,
+			http.MethodGet,
+			"/receipts/"+receiptId+"/points/breakdown",
+			"",
+		)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: responded with %d", test.name, recorder.Code)
+		}
+
+		var body struct {
+			Rules map[string]int64     `json:"rules"`
+			Total int64                `json:"total"`
+			Items []receipt.ItemPoints `json:"items"`
+		}
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		var expectedTotal int64 = 0
+
+		for _, rule := range receipt.RuleNames() {
+			expectedTotal += test.expected[rule]
+			points, exists := body.Rules[rule]
+
+			if !exists || points != test.expected[rule] {
+				t.Errorf(
+					"%s: %s awarded %d points, expected %d",
+					test.name,
+					rule,
+					points,
+					test.expected[rule],
+				)
+			}
+		}
+
+		if body.Total != expectedTotal {
+			t.Errorf("%s: total of %d points", test.name, body.Total)
+		}
+
+		var itemsTotal int64 = 0
+
+		for _, item := range body.Items {
+			itemsTotal += item.PointsAwarded
+		}
+
+		if itemsTotal != body.Rules["itemDescriptionLengthsPoints"] {
+			t.Errorf("%s: items awarded %+v", test.name, body.Items)
+		}
+	}
+
+	recorder := serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/00000000-0000-0000-0000-000000000000/points/breakdown",
+		"",
+	)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("a missing receipt responded with %d", recorder.Code)
+	}
+}
+
+// The items are attributed the points they were awarded when the breakdown
+// was computed, even once the rules have changed
+func TestPointsBreakdownKeepsStoredItemPoints(t *testing.T) {
+	defer func(original receipt.RuleConfig) { rules = original }(rules)
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+	getTestReceiptPoints(t, handler, receiptId)
+	rules.DescriptionPriceMultiplier = 1
+	recorder := serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/"+receiptId+"/points/breakdown",
+		"",
+	)
+
+	var body ReceiptsPointsBreakdownResponseBody
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	var itemsTotal int64 = 0
+
+	for _, item := range body.Items {
+		itemsTotal += item.PointsAwarded
+	}
+
+	if itemsTotal != 6 {
+		t.Errorf("items awarded %+v, expected 6 points in all", body.Items)
+	}
+}
+
+// A store whose lookups fail for every receipt, existing or not
+type failingLookupStorage struct {
+	Storage
+}
+
+func (store failingLookupStorage) getComputedReceiptRow(
+	receiptId string,
+) (ReceiptRow, error) {
+	return ReceiptRow{}, errors.New("disk I/O error")
+}
+
+// Only a missing receipt is a 404, not a store that fails to look it up
+func TestPointsBreakdownLookupFailure(t *testing.T) {
+	defer func() { db = NewXDB() }()
+	db = failingLookupStorage{NewXDB()}
+	handler := receiptsSubresourceHandler()
+	path := "/receipts/00000000-0000-0000-0000-000000000000/points/"
+
+	for _, subresource := range []string{"breakdown", "explain"} {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodGet,
+			path+subresource,
+			"",
+		)
+
+		if recorder.Code != http.StatusInternalServerError ||
+			testErrorCode(t, recorder) != "INTERNAL_ERROR" {
+			t.Errorf(
+				"%s: responded with %d: %s",
+				subresource,
+				recorder.Code,
+				recorder.Body,
+			)
+		}
+	}
+}
+
+// The rules are in the order they're applied, which README.md documents, so
+// every response for a receipt is byte for byte the same
+func TestPointsBreakdownIsStable(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, cornerMarketReceipt)
+	path := "/receipts/" + receiptId + "/points/breakdown"
+	first := serveTestRequest(handler, http.MethodGet, path, "").Body.String()
+
+	for request := 0; request < 100; request++ {
+		recorder := serveTestRequest(handler, http.MethodGet, path, "")
+		body := recorder.Body.String()
+
+		if body != first {
+			t.Fatalf("responded with %s, then with %s", first, body)
+		}
+	}
+
+	var body struct {
+		Rules receipt.PointsBreakdown `json:"rules"`
+	}
+
+	if err := json.Unmarshal([]byte(first), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	var rules []string
+
+	for _, rulePoints := range body.Rules {
+		rules = append(rules, rulePoints.Rule)
+	}
+
+	expected := []string{
+		"alphanumericRetailerPoints",
+		"totalRoundDollarAmountPoints",
+		"totalMultipleOf25CentsPoints",
+		"every2ItemsPoints",
+		"itemDescriptionLengthsPoints",
+		"purchaseDayOddPoints",
+		"purchaseTimeBetween2And4Points",
+		"largeTotalBonusPoints",
+		"manyItemsBonusPoints",
+		"retailerBonusPoints",
+	}
+
+	if !slices.Equal(rules, expected) {
+		t.Errorf("responded with rules %q, expected %q", rules, expected)
+	}
+}
+
+func TestReceiptsSurviveReload(t *testing.T) {
+	tests := []struct {
+		name   string
+		create bool
+	}{
+		{"missing file", false},
+		{"empty file", true},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "receipts.jsonl")
+
+		if test.create {
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		store, err := NewXDBFromFile(path)
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		ctx := context.Background()
+		receiptIds := make(map[string]int64)
+
+		for _, expected := range []struct {
+			receipt string
+			points  int64
+		}{
+			{targetReceipt, targetReceiptPoints},
+			{cornerMarketReceipt, cornerMarketReceiptPoints},
+		} {
+			receiptId, err := store.writeReceipt(
+				ctx,
+				unmarshalTestReceipt(t, expected.receipt),
+			)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiptIds[receiptId] = expected.points
+		}
+
+		store.File.Close()
+		store, err = NewXDBFromFile(path)
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		for receiptId, expected := range receiptIds {
+			points, err := store.getReceiptPoints(ctx, receiptId)
+
+			if err != nil || points != expected {
+				t.Errorf(
+					"%s: reloaded %d points with error %v, expected %d",
+					test.name,
+					points,
+					err,
+					expected,
+				)
+			}
+		}
+
+		store.File.Close()
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		host     string
+		port     string
+		expected string
+		valid    bool
+	}{
+		{"", "", ":8000", true},
+		{"", "9000", ":9000", true},
+		{"127.0.0.1", "", "127.0.0.1:8000", true},
+		{"::1", "8080", "[::1]:8080", true},
+		{"", "0", "", false},
+		{"", "65536", "", false},
+		{"", "http", "", false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("HOST", test.host)
+		t.Setenv("PORT", test.port)
+		address, err := listenAddress()
+
+		if (err == nil) != test.valid || address != test.expected {
+			t.Errorf(
+				"HOST=%q PORT=%q gave %q with error %v, expected %q",
+				test.host,
+				test.port,
+				address,
+				err,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		body            string
+		expectedStatus  int
+		expectedCode    string
+		expectedMessage string
+	}{
+		{
+			"invalid receipt",
+			http.MethodPost,
+			"/receipts/process",
+			`{"retailer": "Target!"}`,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		},
+		{
+			"malformed JSON",
+			http.MethodPost,
+			"/receipts/process",
+			`{"retailer": `,
+			http.StatusBadRequest,
+			"INVALID_RECEIPT",
+			"The receipt is invalid.",
+		},
+		{
+			"missing receipt",
+			http.MethodGet,
+			"/receipts/00000000-0000-0000-0000-000000000000/points",
+			"",
+			http.StatusNotFound,
+			"RECEIPT_NOT_FOUND",
+			"No receipt found for that ID.",
+		},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			handler,
+			test.method,
+			test.path,
+			test.body,
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		}
+
+		contentType := recorder.Header().Get("Content-Type")
+
+		if contentType != "application/json" {
+			t.Errorf("%s: responded with %s", test.name, contentType)
+		}
+
+		var body ErrorResponseBody
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if body.Code != test.expectedCode ||
+			body.Error != test.expectedMessage {
+			t.Errorf(
+				"%s: responded with %s %q, expected %s %q",
+				test.name,
+				body.Code,
+				body.Error,
+				test.expectedCode,
+				test.expectedMessage,
+			)
+		}
+	}
+}
+
+// Generates the UUIDs 00000000-0000-0000-0000-000000000001 and onwards, so
+// that they sort in the order the receipts are written
+func sequentialTestIDs() func() string {
+	var mu sync.Mutex
+	next := 0
+
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		next++
+		return fmt.Sprintf("00000000-0000-0000-0000-%012d", next)
+	}
+}
+
+func TestListReceiptsPages(t *testing.T) {
+	db = NewXDB(WithIDGenerator(sequentialTestIDs()))
+	subresourceHandler := receiptsSubresourceHandler()
+	var receiptIds []string
+
+	for write := 0; write < 5; write++ {
+		receiptIds = append(
+			receiptIds,
+			processTestReceipt(t, subresourceHandler, targetReceipt),
+		)
+	}
+
+	tests := []struct {
+		query          string
+		expectedStatus int
+		expectedIds    []string
+	}{
+		{"", http.StatusOK, receiptIds},
+		{"?limit=2", http.StatusOK, receiptIds[:2]},
+		{"?limit=2&offset=1", http.StatusOK, receiptIds[1:3]},
+		{"?offset=4", http.StatusOK, receiptIds[4:]},
+		{"?offset=10", http.StatusOK, []string{}},
+		{"?limit=1000", http.StatusOK, receiptIds},
+		{"?limit=-1", http.StatusBadRequest, nil},
+		{"?offset=first", http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			receiptsHandler(),
+			http.MethodGet,
+			"/receipts"+test.query,
+			"",
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%q responded with %d, expected %d",
+				test.query,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if recorder.Code != http.StatusOK {
+			continue
+		}
+
+		var body ListReceiptsResponseBody
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		listedIds := make([]string, 0, len(body.Receipts))
+
+		for _, summary := range body.Receipts {
+			listedIds = append(listedIds, summary.ReceiptId)
+
+			if summary.Points != targetReceiptPoints {
+				t.Errorf(
+					"%s listed with %d points",
+					summary.ReceiptId,
+					summary.Points,
+				)
+			}
+		}
+
+		if !slices.Equal(listedIds, test.expectedIds) || body.Total != 5 {
+			t.Errorf(
+				"%q listed %q of %d receipts, expected %q",
+				test.query,
+				listedIds,
+				body.Total,
+				test.expectedIds,
+			)
+		}
+	}
+}
+
+func TestCreationDate(t *testing.T) {
+	store := NewXDB()
+	ctx := context.Background()
+	r := unmarshalTestReceipt(t, targetReceipt)
+	before := time.Now().UTC()
+	var creationDates []time.Time
+
+	for write := 0; write < 2; write++ {
+		receiptId, err := store.writeReceipt(ctx, r)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		row, err := store.getReceiptRow(receiptId)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		creationDates = append(creationDates, row.CreationDate)
+	}
+
+	if creationDates[0].Before(before) ||
+		creationDates[0].Location() != time.UTC {
+		t.Errorf("the first receipt was created %v", creationDates[0])
+	}
+
+	if creationDates[1].Before(creationDates[0]) {
+		t.Errorf(
+			"the second receipt was created %v, before %v",
+			creationDates[1],
+			creationDates[0],
+		)
+	}
+
+	summaries, _, err := store.listReceipts(ReceiptFilter{}, 2, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, summary := range summaries {
+		_, err := time.Parse(time.RFC3339, summary.CreationDate)
+
+		if err != nil {
+			t.Errorf("listed creation date: %v", err)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		key            string
+		expectedStatus int
+		// The index of the earlier request whose receipt is replayed, or -1
+		// for a new receipt
+		replays int
+	}{
+		{"first", http.StatusCreated, -1},
+		{"first", http.StatusOK, 0},
+		{"second", http.StatusCreated, -1},
+		{"", http.StatusCreated, -1},
+		{"", http.StatusCreated, -1},
+		{"second", http.StatusOK, 2},
+	}
+
+	receiptIds := make([]string, 0, len(tests))
+
+	for index, test := range tests {
+		request := httptest.NewRequest(
+			http.MethodPost,
+			"/receipts/process",
+			strings.NewReader(targetReceipt),
+		)
+		request.Header.Set("Content-Type", "application/json")
+
+		if test.key != "" {
+			request.Header.Set("Idempotency-Key", test.key)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expectedStatus {
+			t.Fatalf(
+				"request %d responded with %d, expected %d",
+				index,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		}
+
+		var processed ProcessReceiptsResponseBody
+		err := json.Unmarshal(recorder.Body.Bytes(), &processed)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		replayed := recorder.Header().Get("Idempotent-Replayed") == "true"
+
+		if test.replays >= 0 {
+			if !replayed || processed.ReceiptId != receiptIds[test.replays] {
+				t.Errorf(
+					"request %d responded with %s, expected a replay of %s",
+					index,
+					processed.ReceiptId,
+					receiptIds[test.replays],
+				)
+			}
+		} else if replayed || slices.Contains(receiptIds, processed.ReceiptId) {
+			t.Errorf("request %d replayed %s", index, processed.ReceiptId)
+		}
+
+		receiptIds = append(receiptIds, processed.ReceiptId)
+	}
+
+	if count, _ := db.count(); count != 4 {
+		t.Errorf("%d receipts stored, expected 4", count)
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	defaultMaxRequestBodyBytes := maxRequestBodyBytes
+	maxRequestBodyBytes = int64(len(targetReceipt))
+	defer func() { maxRequestBodyBytes = defaultMaxRequestBodyBytes }()
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"at the limit", targetReceipt, http.StatusCreated},
+		{"a byte over", targetReceipt + " ", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodPost,
+			"/receipts/process",
+			test.body,
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		}
+
+		if recorder.Code == http.StatusRequestEntityTooLarge &&
+			testErrorCode(t, recorder) != "REQUEST_TOO_LARGE" {
+			t.Errorf("%s: responded with %s", test.name, recorder.Body)
+		}
+	}
+}
+
+func gzipTestBody(t *testing.T, body string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+
+	if _, err := writer.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.String()
+}
+
+func TestProcessGzippedReceipt(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	defaultMaxRequestBodyBytes := maxRequestBodyBytes
+	maxRequestBodyBytes = 1 << 10
+	defer func() { maxRequestBodyBytes = defaultMaxRequestBodyBytes }()
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"gzipped", gzipTestBody(t, targetReceipt), http.StatusCreated},
+		{"not gzipped", targetReceipt, http.StatusBadRequest},
+		// Small once compressed, but over the limit once decompressed
+		{
+			"bomb",
+			gzipTestBody(t, targetReceipt+strings.Repeat(" ", 1<<20)),
+			http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(
+			http.MethodPost,
+			"/receipts/process",
+			strings.NewReader(test.body),
+		)
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Content-Encoding", "gzip")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if recorder.Code != http.StatusCreated {
+			continue
+		}
+
+		var processed ProcessReceiptsResponseBody
+		err := json.Unmarshal(recorder.Body.Bytes(), &processed)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points := getTestReceiptPoints(t, handler, processed.ReceiptId)
+
+		if points != targetReceiptPoints {
+			t.Errorf("%s: awarded %d points", test.name, points)
+		}
+	}
+}
+
+// Scrapes the value of every series that metricsHandler writes, keyed by
+// their name and labels, like `receipts_processed_total{result="success"}`
+func scrapeTestMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	recorder := serveTestRequest(metricsHandler(), http.MethodGet, "/", "")
+	metrics := make(map[string]float64)
+
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		separator := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[separator+1:], 64)
+
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+
+		metrics[line[:separator]] = value
+	}
+
+	return metrics
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	before := scrapeTestMetrics(t)
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+	serveTestRequest(handler, http.MethodPost, "/receipts/process", `{}`)
+	getTestReceiptPoints(t, handler, receiptId)
+	serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/00000000-0000-0000-0000-000000000000/points",
+		"",
+	)
+	serveTestRequest(handler, http.MethodGet, "/receipts/a.b/points", "")
+	after := scrapeTestMetrics(t)
+
+	for _, series := range []string{
+		`receipts_processed_total{result="success"}`,
+		`receipts_processed_total{result="failure"}`,
+		`points_lookups_total{result="found"}`,
+		`points_lookups_total{result="not_found"}`,
+		`points_lookups_total{result="invalid_id"}`,
+	} {
+		if after[series]-before[series] != 1 {
+			t.Errorf(
+				"%s went from %v to %v, expected an increment of 1",
+				series,
+				before[series],
+				after[series],
+			)
+		}
+	}
+
+	timed := `operation_duration_seconds_count{` +
+		`operation="writing receipt to storage"}`
+
+	if after[timed] <= before[timed] {
+		t.Errorf("%s wasn't incremented", timed)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test.", "step", []float64{0.1, 1})
+	h.observe("b", 0.05)
+	h.observe("b", 0.1)
+	h.observe("b", 0.5)
+	h.observe("b", 2)
+	h.observe("a", 1)
+	var output strings.Builder
+	h.writeTo(&output)
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{step="a",le="0.1"} 0
+test_seconds_bucket{step="a",le="1"} 1
+test_seconds_bucket{step="a",le="+Inf"} 1
+test_seconds_sum{step="a"} 1
+test_seconds_count{step="a"} 1
+test_seconds_bucket{step="b",le="0.1"} 2
+test_seconds_bucket{step="b",le="1"} 3
+test_seconds_bucket{step="b",le="+Inf"} 4
+test_seconds_sum{step="b"} 2.65
+test_seconds_count{step="b"} 4
+`
+
+	if output.String() != expected {
+		t.Errorf("wrote %q, expected %q", output.String(), expected)
+	}
+}
+
+// Each step timed while serving a request is observed under its message
+func TestOperationDuration(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+	before := scrapeTestMetrics(t)
+	getTestReceiptPoints(t, handler, receiptId)
+	withTimer("sleeping for a test", func() { time.Sleep(time.Millisecond) })
+	after := scrapeTestMetrics(t)
+
+	for _, operation := range []string{
+		"getting receipt ID from request URL path",
+		"getting the points awarded for the given receipt",
+		"writing points to response body",
+		"sleeping for a test",
+	} {
+		labels := fmt.Sprintf("{operation=%q}", operation)
+		count := "operation_duration_seconds_count" + labels
+		infBucket := fmt.Sprintf(
+			"operation_duration_seconds_bucket{operation=%q,le=\"+Inf\"}",
+			operation,
+		)
+
+		if after[count]-before[count] != 1 ||
+			after[infBucket]-before[infBucket] != 1 {
+			t.Errorf(
+				"%s was observed %v times, expected once",
+				operation,
+				after[count]-before[count],
+			)
+		}
+	}
+
+	sum := `operation_duration_seconds_sum{operation="sleeping for a test"}`
+	fastest := `operation_duration_seconds_bucket{` +
+		`operation="sleeping for a test",le="0.0005"}`
+
+	if after[sum]-before[sum] < 0.001 || after[fastest] != before[fastest] {
+		t.Errorf(
+			"slept for %v seconds, counted in the fastest bucket %v times",
+			after[sum]-before[sum],
+			after[fastest]-before[fastest],
+		)
+	}
+}
+
+func TestProcessAndGetPoints(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		name     string
+		receipt  string
+		expected int64
+	}{
+		{"Target", targetReceipt, targetReceiptPoints},
+		{"M&M Corner Market", cornerMarketReceipt, cornerMarketReceiptPoints},
+	}
+
+	for _, test := range tests {
+		receiptId := processTestReceipt(t, handler, test.receipt)
+
+		if _, err := uuid.Parse(receiptId); err != nil {
+			t.Errorf("%s: processed as %q: %v", test.name, receiptId, err)
+		}
+
+		points := getTestReceiptPoints(t, handler, receiptId)
+
+		if points != test.expected {
+			t.Errorf(
+				"%s: awarded %d points, expected %d",
+				test.name,
+				points,
+				test.expected,
+			)
+		}
+	}
+
+	if count, _ := db.count(); count != len(tests) {
+		t.Errorf("%d receipts stored, expected %d", count, len(tests))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	db = NewXDB()
+	var logs bytes.Buffer
+	handler := withRequestID(
+		newLoggingHandler(&logs)(receiptsSubresourceHandler()),
+	)
+
+	tests := []struct {
+		name      string
+		requestId string
+		kept      bool
+	}{
+		{"supplied", "client-request.42", true},
+		{"generated", "", false},
+		{"invalid", "not a request ID", false},
+	}
+
+	for _, test := range tests {
+		logs.Reset()
+		request := httptest.NewRequest(
+			http.MethodGet,
+			"/receipts/00000000-0000-0000-0000-000000000000/points",
+			nil,
+		)
+
+		if test.requestId != "" {
+			request.Header.Set("X-Request-ID", test.requestId)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		requestId := recorder.Header().Get("X-Request-ID")
+
+		if test.kept && requestId != test.requestId {
+			t.Errorf("%s: responded with %q", test.name, requestId)
+		}
+
+		if _, err := uuid.Parse(requestId); !test.kept && err != nil {
+			t.Errorf("%s: generated %q", test.name, requestId)
+		}
+
+		var body ErrorResponseBody
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		if body.RequestId != requestId {
+			t.Errorf(
+				"%s: the error holds %q instead of %q",
+				test.name,
+				body.RequestId,
+				requestId,
+			)
+		}
+
+		if !strings.Contains(logs.String(), requestId) {
+			t.Errorf("%s: %q wasn't logged: %s", test.name, requestId, &logs)
+		}
+	}
+}
+
+func TestProcessBatch(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		// Whether each receipt of the batch is expected to be processed
+		expectedValid []bool
+	}{
+		{
+			"all valid",
+			"[" + targetReceipt + "," + cornerMarketReceipt + "]",
+			http.StatusOK,
+			[]bool{true, true},
+		},
+		{
+			"mixed",
+			"[" + targetReceipt + `, {"retailer": "Target!"}, 42]`,
+			http.StatusMultiStatus,
+			[]bool{true, false, false},
+		},
+		{"empty", "[]", http.StatusOK, []bool{}},
+		{"not an array", targetReceipt, http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		db = NewXDB()
+		recorder := serveTestRequest(
+			receiptsSubresourceHandler(),
+			http.MethodPost,
+			"/receipts/process/batch",
+			test.body,
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if test.expectedValid == nil {
+			continue
+		}
+
+		var results []BatchReceiptResult
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != len(test.expectedValid) {
+			t.Fatalf("%s: %d results", test.name, len(results))
+		}
+
+		processed := 0
+
+		for index, result := range results {
+			valid := result.ReceiptId != "" && result.Error == ""
+
+			if result.Index != index || valid != test.expectedValid[index] {
+				t.Errorf("%s: result %d is %+v", test.name, index, result)
+			}
+
+			if valid {
+				processed++
+			}
+		}
+
+		if count, _ := db.count(); count != processed {
+			t.Errorf("%s: %d receipts stored", test.name, count)
+		}
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	const allowed = "https://app.example.com"
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name            string
+		allowedOrigins  string
+		method          string
+		origin          string
+		expectedAllowed bool
+	}{
+		{"allowed", allowed, http.MethodGet, allowed, true},
+		{"allowed preflight", allowed, http.MethodOptions, allowed, true},
+		{"other origin", allowed, http.MethodGet, "https://evil.test", false},
+		{
+			"other origin preflight",
+			allowed,
+			http.MethodOptions,
+			"https://evil.test",
+			false,
+		},
+		{"no allowed origins", "", http.MethodGet, allowed, false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("CORS_ALLOWED_ORIGINS", test.allowedOrigins)
+		config, err := loadCORSConfig()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request := httptest.NewRequest(test.method, "/receipts/process", nil)
+		request.Header.Set("Origin", test.origin)
+
+		if test.method == http.MethodOptions {
+			request.Header.Set("Access-Control-Request-Method", "POST")
+		}
+
+		recorder := httptest.NewRecorder()
+		newCORSHandler(config)(ok).ServeHTTP(recorder, request)
+		allowOrigin := recorder.Header().Get("Access-Control-Allow-Origin")
+		expected := ""
+
+		if test.expectedAllowed {
+			expected = test.origin
+		}
+
+		if allowOrigin != expected {
+			t.Errorf("%s: allowed origin %q", test.name, allowOrigin)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	const origin = "https://app.example.com"
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	configured := map[string]string{
+		"CORS_ALLOWED_METHODS":   "GET,POST,PATCH",
+		"CORS_ALLOWED_HEADERS":   "Content-Type,X-Trace",
+		"CORS_MAX_AGE":           "300",
+		"CORS_ALLOW_CREDENTIALS": "true",
+	}
+
+	// Allowed methods are only echoed back for methods other than GET, HEAD
+	// and POST, which browsers always allow
+	tests := []struct {
+		name            string
+		env             map[string]string
+		requestMethod   string
+		requestHeaders  string
+		expectedHeaders map[string]string
+	}{
+		{
+			"defaults",
+			map[string]string{},
+			http.MethodPatch,
+			"Idempotency-Key",
+			map[string]string{
+				"Access-Control-Allow-Methods":     "PATCH",
+				"Access-Control-Allow-Headers":     "Idempotency-Key",
+				"Access-Control-Max-Age":           "",
+				"Access-Control-Allow-Credentials": "",
+			},
+		},
+		{
+			"configured",
+			configured,
+			http.MethodPatch,
+			"X-Trace",
+			map[string]string{
+				"Access-Control-Allow-Methods":     "PATCH",
+				"Access-Control-Allow-Headers":     "X-Trace",
+				"Access-Control-Max-Age":           "300",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{
+			"method not allowed",
+			configured,
+			http.MethodDelete,
+			"",
+			map[string]string{
+				"Access-Control-Allow-Methods": "",
+				"Access-Control-Allow-Origin":  "",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Setenv("CORS_ALLOWED_ORIGINS", origin)
+
+		for _, name := range sortedKeys(configured) {
+			t.Setenv(name, test.env[name])
+		}
+
+		config, err := loadCORSConfig()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request := httptest.NewRequest(
+			http.MethodOptions,
+			"/receipts/process",
+			nil,
+		)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", test.requestMethod)
+
+		if test.requestHeaders != "" {
+			request.Header.Set(
+				"Access-Control-Request-Headers",
+				test.requestHeaders,
+			)
+		}
+
+		recorder := httptest.NewRecorder()
+		newCORSHandler(config)(ok).ServeHTTP(recorder, request)
+
+		for header, expected := range test.expectedHeaders {
+			if value := recorder.Header().Get(header); value != expected {
+				t.Errorf(
+					"%s: responded with %s %q, expected %q",
+					test.name,
+					header,
+					value,
+					expected,
+				)
+			}
+		}
+	}
+
+	for _, env := range []map[string]string{
+		{"CORS_MAX_AGE": "601"},
+		{"CORS_MAX_AGE": "-1"},
+		{"CORS_ALLOW_CREDENTIALS": "sometimes"},
+		{"CORS_ALLOWED_ORIGINS": "*", "CORS_ALLOW_CREDENTIALS": "true"},
+	} {
+		t.Setenv("CORS_ALLOWED_ORIGINS", origin)
+		t.Setenv("CORS_MAX_AGE", "")
+		t.Setenv("CORS_ALLOW_CREDENTIALS", "")
+
+		for name, value := range env {
+			t.Setenv(name, value)
+		}
+
+		if _, err := loadCORSConfig(); err == nil {
+			t.Errorf("loaded %v", env)
+		}
+	}
+}
+
+func TestEvictExpiredReceipts(t *testing.T) {
+	store := NewXDB()
+	defer store.Stop()
+
+	ctx := context.Background()
+	r := unmarshalTestReceipt(t, targetReceipt)
+	expiredId, err := store.writeReceipt(ctx, r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freshId, err := store.writeReceipt(ctx, r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Mu.Lock()
+	expired := store.Receipts[expiredId]
+	expired.CreationDate = expired.CreationDate.Add(-time.Hour)
+	store.Receipts[expiredId] = expired
+	store.Mu.Unlock()
+
+	store.StartEviction(time.Minute, 10*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		if _, err := store.getReceiptRow(expiredId); err != nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the expired receipt wasn't evicted")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := store.getReceiptRow(freshId); err != nil {
+		t.Errorf("the fresh receipt was evicted: %v", err)
+	}
+}
+
+func TestDeleteReceipt(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{
+			"delete",
+			http.MethodDelete,
+			"/receipts/" + receiptId,
+			http.StatusNoContent,
+		},
+		{
+			"points",
+			http.MethodGet,
+			"/receipts/" + receiptId + "/points",
+			http.StatusNotFound,
+		},
+		{
+			"delete again",
+			http.MethodDelete,
+			"/receipts/" + receiptId,
+			http.StatusNotFound,
+		},
+		{
+			"delete missing",
+			http.MethodDelete,
+			"/receipts/00000000-0000-0000-0000-000000000000",
+			http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(handler, test.method, test.path, "")
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		}
+
+		if recorder.Code == http.StatusNotFound &&
+			testErrorCode(t, recorder) != "RECEIPT_NOT_FOUND" {
+			t.Errorf("%s: responded with %s", test.name, recorder.Body)
+		}
+	}
+
+	if count, _ := db.count(); count != 0 {
+		t.Errorf("%d receipts left", count)
+	}
+}
+
+// Points are only computed on the first lookup, which many lookups may race
+// to make at once
+func TestLazyPointsUnderConcurrentFirstAccess(t *testing.T) {
+	store := NewXDB()
+	ctx := context.Background()
+	receiptId, err := store.writeReceipt(
+		ctx,
+		unmarshalTestReceipt(t, cornerMarketReceipt),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row, _ := store.getReceiptRow(receiptId); row.Computed {
+		t.Fatal("the points were computed on write")
+	}
+
+	const readers = 32
+	errs := make(chan error, readers)
+	var wg sync.WaitGroup
+
+	for reader := 0; reader < readers; reader++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			points, err := store.getReceiptPoints(ctx, receiptId)
+
+			if err == nil && points != cornerMarketReceiptPoints {
+				err = fmt.Errorf("looked up %d points", points)
+			}
+
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	row, _ := store.getReceiptRow(receiptId)
+
+	if !row.Computed || row.Points != cornerMarketReceiptPoints {
+		t.Errorf("cached %d points, computed %t", row.Points, row.Computed)
+	}
+}
+
+func BenchmarkGetReceiptPoints(b *testing.B) {
+	store := NewXDB()
+	ctx := context.Background()
+	var r receipt.Receipt
+
+	if err := json.Unmarshal([]byte(targetReceipt), &r); err != nil {
+		b.Fatal(err)
+	}
+
+	receiptId, err := store.writeReceipt(ctx, r)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		if _, err := store.getReceiptPoints(ctx, receiptId); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkComputePoints(b *testing.B) {
+	var r receipt.Receipt
+
+	if err := json.Unmarshal([]byte(targetReceipt), &r); err != nil {
+		b.Fatal(err)
+	}
+
+	cfg := receipt.DefaultRuleConfig()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		r.ComputePoints(cfg)
+	}
+}
+
+func TestStructuredLogging(t *testing.T) {
+	db = NewXDB()
+	var logs bytes.Buffer
+	handler := withRequestID(
+		newStructuredLoggingHandler(&logs)(receiptsSubresourceHandler()),
+	)
+
+	tests := []struct {
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			http.MethodPost,
+			"/receipts/process",
+			targetReceipt,
+			http.StatusCreated,
+		},
+		{
+			http.MethodGet,
+			"/receipts/00000000-0000-0000-0000-000000000000/points",
+			"",
+			http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		logs.Reset()
+		recorder := serveTestRequest(handler, test.method, test.path, test.body)
+		var entry requestLogEntry
+
+		if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+			t.Fatalf("%s %s logged %q: %v", test.method, test.path, &logs, err)
+		}
+
+		_, err := time.Parse(time.RFC3339, entry.Time)
+
+		if err != nil ||
+			entry.Method != test.method ||
+			entry.Path != test.path ||
+			entry.Status != test.expectedStatus ||
+			entry.Bytes != recorder.Body.Len() ||
+			entry.DurationSeconds < 0 ||
+			entry.RequestId != recorder.Header().Get("X-Request-ID") {
+			t.Errorf("%s %s logged %+v", test.method, test.path, entry)
+		}
+	}
+}
+
+func TestPreviewReceipt(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		name           string
+		receipt        string
+		expectedStatus int
+		expectedPoints int64
+	}{
+		{"Target", targetReceipt, http.StatusOK, targetReceiptPoints},
+		{
+			"M&M Corner Market",
+			cornerMarketReceipt,
+			http.StatusOK,
+			cornerMarketReceiptPoints,
+		},
+		{"invalid", `{"retailer": "Target!"}`, http.StatusBadRequest, 0},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodPost,
+			"/receipts/preview",
+			test.receipt,
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if recorder.Code != http.StatusOK {
+			continue
+		}
+
+		var body ReceiptsPointsResponseBody
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		if count, _ := db.count(); count != 0 {
+			t.Fatalf("%s: previewing stored %d receipts", test.name, count)
+		}
+
+		// The same points as submitting it for real
+		receiptId := processTestReceipt(t, handler, test.receipt)
+		points := getTestReceiptPoints(t, handler, receiptId)
+		db = NewXDB()
+
+		if body.Points != test.expectedPoints || body.Points != points {
+			t.Errorf(
+				"%s: previewed %d points, processed %d, expected %d",
+				test.name,
+				body.Points,
+				points,
+				test.expectedPoints,
+			)
+		}
+	}
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		valid    bool
+	}{
+		{"", 5 * time.Second, true},
+		{"250ms", 250 * time.Millisecond, true},
+		{"fast", 0, false},
+		{"-1s", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("READ_HEADER_TIMEOUT", test.value)
+		server, err := newServer(":0", http.NotFoundHandler())
+
+		if (err == nil) != test.valid {
+			t.Errorf("%q built a server with error %v", test.value, err)
+		} else if test.valid && server.ReadHeaderTimeout != test.expected {
+			t.Errorf(
+				"%q set a timeout of %v, expected %v",
+				test.value,
+				server.ReadHeaderTimeout,
+				test.expected,
+			)
+		}
+	}
+}
+
+// A client that never finishes sending its headers is disconnected once the
+// read header timeout is up
+func TestStalledClientIsDropped(t *testing.T) {
+	t.Setenv("READ_HEADER_TIMEOUT", "50ms")
+	server, err := newServer("127.0.0.1:0", http.NotFoundHandler())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", server.Addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(listener)
+	defer server.Close()
+
+	connection, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer connection.Close()
+
+	if _, err := connection.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(connection)
+
+	if err != nil {
+		t.Fatalf("the connection wasn't dropped: %v", err)
+	}
+
+	// The server may answer with a 408 before closing the connection
+	if len(response) > 0 &&
+		!bytes.Contains(response, []byte("408 Request Timeout")) {
+		t.Errorf("responded with %q", response)
+	}
+}
+
+// Encodes the given JSON receipt as the equivalent form, naming the item
+// fields like "items[0].price"
+func testReceiptForm(t *testing.T, data string) string {
+	t.Helper()
+	var fields map[string]any
+
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{}
+
+	for key, value := range fields {
+		items, ok := value.([]any)
+
+		if !ok {
+			form.Set(key, value.(string))
+			continue
+		}
+
+		for index, item := range items {
+			for name, value := range item.(map[string]any) {
+				key := fmt.Sprintf("items[%d].%s", index, name)
+				form.Set(key, value.(string))
+			}
+		}
+	}
+
+	return form.Encode()
+}
+
+func TestProcessFormEncodedReceipt(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	const formType = "application/x-www-form-urlencoded"
+
+	tests := []struct {
+		name           string
+		contentType    string
+		body           string
+		expectedStatus int
+		expectedPoints int64
+	}{
+		{
+			"json",
+			"application/json",
+			targetReceipt,
+			http.StatusCreated,
+			targetReceiptPoints,
+		},
+		{
+			"form",
+			formType,
+			testReceiptForm(t, targetReceipt),
+			http.StatusCreated,
+			targetReceiptPoints,
+		},
+		{
+			"form with a charset",
+			formType + "; charset=utf-8",
+			testReceiptForm(t, cornerMarketReceipt),
+			http.StatusCreated,
+			cornerMarketReceiptPoints,
+		},
+		{
+			"form with a gap between items",
+			formType,
+			strings.Replace(
+				testReceiptForm(t, cornerMarketReceipt),
+				"items%5B3%5D",
+				"items%5B7%5D",
+				-1,
+			),
+			http.StatusBadRequest,
+			0,
+		},
+		{
+			"plain text",
+			"text/plain",
+			targetReceipt,
+			http.StatusUnsupportedMediaType,
+			0,
+		},
+		{
+			"xml",
+			"application/xml",
+			"<receipt/>",
+			http.StatusUnsupportedMediaType,
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(
+			http.MethodPost,
+			"/receipts/process",
+			strings.NewReader(test.body),
+		)
+		request.Header.Set("Content-Type", test.contentType)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d: %s",
+				test.name,
+				recorder.Code,
+				recorder.Body,
+			)
+			continue
+		}
+
+		if test.expectedStatus != http.StatusCreated {
+			continue
+		}
+
+		var processed ProcessReceiptsResponseBody
+		err := json.Unmarshal(recorder.Body.Bytes(), &processed)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points := getTestReceiptPoints(t, handler, processed.ReceiptId)
+
+		if points != test.expectedPoints {
+			t.Errorf(
+				"%s: awarded %d points, expected %d",
+				test.name,
+				points,
+				test.expectedPoints,
+			)
+		}
+	}
+}
+
+func TestDetailedHealth(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	defer func(startTime time.Time) { processStartTime = startTime }(
+		processStartTime,
+	)
+	processStartTime = time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name    string
+		process []string
+	}{
+		{"empty", nil},
+		{"one receipt", []string{targetReceipt}},
+		{"two more receipts", []string{targetReceipt, cornerMarketReceipt}},
+	}
+	receipts := 0
+
+	for _, test := range tests {
+		for _, body := range test.process {
+			processTestReceipt(t, handler, body)
+			receipts++
+		}
+
+		recorder := serveTestRequest(
+			detailedHealthHandler(),
+			http.MethodGet,
+			"/health/detailed",
+			"",
+		)
+		var body DetailedHealthResponseBody
+		err := json.Unmarshal(recorder.Body.Bytes(), &body)
+
+		if err != nil || recorder.Code != http.StatusOK {
+			t.Errorf(
+				"%s: responded with %d: %s",
+				test.name,
+				recorder.Code,
+				recorder.Body,
+			)
+			continue
+		}
+
+		if body.Status != "ok" ||
+			body.Receipts != receipts ||
+			body.UptimeSeconds < 60 {
+			t.Errorf("%s: reported %+v", test.name, body)
+		}
+	}
+
+	// The liveness probe keeps its plain response
+	recorder := serveTestRequest(healthHandler(), http.MethodGet, "/health", "")
+
+	if recorder.Code != http.StatusOK ||
+		recorder.Body.String() != "go fetch !" {
+		t.Errorf("health responded with %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	source := NewXDB()
+	ctx := context.Background()
+	receiptIds := make(map[string]int64)
+
+	for _, expected := range []struct {
+		receipt string
+		points  int64
+	}{
+		{targetReceipt, targetReceiptPoints},
+		{cornerMarketReceipt, cornerMarketReceiptPoints},
+		{targetReceipt, targetReceiptPoints},
+	} {
+		receiptId, err := source.writeReceipt(
+			ctx,
+			unmarshalTestReceipt(t, expected.receipt),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiptIds[receiptId] = expected.points
+	}
+
+	var snapshot bytes.Buffer
+
+	if err := source.export(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	destination := NewXDB()
+	imported, err := destination.importRows(bytes.NewReader(snapshot.Bytes()))
+
+	if err != nil || imported != len(receiptIds) {
+		t.Fatalf("imported %d rows with error %v", imported, err)
+	}
+
+	for receiptId, expected := range receiptIds {
+		points, err := destination.getReceiptPoints(ctx, receiptId)
+
+		if err != nil || points != expected {
+			t.Errorf(
+				"%s: imported %d points with error %v, expected %d",
+				receiptId,
+				points,
+				err,
+				expected,
+			)
+		}
+	}
+
+	// A snapshot that can't be read leaves the store as it was
+	invalid := strings.NewReader(snapshot.String() + "{\"id\": \n")
+
+	if _, err := destination.importRows(invalid); err == nil {
+		t.Error("imported an invalid snapshot")
+	}
+
+	if count, _ := destination.count(); count != len(receiptIds) {
+		t.Errorf("kept %d receipts after an invalid import", count)
+	}
+}
+
+func TestSnapshotRequiresAdminToken(t *testing.T) {
+	db = NewXDB()
+
+	tests := []struct {
+		name           string
+		token          string
+		authorization  string
+		expectedStatus int
+	}{
+		{"no admin token configured", "", "Bearer secret", http.StatusNotFound},
+		{"missing token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer guess", http.StatusUnauthorized},
+		{"admin token", "secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		handler := requireAdminToken(test.token)(snapshotHandler())
+		request := httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil)
+		request.Header.Set("Authorization", test.authorization)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		}
+	}
+}
+
+// Runs the same operations against any Storage, so that every backend is held
+// to what xDB does. sqlite_test.go runs it against sqliteStore
+func testStorage(t *testing.T, newStore func(t *testing.T) Storage) {
+	store := newStore(t)
+	ctx := context.Background()
+	targetId, err := store.writeReceipt(
+		ctx,
+		unmarshalTestReceipt(t, targetReceipt),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cornerMarketId, existed, err := store.writeReceiptIdempotent(
+		ctx,
+		"corner-market",
+		unmarshalTestReceipt(t, cornerMarketReceipt),
+	)
+
+	if err != nil || existed {
+		t.Fatalf("wrote with existed %t and error %v", existed, err)
+	}
+
+	receiptId, existed, err := store.writeReceiptIdempotent(
+		ctx,
+		"corner-market",
+		unmarshalTestReceipt(t, cornerMarketReceipt),
+	)
+
+	if err != nil || !existed || receiptId != cornerMarketId {
+		t.Errorf(
+			"rewrote the idempotency key as %s with existed %t and error %v",
+			receiptId,
+			existed,
+			err,
+		)
+	}
+
+	expectedPoints := map[string]int64{
+		targetId:       targetReceiptPoints,
+		cornerMarketId: cornerMarketReceiptPoints,
+	}
+
+	for receiptId, expected := range expectedPoints {
+		points, err := store.getReceiptPoints(ctx, receiptId)
+
+		if err != nil || points != expected {
+			t.Errorf(
+				"%s: got %d points with error %v, expected %d",
+				receiptId,
+				points,
+				err,
+				expected,
+			)
+		}
+	}
+
+	allPoints, err := store.getReceiptsPoints(
+		ctx,
+		[]string{targetId, cornerMarketId, uuid.NewString()},
+	)
+
+	if err != nil || !maps.Equal(allPoints, expectedPoints) {
+		t.Errorf("got points %v with error %v", allPoints, err)
+	}
+
+	summaries, total, err := store.listReceipts(
+		ReceiptFilter{Retailer: "Target"},
+		10,
+		0,
+	)
+
+	if err != nil ||
+		total != 1 ||
+		len(summaries) != 1 ||
+		summaries[0].ReceiptId != targetId {
+		t.Errorf("listed %v of %d with error %v", summaries, total, err)
+	}
+
+	var snapshot bytes.Buffer
+
+	if err := store.export(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.deleteReceipt(targetId); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.getReceiptPoints(ctx, targetId)
+
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("got a deleted receipt with error %v", err)
+	}
+
+	if err := store.deleteReceipt(targetId); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted a deleted receipt with error %v", err)
+	}
+
+	if count, err := store.count(); err != nil || count != 1 {
+		t.Errorf("counted %d receipts with error %v", count, err)
+	}
+
+	imported := newStore(t)
+	count, err := imported.importRows(bytes.NewReader(snapshot.Bytes()))
+
+	if err != nil || count != len(expectedPoints) {
+		t.Fatalf("imported %d rows with error %v", count, err)
+	}
+
+	for receiptId, expected := range expectedPoints {
+		points, err := imported.getReceiptPoints(ctx, receiptId)
+
+		if err != nil || points != expected {
+			t.Errorf(
+				"%s: imported %d points with error %v, expected %d",
+				receiptId,
+				points,
+				err,
+				expected,
+			)
+		}
+	}
+}
+
+// Every operation taking a context gives up on a canceled one without
+// touching the store
+func testStorageCancellation(
+	t *testing.T,
+	newStore func(t *testing.T) Storage,
+) {
+	store := newStore(t)
+	receiptId, err := store.writeReceipt(
+		context.Background(),
+		unmarshalTestReceipt(t, targetReceipt),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := unmarshalTestReceipt(t, cornerMarketReceipt)
+
+	tests := []struct {
+		name      string
+		operation func() error
+	}{
+		{
+			"writeReceipt",
+			func() error {
+				_, err := store.writeReceipt(ctx, r)
+				return err
+			},
+		},
+		{
+			"writeReceiptIdempotent",
+			func() error {
+				_, _, err := store.writeReceiptIdempotent(ctx, "key", r)
+				return err
+			},
+		},
+		{
+			"getReceiptPoints",
+			func() error {
+				_, err := store.getReceiptPoints(ctx, receiptId)
+				return err
+			},
+		},
+		{
+			"getReceiptsPoints",
+			func() error {
+				_, err := store.getReceiptsPoints(ctx, []string{receiptId})
+				return err
+			},
+		},
+		{"Ping", func() error { return store.Ping(ctx) }},
+	}
+
+	for _, test := range tests {
+		if err := test.operation(); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: returned %v", test.name, err)
+		}
+	}
+
+	if count, err := store.count(); err != nil || count != 1 {
+		t.Errorf("counted %d receipts with error %v", count, err)
+	}
+}
+
+// Has another writer update the row just before each of the first conflicts
+// updates, the way a concurrent recompute would
+type conflictingStorage struct {
+	Storage
+	conflicts int
+}
+
+func (store *conflictingStorage) updateReceiptRow(row ReceiptRow) error {
+	if store.conflicts > 0 {
+		store.conflicts--
+		err := store.Storage.updateReceiptRow(row)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.Storage.updateReceiptRow(row)
+}
+
+// Updates made from a stale read of a row conflict rather than overwrite the
+// update made in between
+func testStorageVersioning(
+	t *testing.T,
+	newStore func(t *testing.T) Storage,
+) {
+	store := newStore(t)
+	receiptId, err := store.writeReceipt(
+		context.Background(),
+		unmarshalTestReceipt(t, cornerMarketReceipt),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := store.getReceiptRow(receiptId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := first
+	first.Points = 1
+	second.Points = 2
+
+	if err := store.updateReceiptRow(first); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.updateReceiptRow(second)
+
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("a stale update returned %v", err)
+	}
+
+	row, err := store.getReceiptRow(receiptId)
+
+	if err != nil || row.Points != 1 || row.Version != first.Version+1 {
+		t.Errorf("kept %d points at version %d", row.Points, row.Version)
+	}
+
+	tests := []struct {
+		conflicts int
+		expected  error
+	}{
+		{0, nil},
+		{maxUpdateAttempts - 1, nil},
+		{maxUpdateAttempts, ErrConflict},
+	}
+
+	for _, test := range tests {
+		conflicting := &conflictingStorage{store, test.conflicts}
+		row, err := store.getReceiptRow(receiptId)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = recomputeRow(conflicting, row, rules)
+
+		if !errors.Is(err, test.expected) {
+			t.Errorf(
+				"%d conflicts recomputed with error %v, expected %v",
+				test.conflicts,
+				err,
+				test.expected,
+			)
+		}
+	}
+
+	if err := store.deleteReceipt(receiptId); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.updateReceiptRow(row); !errors.Is(err, ErrConflict) {
+		t.Errorf("updating a deleted row returned %v", err)
+	}
+}
+
+func TestXDBStorage(t *testing.T) {
+	newStore := func(t *testing.T) Storage { return NewXDB() }
+	testStorage(t, newStore)
+	testStorageCancellation(t, newStore)
+	testStorageVersioning(t, newStore)
+}
+
+func TestSubresourceRoutingIsLenient(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptPath := "/receipts/" + processTestReceipt(t, handler, targetReceipt)
+
+	tests := []struct {
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			http.MethodPost,
+			"/receipts/process/",
+			targetReceipt,
+			http.StatusCreated,
+		},
+		{
+			http.MethodPost,
+			"/receipts/Process",
+			targetReceipt,
+			http.StatusCreated,
+		},
+		{
+			http.MethodPost,
+			"/receipts/PROCESS//",
+			targetReceipt,
+			http.StatusCreated,
+		},
+		{http.MethodGet, receiptPath + "/points/", "", http.StatusOK},
+		{http.MethodGet, receiptPath + "/Points", "", http.StatusOK},
+		{http.MethodGet, receiptPath + "/POINTS/Breakdown/", "", http.StatusOK},
+		// Receipt IDs stay case sensitive
+		{http.MethodGet, strings.ToUpper(receiptPath), "", http.StatusNotFound},
+		{http.MethodGet, "/receipts/foo/bar", "", http.StatusNotFound},
+		{http.MethodGet, receiptPath + "/pointz", "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(handler, test.method, test.path, test.body)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s %s responded with %d, expected %d",
+				test.method,
+				test.path,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		}
+	}
+}
+
+func TestUnmatchedSubresourcesAreNotFound(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptPath := "/receipts/" + processTestReceipt(t, handler, targetReceipt)
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{http.MethodGet, "/receipts/", http.StatusNotFound},
+		{http.MethodGet, "/receipts", http.StatusNotFound},
+		{http.MethodGet, "/receipts//points", http.StatusNotFound},
+		{http.MethodGet, "/receipts/x/y/z", http.StatusNotFound},
+		{http.MethodGet, "/receipts/a/b/c/d", http.StatusNotFound},
+		{
+			http.MethodGet,
+			receiptPath + "/points/breakdown/x",
+			http.StatusNotFound,
+		},
+		{http.MethodGet, receiptPath, http.StatusOK},
+		{http.MethodGet, receiptPath + "/points", http.StatusOK},
+		{http.MethodGet, receiptPath + "/points/breakdown", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(handler, test.method, test.path, "")
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s %s responded with %d, expected %d",
+				test.method,
+				test.path,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if test.expectedStatus == http.StatusNotFound &&
+			testErrorCode(t, recorder) != "NOT_FOUND" {
+			t.Errorf("%s responded with %s", test.path, recorder.Body)
+		}
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	recorder := serveTestRequest(
+		openAPIHandler(),
+		http.MethodGet,
+		"/openapi.json",
+		"",
+	)
+	contentType := recorder.Header().Get("Content-Type")
+
+	if recorder.Code != http.StatusOK || contentType != "application/json" {
+		t.Fatalf("responded with %d as %q", recorder.Code, contentType)
+	}
+
+	var spec struct {
+		OpenAPI    string                    `json:"openapi"`
+		Paths      map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any `json:"properties"`
+				OneOf      []struct {
+					Type    string `json:"type"`
+					Pattern string `json:"pattern"`
+				} `json:"oneOf"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(spec.OpenAPI, "3.0.") {
+		t.Errorf("describes OpenAPI %q", spec.OpenAPI)
+	}
+
+	tests := []struct {
+		path   string
+		method string
+	}{
+		{"/receipts/process", "post"},
+		{"/receipts/{id}/points", "get"},
+	}
+
+	for _, test := range tests {
+		if _, exists := spec.Paths[test.path][test.method]; !exists {
+			t.Errorf("%s %s is missing", test.method, test.path)
+		}
+	}
+
+	receiptDefinition := spec.Components.Schemas["Receipt"]
+
+	for _, field := range []string{
+		"retailer",
+		"purchaseDate",
+		"purchaseTime",
+		"items",
+		"total",
+	} {
+		if _, exists := receiptDefinition.Properties[field]; !exists {
+			t.Errorf("the receipt schema is missing %s", field)
+		}
+	}
+
+	// Quoted amounts have exactly two decimals
+	amountSchema := spec.Components.Schemas["Amount"]
+	quotedPattern := ""
+
+	for _, alternative := range amountSchema.OneOf {
+		if alternative.Type == "string" {
+			quotedPattern = alternative.Pattern
+		}
+	}
+
+	if quotedPattern != `^\d+\.\d{2}$` {
+		t.Errorf("the amount schema allows %+v", amountSchema.OneOf)
+	}
+}
+
+func TestProcessStream(t *testing.T) {
+	var compactTarget, compactCornerMarket bytes.Buffer
+
+	if err := json.Compact(&compactTarget, []byte(targetReceipt)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := json.Compact(&compactCornerMarket, []byte(cornerMarketReceipt))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		lines []string
+		// Whether each line is expected to be processed
+		expectedValid []bool
+	}{
+		{
+			"all valid",
+			[]string{compactTarget.String(), compactCornerMarket.String()},
+			[]bool{true, true},
+		},
+		{
+			"mixed",
+			[]string{
+				compactTarget.String(),
+				`{"retailer": "Target!"}`,
+				compactCornerMarket.String(),
+			},
+			[]bool{true, false, true},
+		},
+		{
+			// Nothing can be decoded after a line that isn't JSON
+			"malformed line",
+			[]string{compactTarget.String(), `{"retailer": `},
+			[]bool{true, false},
+		},
+		{"empty", nil, nil},
+	}
+
+	for _, test := range tests {
+		db = NewXDB()
+		recorder := serveTestRequest(
+			receiptsSubresourceHandler(),
+			http.MethodPost,
+			"/receipts/process/stream",
+			strings.Join(test.lines, "\n"),
+		)
+
+		if recorder.Code != http.StatusOK ||
+			recorder.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("%s: responded with %d", test.name, recorder.Code)
+			continue
+		}
+
+		decoder := json.NewDecoder(recorder.Body)
+		var results []BatchReceiptResult
+
+		for decoder.More() {
+			var result BatchReceiptResult
+
+			if err := decoder.Decode(&result); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+
+			results = append(results, result)
+		}
+
+		if len(results) != len(test.expectedValid) {
+			t.Errorf("%s: got %d result lines", test.name, len(results))
+			continue
+		}
+
+		for index, result := range results {
+			valid := result.ReceiptId != "" && result.Error == ""
+
+			if result.Index != index || valid != test.expectedValid[index] {
+				t.Errorf(
+					"%s: line %d resulted in %+v",
+					test.name,
+					index,
+					result,
+				)
+			}
+		}
+
+		expectedCount := 0
+
+		for _, valid := range test.expectedValid {
+			if valid {
+				expectedCount++
+			}
+		}
+
+		if count, _ := db.count(); count != expectedCount {
+			t.Errorf("%s: stored %d receipts", test.name, count)
+		}
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	defer func(tokens []string) { apiTokens = tokens }(apiTokens)
+	db = NewXDB()
+	receiptId := processTestReceipt(
+		t,
+		receiptsSubresourceHandler(),
+		targetReceipt,
+	)
+
+	tests := []struct {
+		name           string
+		tokens         []string
+		method         string
+		path           string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			"disabled by default",
+			nil,
+			http.MethodPost,
+			"/receipts/process",
+			"",
+			http.StatusCreated,
+		},
+		{
+			"valid token",
+			[]string{"first", "second"},
+			http.MethodPost,
+			"/receipts/process",
+			"Bearer second",
+			http.StatusCreated,
+		},
+		{
+			"invalid token",
+			[]string{"first", "second"},
+			http.MethodPost,
+			"/receipts/process",
+			"Bearer third",
+			http.StatusUnauthorized,
+		},
+		{
+			"not a bearer token",
+			[]string{"first"},
+			http.MethodPost,
+			"/receipts/process",
+			"first",
+			http.StatusUnauthorized,
+		},
+		{
+			"missing token",
+			[]string{"first"},
+			http.MethodPost,
+			"/receipts/process",
+			"",
+			http.StatusUnauthorized,
+		},
+		{
+			"missing token on a delete",
+			[]string{"first"},
+			http.MethodDelete,
+			"/receipts/" + receiptId,
+			"",
+			http.StatusUnauthorized,
+		},
+		{
+			"missing token on a read",
+			[]string{"first"},
+			http.MethodGet,
+			"/receipts/" + receiptId + "/points",
+			"",
+			http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		apiTokens = test.tokens
+		request := httptest.NewRequest(
+			test.method,
+			test.path,
+			strings.NewReader(targetReceipt),
+		)
+		request.Header.Set("Content-Type", "application/json")
+
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+
+		recorder := httptest.NewRecorder()
+		receiptsSubresourceHandler().ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		} else if recorder.Code == http.StatusUnauthorized &&
+			testErrorCode(t, recorder) != "UNAUTHORIZED" {
+			t.Errorf("%s: responded with %s", test.name, recorder.Body)
+		}
+	}
+}
+
+// Spans several batches of recomputeAllPoints, with points that were
+// computed under the rules before the change
+func TestRecomputeAllPoints(t *testing.T) {
+	defer func(original receipt.RuleConfig) { rules = original }(rules)
+	db = NewXDB()
+	ctx := context.Background()
+	cornerMarketIds := make([]string, 0, recomputeBatchSize+1)
+
+	for len(cornerMarketIds) < cap(cornerMarketIds) {
+		receiptId, err := db.writeReceipt(
+			ctx,
+			unmarshalTestReceipt(t, cornerMarketReceipt),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cornerMarketIds = append(cornerMarketIds, receiptId)
+	}
+
+	targetId, err := db.writeReceipt(
+		ctx,
+		unmarshalTestReceipt(t, targetReceipt),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, receiptId := range append(cornerMarketIds, targetId) {
+		if _, err := db.getReceiptPoints(ctx, receiptId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules.RoundDollarPoints = 0
+	stalePoints, _ := db.getReceiptPoints(ctx, cornerMarketIds[0])
+
+	if stalePoints != cornerMarketReceiptPoints {
+		t.Fatalf("points changed to %d before the recompute", stalePoints)
+	}
+
+	recorder := serveTestRequest(
+		recomputeHandler(),
+		http.MethodPost,
+		"/admin/recompute",
+		"",
+	)
+	var body RecomputePointsResponseBody
+	err = json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	if err != nil ||
+		recorder.Code != http.StatusOK ||
+		body.Recomputed != len(cornerMarketIds)+1 {
+		t.Fatalf("responded with %d: %s", recorder.Code, recorder.Body)
+	}
+
+	expectedPoints := map[string]int64{targetId: targetReceiptPoints}
+
+	for _, receiptId := range cornerMarketIds {
+		expectedPoints[receiptId] = cornerMarketReceiptPoints - 50
+	}
+
+	for receiptId, expected := range expectedPoints {
+		points, err := db.getReceiptPoints(ctx, receiptId)
+
+		if err != nil || points != expected {
+			t.Fatalf(
+				"%s: recomputed %d points with error %v, expected %d",
+				receiptId,
+				points,
+				err,
+				expected,
+			)
+		}
+	}
+
+	recorder = serveTestRequest(
+		recomputeHandler(),
+		http.MethodGet,
+		"/admin/recompute",
+		"",
+	)
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("a GET responded with %d", recorder.Code)
+	}
+}
+
+func TestClassifyTier(t *testing.T) {
+	cfg := receipt.DefaultRuleConfig()
+	cfg.SilverTierPoints = 100
+	cfg.GoldTierPoints = 250
+
+	tests := []struct {
+		points   int64
+		expected string
+	}{
+		{0, "bronze"},
+		{99, "bronze"},
+		{100, "silver"},
+		{249, "silver"},
+		{250, "gold"},
+		{10000, "gold"},
+	}
+
+	for _, test := range tests {
+		if tier := classifyTier(test.points, cfg); tier != test.expected {
+			t.Errorf(
+				"%d points classified as %s, expected %s",
+				test.points,
+				tier,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestPointsTier(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	pointsPath := "/receipts/" +
+		processTestReceipt(t, handler, cornerMarketReceipt) + "/points"
+
+	tests := []struct {
+		query          string
+		expectedStatus int
+		// Empty when the tier is expected to be left out
+		expectedTier string
+	}{
+		{"", http.StatusOK, ""},
+		{"?tier=false", http.StatusOK, ""},
+		{"?tier=true", http.StatusOK, "silver"},
+		{"?tier=maybe", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodGet,
+			pointsPath+test.query,
+			"",
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf("%q: responded with %d", test.query, recorder.Code)
+			continue
+		}
+
+		if test.expectedStatus != http.StatusOK {
+			continue
+		}
+
+		var body map[string]any
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		tier, exists := body["tier"]
+
+		if exists != (test.expectedTier != "") ||
+			(exists && tier != test.expectedTier) {
+			t.Errorf("%q: responded with %s", test.query, recorder.Body)
+		}
+	}
+}
+
+func TestLoadMaxReceiptItems(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+		valid    bool
+	}{
+		{"", defaultMaxReceiptItems, true},
+		{"5", 5, true},
+		{"many", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("MAX_RECEIPT_ITEMS", test.value)
+		config, err := loadValidationConfig()
+
+		if (err == nil) != test.valid ||
+			(test.valid && config.MaxItems != test.expected) {
+			t.Errorf(
+				"%q loaded %d items with error %v, expected %d",
+				test.value,
+				config.MaxItems,
+				err,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, date = v, c, d }(
+		version,
+		commit,
+		date,
+	)
+
+	tests := []struct {
+		name  string
+		build VersionResponseBody
+	}{
+		{"without ldflags", VersionResponseBody{version, commit, date}},
+		{
+			"with ldflags",
+			VersionResponseBody{"1.2.0", "2248af4", "2026-10-14T12:00:00Z"},
+		},
+	}
+
+	if tests[0].build != (VersionResponseBody{"dev", "unknown", "unknown"}) {
+		t.Errorf("defaults to %+v", tests[0].build)
+	}
+
+	for _, test := range tests {
+		version = test.build.Version
+		commit = test.build.Commit
+		date = test.build.Date
+		recorder := serveTestRequest(
+			versionHandler(),
+			http.MethodGet,
+			"/version",
+			"",
+		)
+		var body map[string]string
+		err := json.Unmarshal(recorder.Body.Bytes(), &body)
+
+		if err != nil || recorder.Code != http.StatusOK {
+			t.Errorf("%s: responded with %d", test.name, recorder.Code)
+			continue
+		}
+
+		expected := map[string]string{
+			"version": test.build.Version,
+			"commit":  test.build.Commit,
+			"date":    test.build.Date,
+		}
+
+		if !maps.Equal(body, expected) {
+			t.Errorf("%s: responded with %v", test.name, body)
+		}
+	}
+}
+
+// A store that's up but whose backend no longer responds
+type unavailableStorage struct {
+	Storage
+}
+
+func (store unavailableStorage) Ping(ctx context.Context) error {
+	return errors.New("database is locked")
+}
+
+func TestHealth(t *testing.T) {
+	defer func() {
+		db = NewXDB()
+		shuttingDown.Store(false)
+	}()
+
+	tests := []struct {
+		name           string
+		store          Storage
+		shuttingDown   bool
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"healthy", NewXDB(), false, http.StatusOK, ""},
+		{
+			"shutting down",
+			NewXDB(),
+			true,
+			http.StatusServiceUnavailable,
+			"SHUTTING_DOWN",
+		},
+		{
+			"backend down",
+			unavailableStorage{NewXDB()},
+			false,
+			http.StatusServiceUnavailable,
+			"STORAGE_UNAVAILABLE",
+		},
+	}
+
+	for _, test := range tests {
+		db = test.store
+		shuttingDown.Store(test.shuttingDown)
+		recorder := serveTestRequest(
+			healthHandler(),
+			http.MethodGet,
+			"/health",
+			"",
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf("%s: responded with %d", test.name, recorder.Code)
+		} else if test.expectedCode != "" &&
+			testErrorCode(t, recorder) != test.expectedCode {
+			t.Errorf("%s: responded with %s", test.name, recorder.Body)
+		}
+	}
+}
+
+func TestProcessLocation(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"created", targetReceipt, http.StatusCreated},
+		{"replayed", targetReceipt, http.StatusOK},
+		{"invalid", `{"retailer": "Target!"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(
+			http.MethodPost,
+			"/receipts/process",
+			strings.NewReader(test.body),
+		)
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Idempotency-Key", "location")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		location := recorder.Header().Get("Location")
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf("%s: responded with %d", test.name, recorder.Code)
+			continue
+		}
+
+		if test.expectedStatus == http.StatusBadRequest {
+			if location != "" {
+				t.Errorf("%s: located at %q", test.name, location)
+			}
+
+			continue
+		}
+
+		var processed ProcessReceiptsResponseBody
+		err := json.Unmarshal(recorder.Body.Bytes(), &processed)
+
+		if err != nil || location != "/receipts/"+processed.ReceiptId {
+			t.Errorf(
+				"%s: located at %q with body %s",
+				test.name,
+				location,
+				recorder.Body,
+			)
+			continue
+		}
+
+		recorder = serveTestRequest(handler, http.MethodGet, location, "")
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf(
+				"%s: following it responded with %d",
+				test.name,
+				recorder.Code,
+			)
+		}
+	}
+}
+
+func TestListReceiptsWithMinPoints(t *testing.T) {
+	db = NewXDB(WithIDGenerator(sequentialTestIDs()))
+	handler := receiptsSubresourceHandler()
+	var targetIds, cornerMarketIds []string
+
+	for write := 0; write < 2; write++ {
+		targetIds = append(
+			targetIds,
+			processTestReceipt(t, handler, targetReceipt),
+		)
+		cornerMarketIds = append(
+			cornerMarketIds,
+			processTestReceipt(t, handler, cornerMarketReceipt),
+		)
+	}
+
+	tests := []struct {
+		query          string
+		expectedStatus int
+		expectedIds    []string
+		expectedTotal  int
+	}{
+		{
+			"?minPoints=28",
+			http.StatusOK,
+			[]string{
+				targetIds[0],
+				cornerMarketIds[0],
+				targetIds[1],
+				cornerMarketIds[1],
+			},
+			4,
+		},
+		{"?minPoints=29", http.StatusOK, cornerMarketIds, 2},
+		{"?minPoints=109", http.StatusOK, cornerMarketIds, 2},
+		{"?minPoints=110", http.StatusOK, []string{}, 0},
+		{"?minPoints=100&limit=1", http.StatusOK, cornerMarketIds[:1], 2},
+		{"?minPoints=100&offset=1", http.StatusOK, cornerMarketIds[1:], 2},
+		{"?minPoints=20&retailer=Target", http.StatusOK, targetIds, 2},
+		{"?minPoints=100&retailer=Target", http.StatusOK, []string{}, 0},
+		{"?minPoints=-1", http.StatusBadRequest, nil, 0},
+		{"?minPoints=lots", http.StatusBadRequest, nil, 0},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			receiptsHandler(),
+			http.MethodGet,
+			"/receipts"+test.query,
+			"",
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf("%q responded with %d", test.query, recorder.Code)
+			continue
+		}
+
+		if recorder.Code != http.StatusOK {
+			continue
+		}
+
+		var body ListReceiptsResponseBody
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		listedIds := make([]string, 0, len(body.Receipts))
+
+		for _, summary := range body.Receipts {
+			listedIds = append(listedIds, summary.ReceiptId)
+		}
+
+		if !slices.Equal(listedIds, test.expectedIds) ||
+			body.Total != test.expectedTotal {
+			t.Errorf(
+				"%q listed %q of %d receipts, expected %q of %d",
+				test.query,
+				listedIds,
+				body.Total,
+				test.expectedIds,
+				test.expectedTotal,
+			)
+		}
+	}
+}
+
+func TestProcessContentType(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptPath := "/receipts/" + processTestReceipt(t, handler, targetReceipt)
+
+	tests := []struct {
+		method         string
+		path           string
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{
+			http.MethodPost,
+			"/receipts/process",
+			"application/json",
+			targetReceipt,
+			http.StatusCreated,
+		},
+		{
+			http.MethodPost,
+			"/receipts/process",
+			"application/json; charset=utf-8",
+			targetReceipt,
+			http.StatusCreated,
+		},
+		{
+			http.MethodPost,
+			"/receipts/process",
+			"Application/JSON",
+			targetReceipt,
+			http.StatusCreated,
+		},
+		{
+			http.MethodPost,
+			"/receipts/process",
+			"",
+			targetReceipt,
+			http.StatusUnsupportedMediaType,
+		},
+		{
+			http.MethodPost,
+			"/receipts/process",
+			"text/plain",
+			targetReceipt,
+			http.StatusUnsupportedMediaType,
+		},
+		{
+			http.MethodPost,
+			"/receipts/process",
+			"application/json; charset",
+			targetReceipt,
+			http.StatusUnsupportedMediaType,
+		},
+		{
+			http.MethodPatch,
+			receiptPath,
+			"application/json",
+			`{"retailer": "Walmart"}`,
+			http.StatusOK,
+		},
+		// Patches can't be form encoded
+		{
+			http.MethodPatch,
+			receiptPath,
+			"application/x-www-form-urlencoded",
+			"retailer=Walmart",
+			http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(
+			test.method,
+			test.path,
+			strings.NewReader(test.body),
+		)
+
+		if test.contentType != "" {
+			request.Header.Set("Content-Type", test.contentType)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s as %q responded with %d, expected %d",
+				test.method,
+				test.contentType,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		} else if recorder.Code == http.StatusUnsupportedMediaType &&
+			testErrorCode(t, recorder) != "UNSUPPORTED_MEDIA_TYPE" {
+			t.Errorf("%q responded with %s", test.contentType, recorder.Body)
+		}
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	db = NewXDB(WithIDGenerator(sequentialTestIDs()))
+	handler := receiptsSubresourceHandler()
+	var targetIds, cornerMarketIds []string
+
+	for write := 0; write < 3; write++ {
+		targetIds = append(
+			targetIds,
+			processTestReceipt(t, handler, targetReceipt),
+		)
+		cornerMarketIds = append(
+			cornerMarketIds,
+			processTestReceipt(t, handler, cornerMarketReceipt),
+		)
+	}
+
+	// Ties are broken by creation date, then by ID
+	ranked := append(slices.Clone(cornerMarketIds), targetIds...)
+
+	tests := []struct {
+		query          string
+		expectedStatus int
+		expectedIds    []string
+	}{
+		{"", http.StatusOK, ranked},
+		{"?limit=1", http.StatusOK, ranked[:1]},
+		{"?limit=4", http.StatusOK, ranked[:4]},
+		{"?limit=0", http.StatusOK, []string{}},
+		{"?limit=100000", http.StatusOK, ranked},
+		{"?limit=-1", http.StatusBadRequest, nil},
+		{"?limit=ten", http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodGet,
+			"/receipts/leaderboard"+test.query,
+			"",
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf("%q responded with %d", test.query, recorder.Code)
+			continue
+		}
+
+		if recorder.Code != http.StatusOK {
+			continue
+		}
+
+		var body LeaderboardResponseBody
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		rankedIds := make([]string, 0, len(body.Receipts))
+
+		for _, entry := range body.Receipts {
+			rankedIds = append(rankedIds, entry.ReceiptId)
+			expected := LeaderboardEntry{
+				entry.ReceiptId,
+				"Target",
+				targetReceiptPoints,
+			}
+
+			if slices.Contains(cornerMarketIds, entry.ReceiptId) {
+				expected.Retailer = "M&M Corner Market"
+				expected.Points = cornerMarketReceiptPoints
+			}
+
+			if entry != expected {
+				t.Errorf("%q ranked %+v", test.query, entry)
+			}
+		}
+
+		if !slices.Equal(rankedIds, test.expectedIds) {
+			t.Errorf(
+				"%q ranked %q, expected %q",
+				test.query,
+				rankedIds,
+				test.expectedIds,
+			)
+		}
+	}
+}
+
+// The bounded heap of topReceipts against a full sort
+func TestTopReceiptsMatchesSort(t *testing.T) {
+	store := NewXDB()
+	ctx := context.Background()
+
+	for write := 0; write < 150; write++ {
+		r := unmarshalTestReceipt(t, targetReceipt)
+		r.Total = receipt.Amount(write % 7 * 25)
+
+		if _, err := store.writeReceipt(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := store.topReceipts(150)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sorted := slices.Clone(rows)
+	slices.SortFunc(sorted, func(a ReceiptRow, b ReceiptRow) int {
+		if rankedBefore(a, b) {
+			return -1
+		} else if rankedBefore(b, a) {
+			return 1
+		}
+
+		return 0
+	})
+
+	for _, n := range []int{0, 1, 10, 149, 150, 200} {
+		top, err := store.topReceipts(n)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := sorted[:min(n, len(sorted))]
+
+		if !slices.EqualFunc(top, expected, func(a, b ReceiptRow) bool {
+			return a.ReceiptId == b.ReceiptId
+		}) {
+			t.Errorf("the top %d receipts are out of order", n)
+		}
+	}
+}
+
+// Malformed IDs get a 400, while well-formed IDs that don't name a receipt
+// get a 404
+func TestMalformedReceiptIDs(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	missingId := "00000000-0000-0000-0000-000000000000"
+
+	tests := []struct {
+		receiptId   string
+		subresource string
+		wellFormed  bool
+	}{
+		{"not.an.id", "/points", false},
+		{"not.an.id", "/points/breakdown", false},
+		{"not.an.id", "/points/explain", false},
+		{"..", "/points", false},
+		{strings.Repeat("a", 129), "/points", false},
+		{missingId[1:], "/points", true},
+		{"receipt-1", "/points", true},
+		{"receipt_1", "/points", true},
+		{missingId, "/points", true},
+		{missingId, "", true},
+		{missingId, "/points/breakdown", true},
+		{missingId, "/points/explain", true},
+	}
+
+	for _, test := range tests {
+		path := "/receipts/" + test.receiptId + test.subresource
+		recorder := serveTestRequest(handler, http.MethodGet, path, "")
+		expectedStatus := http.StatusBadRequest
+		expectedCode := "INVALID_RECEIPT_ID"
+
+		if test.wellFormed {
+			expectedStatus = http.StatusNotFound
+			expectedCode = "RECEIPT_NOT_FOUND"
+		}
+
+		if recorder.Code != expectedStatus ||
+			testErrorCode(t, recorder) != expectedCode {
+			t.Errorf(
+				"%s responded with %d: %s",
+				path,
+				recorder.Code,
+				recorder.Body,
+			)
+		}
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	db = NewXDB()
+	stop := make(chan struct{})
+	defer close(stop)
+	mux := defineResources(stop)
+	receiptId := processTestReceipt(t, mux, targetReceipt)
+	processTestReceipt(t, mux, cornerMarketReceipt)
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		compressed     bool
+	}{
+		{"/receipts", "gzip", true},
+		{"/receipts", "gzip, deflate, br", true},
+		{"/receipts", "", false},
+		{"/receipts", "identity", false},
+		// Too small to be worth compressing
+		{"/receipts/" + receiptId + "/points", "gzip", false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, test.path, nil)
+
+		if test.acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		encoding := recorder.Header().Get("Content-Encoding")
+
+		if recorder.Code != http.StatusOK ||
+			(encoding == "gzip") != test.compressed {
+			t.Errorf(
+				"%s accepting %q responded with %d encoded as %q",
+				test.path,
+				test.acceptEncoding,
+				recorder.Code,
+				encoding,
+			)
+			continue
+		}
+
+		contentType := recorder.Header().Get("Content-Type")
+
+		if !strings.HasPrefix(contentType, "application/json") {
+			t.Errorf("%s responded as %q", test.path, contentType)
+		}
+
+		var body io.Reader = recorder.Body
+
+		if test.compressed {
+			reader, err := gzip.NewReader(recorder.Body)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body = reader
+		}
+
+		var decoded map[string]any
+
+		if err := json.NewDecoder(body).Decode(&decoded); err != nil {
+			t.Errorf("%s decoded with error %v", test.path, err)
+		}
+	}
+}
+
+func TestRotatingWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+	writer, err := newRotatingWriter(path, 10, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line string
+		// The contents of path, path.1 and path.2 after writing the line,
+		// empty for files that don't exist
+		expected []string
+	}{
+		{"line1\n", []string{"line1\n", "", ""}},
+		{"line2\n", []string{"line2\n", "line1\n", ""}},
+		{"line3\n", []string{"line3\n", "line2\n", "line1\n"}},
+		// The oldest file is dropped
+		{"line4\n", []string{"line4\n", "line3\n", "line2\n"}},
+		{"4\n", []string{"line4\n4\n", "line3\n", "line2\n"}},
+		// Too large for any file, so it gets one to itself
+		{
+			"a line longer than the limit\n",
+			[]string{"a line longer than the limit\n", "line4\n4\n", "line3\n"},
+		},
+	}
+
+	for _, test := range tests {
+		if _, err := writer.Write([]byte(test.line)); err != nil {
+			t.Fatal(err)
+		}
+
+		for index, expected := range test.expected {
+			name := path
+
+			if index > 0 {
+				name = fmt.Sprintf("%s.%d", path, index)
+			}
+
+			contents, err := os.ReadFile(name)
+
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+
+			if string(contents) != expected {
+				t.Errorf(
+					"after %q, %s holds %q, expected %q",
+					test.line,
+					filepath.Base(name),
+					contents,
+					expected,
+				)
+			}
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 old files: %v", err)
+	}
+
+	// Reopening picks up the size of the existing file
+	writer.Close()
+	writer, err = newRotatingWriter(path, 30, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer writer.Close()
+
+	if _, err := writer.Write([]byte("line5\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if contents, _ := os.ReadFile(path); string(contents) != "line5\n" {
+		t.Errorf("appended to a full file: %q", contents)
+	}
+}
+
+// The explanation is of the points the receipt was awarded, even once the
+// rules have changed
+func TestGetPointsExplanation(t *testing.T) {
+	defer func(original receipt.RuleConfig) { rules = original }(rules)
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+	r := unmarshalTestReceipt(t, targetReceipt)
+	expected := r.ExplainPoints(
+		r.ComputePointsBreakdown(rules),
+		r.ComputeItemPoints(rules),
+	)
+	getTestReceiptPoints(t, handler, receiptId)
+	rules.ItemGroupPoints = 10
+	rules.DescriptionPriceMultiplier = 1
+	recorder := serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/"+receiptId+"/points/explain",
+		"",
+	)
+
+	if recorder.Code != http.StatusOK ||
+		recorder.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("responded with %d: %s", recorder.Code, recorder.Body)
+	}
+
+	if recorder.Body.String() != expected {
+		t.Errorf("explained as\n%s\nexpected\n%s", recorder.Body, expected)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	ctx := context.Background()
+	prefixed := 0
+
+	tests := []struct {
+		name      string
+		generator func() string
+		expected  []string
+	}{
+		{
+			"sequential",
+			sequentialTestIDs(),
+			[]string{
+				"00000000-0000-0000-0000-000000000001",
+				"00000000-0000-0000-0000-000000000002",
+				"00000000-0000-0000-0000-000000000003",
+			},
+		},
+		{
+			"prefixed",
+			func() string {
+				prefixed++
+				return fmt.Sprintf("receipt-%d", prefixed)
+			},
+			[]string{"receipt-1", "receipt-2", "receipt-3"},
+		},
+	}
+
+	for _, test := range tests {
+		store := NewXDB(WithIDGenerator(test.generator))
+		var receiptIds []string
+
+		for write := 0; write < 2; write++ {
+			receiptId, err := store.writeReceipt(
+				ctx,
+				unmarshalTestReceipt(t, targetReceipt),
+			)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiptIds = append(receiptIds, receiptId)
+		}
+
+		receiptId, _, err := store.writeReceiptIdempotent(
+			ctx,
+			"key",
+			unmarshalTestReceipt(t, targetReceipt),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiptIds = append(receiptIds, receiptId)
+
+		if !slices.Equal(receiptIds, test.expected) {
+			t.Errorf("%s: wrote %q", test.name, receiptIds)
+		}
+
+		for _, receiptId := range receiptIds {
+			if _, err := store.getReceiptRow(receiptId); err != nil {
+				t.Errorf("%s: %s is missing", test.name, receiptId)
+			}
+		}
+	}
+
+	receiptId, err := NewXDB().writeReceipt(
+		ctx,
+		unmarshalTestReceipt(t, targetReceipt),
+	)
+
+	if err != nil || !isValidReceiptID(receiptId) {
+		t.Errorf("generated %q by default with error %v", receiptId, err)
+	}
+
+	// IDs that aren't UUIDs can still be looked up over HTTP
+	db = NewXDB(WithIDGenerator(func() string { return "receipt_1" }))
+	handler := receiptsSubresourceHandler()
+	receiptId = processTestReceipt(t, handler, targetReceipt)
+
+	if receiptId != "receipt_1" {
+		t.Fatalf("processed as %q", receiptId)
+	}
+
+	points := getTestReceiptPoints(t, handler, receiptId)
+
+	if points != targetReceiptPoints {
+		t.Errorf("%s was awarded %d points", receiptId, points)
+	}
+
+	for _, subresource := range []string{"/points/breakdown", "/status", ""} {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodGet,
+			"/receipts/"+receiptId+subresource,
+			"",
+		)
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s responded with %d", subresource, recorder.Code)
+		}
+	}
+}
+
+func TestReceiptStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		receipts []string
+		expected ReceiptStats
+	}{
+		{"empty", nil, ReceiptStats{ReceiptsByRetailer: map[string]int{}}},
+		{
+			"one receipt",
+			[]string{cornerMarketReceipt},
+			ReceiptStats{
+				Receipts:           1,
+				TotalPoints:        cornerMarketReceiptPoints,
+				AveragePoints:      cornerMarketReceiptPoints,
+				MinPoints:          cornerMarketReceiptPoints,
+				MaxPoints:          cornerMarketReceiptPoints,
+				ReceiptsByRetailer: map[string]int{"M&M Corner Market": 1},
+			},
+		},
+		{
+			"several retailers",
+			[]string{targetReceipt, cornerMarketReceipt, targetReceipt},
+			ReceiptStats{
+				Receipts:      3,
+				TotalPoints:   165,
+				AveragePoints: 55,
+				MinPoints:     targetReceiptPoints,
+				MaxPoints:     cornerMarketReceiptPoints,
+				ReceiptsByRetailer: map[string]int{
+					"Target":            2,
+					"M&M Corner Market": 1,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		db = NewXDB()
+		handler := receiptsSubresourceHandler()
+
+		for _, body := range test.receipts {
+			processTestReceipt(t, handler, body)
+		}
+
+		recorder := serveTestRequest(
+			handler,
+			http.MethodGet,
+			"/receipts/stats",
+			"",
+		)
+		var stats ReceiptStats
+		err := json.Unmarshal(recorder.Body.Bytes(), &stats)
+
+		if err != nil || recorder.Code != http.StatusOK {
+			t.Errorf("%s: responded with %d", test.name, recorder.Code)
+			continue
+		}
+
+		expected := test.expected
+
+		if stats.Receipts != expected.Receipts ||
+			stats.TotalPoints != expected.TotalPoints ||
+			stats.AveragePoints != expected.AveragePoints ||
+			stats.MinPoints != expected.MinPoints ||
+			stats.MaxPoints != expected.MaxPoints ||
+			stats.ReceiptsByRetailer == nil ||
+			!maps.Equal(stats.ReceiptsByRetailer, expected.ReceiptsByRetailer) {
+			t.Errorf("%s: responded with %s", test.name, recorder.Body)
+		}
+	}
+}
+
+// Log output shared with the goroutines of a test server
+type lockedBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buffer.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buffer.Reset()
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var logs lockedBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		var row *ReceiptRow
+		w.Write([]byte(row.ReceiptId))
+	})
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		panic("after the response started")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewServer(recoverPanic(withRequestID(mux)))
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		// 0 when the connection is expected to be cut short
+		expectedStatus int
+	}{
+		{"/panic", http.StatusInternalServerError},
+		{"/ok", http.StatusOK},
+		{"/partial", 0},
+		{"/panic", http.StatusInternalServerError},
+		{"/ok", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		logs.Reset()
+		request, err := http.NewRequest(
+			http.MethodGet,
+			server.URL+test.path,
+			nil,
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request.Header.Set(requestIDHeader, "panic-test")
+		response, err := http.DefaultClient.Do(request)
+
+		var body []byte
+
+		if err == nil {
+			body, err = io.ReadAll(response.Body)
+			response.Body.Close()
+		}
+
+		if test.expectedStatus == 0 {
+			if err == nil {
+				t.Errorf("%s wasn't cut short", test.path)
+			}
+
+			continue
+		}
+
+		if err != nil || response.StatusCode != test.expectedStatus {
+			t.Errorf("%s responded with %v: %v", test.path, response, err)
+			continue
+		}
+
+		panicked := strings.Contains(
+			logs.String(),
+			"Recovered from panic serving request panic-test",
+		)
+
+		if panicked != (test.expectedStatus != http.StatusOK) {
+			t.Errorf("%s logged %q", test.path, logs.String())
+		}
+
+		if panicked && !bytes.Contains(body, []byte(`"INTERNAL_ERROR"`)) {
+			t.Errorf("%s responded with %s", test.path, body)
+		}
+	}
+}
+
+func TestPointsBatch(t *testing.T) {
+	defer func(limit int64) { maxPointsBatchIds = limit }(maxPointsBatchIds)
+	maxPointsBatchIds = 3
+	db = NewXDB(WithIDGenerator(sequentialTestIDs()))
+	handler := receiptsSubresourceHandler()
+	targetId := processTestReceipt(t, handler, targetReceipt)
+	cornerMarketId := processTestReceipt(t, handler, cornerMarketReceipt)
+	missingId := uuid.NewString()
+
+	tests := []struct {
+		name           string
+		ids            []string
+		expectedStatus int
+		// The points expected for each ID, or -1 when it isn't found
+		expectedPoints map[string]int64
+	}{
+		{
+			"all found",
+			[]string{targetId, cornerMarketId},
+			http.StatusOK,
+			map[string]int64{targetId: 28, cornerMarketId: 109},
+		},
+		{
+			"some missing",
+			[]string{targetId, missingId, "not.an.id"},
+			http.StatusMultiStatus,
+			map[string]int64{targetId: 28, missingId: -1, "not.an.id": -1},
+		},
+		{"empty", []string{}, http.StatusOK, map[string]int64{}},
+		{
+			"over the cap",
+			[]string{targetId, cornerMarketId, missingId, targetId},
+			http.StatusBadRequest,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		body, err := json.Marshal(PointsBatchRequestBody{ReceiptIds: test.ids})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := serveTestRequest(
+			handler,
+			http.MethodPost,
+			"/receipts/points/batch",
+			string(body),
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.name,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if test.expectedPoints == nil {
+			if code := testErrorCode(t, recorder); code != "TOO_MANY_IDS" {
+				t.Errorf("%s: responded with code %q", test.name, code)
+			}
+
+			continue
+		}
+
+		var results map[string]PointsBatchResult
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != len(test.expectedPoints) {
+			t.Errorf("%s: %d results", test.name, len(results))
+		}
+
+		for id, expected := range test.expectedPoints {
+			result := results[id]
+			found := result.Points != nil && result.Error == ""
+			missing := result.Points == nil && result.Error != ""
+
+			if expected < 0 && !missing ||
+				expected >= 0 && (!found || *result.Points != expected) {
+				t.Errorf("%s: %s resulted in %+v", test.name, id, result)
+			}
+		}
+	}
+
+	recorder := serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/points/batch",
+		"",
+	)
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET responded with %d", recorder.Code)
+	}
+}
+
+func TestUI(t *testing.T) {
+	db = NewXDB()
+	stop := make(chan struct{})
+	defer close(stop)
+	mux := defineResources(stop)
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+		expectedType   string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "text/html; charset=utf-8"},
+		{http.MethodHead, "/", http.StatusOK, "text/html; charset=utf-8"},
+		{
+			http.MethodPost,
+			"/",
+			http.StatusMethodNotAllowed,
+			"application/json",
+		},
+		{
+			http.MethodGet,
+			"/index.html",
+			http.StatusNotFound,
+			"application/json",
+		},
+		{http.MethodGet, "/health", http.StatusOK, "text/plain; charset=utf-8"},
+		{http.MethodGet, "/receipts", http.StatusOK, "application/json"},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(mux, test.method, test.path, "")
+		contentType := recorder.Header().Get("Content-Type")
+
+		if recorder.Code != test.expectedStatus ||
+			contentType != test.expectedType {
+			t.Errorf(
+				"%s %s: responded with %d and %q",
+				test.method,
+				test.path,
+				recorder.Code,
+				contentType,
+			)
+		}
+	}
+
+	recorder := serveTestRequest(mux, http.MethodGet, "/", "")
+	body := recorder.Body.String()
+
+	if !strings.Contains(body, "<title>go-fetch</title>") ||
+		!strings.Contains(body, `<form id="receipt-form">`) {
+		t.Errorf("served %q", body)
+	}
+}
+
+func TestPointsETag(t *testing.T) {
+	defer func(original receipt.RuleConfig) { rules = original }(rules)
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	cornerMarketId := processTestReceipt(t, handler, cornerMarketReceipt)
+	targetId := processTestReceipt(t, handler, targetReceipt)
+	pointsPath := "/receipts/" + cornerMarketId + "/points"
+
+	// Responds to a GET of the path with the given If-None-Match header
+	getPoints := func(
+		path string,
+		ifNoneMatch string,
+	) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	etag := getPoints(pointsPath, "").Header().Get("ETag")
+
+	if etag == "" || getPoints(pointsPath, "").Header().Get("ETag") != etag {
+		t.Fatalf("responded with unstable ETag %q", etag)
+	}
+
+	otherEtags := []string{
+		getPoints("/receipts/"+targetId+"/points", "").Header().Get("ETag"),
+		getPoints(pointsPath+"?tier=true", "").Header().Get("ETag"),
+	}
+
+	if slices.Contains(otherEtags, etag) {
+		t.Errorf("responded with ETag %q for other responses too", etag)
+	}
+
+	tests := []struct {
+		ifNoneMatch    string
+		expectedStatus int
+	}{
+		{etag, http.StatusNotModified},
+		{"W/" + etag, http.StatusNotModified},
+		{`"other", ` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+		{otherEtags[0], http.StatusOK},
+	}
+
+	for _, test := range tests {
+		recorder := getPoints(pointsPath, test.ifNoneMatch)
+
+		if recorder.Code != test.expectedStatus ||
+			recorder.Header().Get("ETag") != etag {
+			t.Errorf(
+				"If-None-Match %s: responded with %d and ETag %q",
+				test.ifNoneMatch,
+				recorder.Code,
+				recorder.Header().Get("ETag"),
+			)
+		}
+
+		if recorder.Code == http.StatusNotModified && recorder.Body.Len() > 0 {
+			t.Errorf(
+				"If-None-Match %s: responded with %s",
+				test.ifNoneMatch,
+				recorder.Body,
+			)
+		}
+	}
+
+	// Recomputing the points with a round dollar total worth nothing changes
+	// those of the corner market receipt, and so its ETag
+	rules.RoundDollarPoints = 0
+	serveTestRequest(
+		recomputeHandler(),
+		http.MethodPost,
+		"/admin/recompute",
+		"",
+	)
+	recorder := getPoints(pointsPath, etag)
+
+	if recorder.Code != http.StatusOK ||
+		recorder.Header().Get("ETag") == etag {
+		t.Errorf(
+			"after the recompute, responded with %d and ETag %q",
+			recorder.Code,
+			recorder.Header().Get("ETag"),
+		)
+	}
+}
+
+func TestProcessVerbose(t *testing.T) {
+	db = NewXDB()
+	invalidReceipt := `{
+		"retailer": "Target!",
+		"purchaseDate": "2022-01-01",
+		"purchaseTime": "25:00",
+		"items": [{"shortDescription": "Gatorade"}],
+		"total": "2.25"
+	}`
+
+	tests := []struct {
+		query          string
+		body           string
+		expectedStatus int
+		expectedFields []string
+	}{
+		{"?verbose=true", targetReceipt, http.StatusCreated, nil},
+		{
+			"?verbose=true",
+			invalidReceipt,
+			http.StatusBadRequest,
+			[]string{"retailer", "purchaseTime", "items[0].price"},
+		},
+		{"", invalidReceipt, http.StatusBadRequest, nil},
+		{"?verbose=false", invalidReceipt, http.StatusBadRequest, nil},
+		{"?verbose=lots", targetReceipt, http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			receiptsSubresourceHandler(),
+			http.MethodPost,
+			"/receipts/process"+test.query,
+			test.body,
+		)
+		var body ErrorResponseBody
+		var fields []string
+
+		if recorder.Code != http.StatusCreated {
+			err := json.Unmarshal(recorder.Body.Bytes(), &body)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, fieldError := range body.Errors {
+			fields = append(fields, fieldError.Field)
+		}
+
+		if recorder.Code != test.expectedStatus ||
+			!slices.Equal(fields, test.expectedFields) {
+			t.Errorf(
+				"%s: responded with %d: %s",
+				test.query,
+				recorder.Code,
+				recorder.Body,
+			)
+		}
+	}
+}
+
+// Fails every write of a response body, as when the client has gone away
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *failingResponseWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestResponseBodyErrors(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+
+	// Marshalling fails before anything is written, so there's still time
+	// for a 500
+	recorder := httptest.NewRecorder()
+	err := writeJSON(recorder, http.StatusOK, math.NaN(), false)
+	var startedError responseStartedError
+
+	if err == nil || errors.As(err, &startedError) {
+		t.Fatalf("marshalling NaN returned error %v", err)
+	}
+
+	writeResponseBodyError(recorder, err, "The points could not be written.")
+
+	if recorder.Code != http.StatusInternalServerError ||
+		testErrorCode(t, recorder) != "INTERNAL_ERROR" {
+		t.Errorf("responded with %d: %s", recorder.Code, recorder.Body)
+	}
+
+	// Writing fails after the status has been sent, so it's only logged
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+	w := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(w, httptest.NewRequest(
+		http.MethodGet,
+		"/receipts/"+receiptId+"/points",
+		nil,
+	))
+
+	if w.Code != http.StatusOK || w.writes != 1 {
+		t.Errorf("responded with %d after %d writes", w.Code, w.writes)
+	}
+
+	if !strings.Contains(logs.String(), "connection reset by peer") {
+		t.Errorf("logged %q", logs.String())
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	defer func(pretty bool) {
+		prettyJSONResponses = pretty
+	}(prettyJSONResponses)
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+	pointsPath := "/receipts/" + receiptId + "/points"
+
+	tests := []struct {
+		method         string
+		path           string
+		body           string
+		prettyResponse bool
+		expectedPretty bool
+	}{
+		{http.MethodGet, pointsPath, "", false, false},
+		{http.MethodGet, pointsPath + "?pretty=true", "", false, true},
+		{http.MethodGet, pointsPath + "?pretty=false", "", false, false},
+		{http.MethodGet, pointsPath + "?pretty=lots", "", false, false},
+		{http.MethodGet, pointsPath, "", true, true},
+		{http.MethodGet, pointsPath + "?pretty=false", "", true, true},
+		{http.MethodPost, "/receipts/process", targetReceipt, false, false},
+		{
+			http.MethodPost,
+			"/receipts/process?pretty=true",
+			targetReceipt,
+			false,
+			true,
+		},
+		{
+			http.MethodGet,
+			pointsPath + "/breakdown?pretty=true",
+			"",
+			false,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		prettyJSONResponses = test.prettyResponse
+		recorder := serveTestRequest(handler, test.method, test.path, test.body)
+		body := recorder.Body.Bytes()
+		var compacted bytes.Buffer
+		err := json.Compact(&compacted, body)
+		pretty := bytes.Contains(body, []byte("\n  \""))
+
+		if err != nil ||
+			pretty != test.expectedPretty ||
+			!pretty && bytes.Contains(body, []byte("\n")) {
+			t.Errorf(
+				"%s %s with PRETTY_JSON %t: responded with %q",
+				test.method,
+				test.path,
+				test.prettyResponse,
+				body,
+			)
+		}
+	}
+}
+
+func TestHeadPoints(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := []struct {
+		receiptId      string
+		expectedStatus int
+	}{
+		{receiptId, http.StatusOK},
+		{"00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+		{"a.b", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		response, err := http.Head(
+			server.URL + "/receipts/" + test.receiptId + "/points",
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		if err != nil ||
+			response.StatusCode != test.expectedStatus ||
+			len(body) > 0 {
+			t.Errorf(
+				"%s: responded with %d: %q",
+				test.receiptId,
+				response.StatusCode,
+				body,
+			)
+		}
+
+		contentType := response.Header.Get("Content-Type")
+
+		if contentType != "application/json" {
+			t.Errorf(
+				"%s: responded with Content-Type %q",
+				test.receiptId,
+				contentType,
+			)
+		}
+	}
+
+	// The same as a GET but for the body
+	recorder := serveTestRequest(
+		handler,
+		http.MethodHead,
+		"/receipts/"+receiptId+"/points",
+		"",
+	)
+
+	if recorder.Header().Get("ETag") == "" {
+		t.Error("responded without an ETag")
+	}
+}
+
+func TestAsyncProcessing(t *testing.T) {
+	defer func(original *processingQueue) {
+		processing = original
+	}(processing)
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	// Without workers, receipts stay pending until one is started
+	processing = newProcessingQueue(1, 0)
+	defer close(processing.receiptIds)
+
+	getStatus := func(receiptId string) string {
+		t.Helper()
+		recorder := serveTestRequest(
+			handler,
+			http.MethodGet,
+			"/receipts/"+receiptId+"/status",
+			"",
+		)
+		var body ReceiptStatusResponseBody
+		err := json.Unmarshal(recorder.Body.Bytes(), &body)
+
+		if err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf(
+				"status responded with %d: %s",
+				recorder.Code,
+				recorder.Body,
+			)
+		}
+
+		return body.Status
+	}
+
+	recorder := serveTestRequest(
+		handler,
+		http.MethodPost,
+		"/receipts/process",
+		targetReceipt,
+	)
+	var body ProcessReceiptsResponseBody
+	err := json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	if err != nil || recorder.Code != http.StatusAccepted {
+		t.Fatalf(
+			"processing responded with %d: %s",
+			recorder.Code,
+			recorder.Body,
+		)
+	}
+
+	pendingId := body.ReceiptId
+
+	if status := getStatus(pendingId); status != "pending" {
+		t.Errorf("%s is %s before it's computed", pendingId, status)
+	}
+
+	pointsPath := "/receipts/" + pendingId + "/points"
+	recorder = serveTestRequest(handler, http.MethodGet, pointsPath, "")
+
+	if recorder.Code != http.StatusAccepted ||
+		testErrorCode(t, recorder) != "RECEIPT_PENDING" ||
+		recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("points responded with %d: %s", recorder.Code, recorder.Body)
+	}
+
+	// The queue is full, so the next receipt is computed on first lookup
+	// like it would be without the queue
+	recorder = serveTestRequest(
+		handler,
+		http.MethodPost,
+		"/receipts/process",
+		cornerMarketReceipt,
+	)
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("processing responded with %d once full", recorder.Code)
+	}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := getStatus(body.ReceiptId); status != "done" {
+		t.Errorf("%s is %s without being enqueued", body.ReceiptId, status)
+	}
+
+	points := getTestReceiptPoints(t, handler, body.ReceiptId)
+
+	if points != cornerMarketReceiptPoints {
+		t.Errorf(
+			"%s was awarded %d points without being enqueued",
+			body.ReceiptId,
+			points,
+		)
+	}
+
+	go processing.work()
+	deadline := time.Now().Add(5 * time.Second)
+
+	for getStatus(pendingId) == "pending" {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is still pending", pendingId)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if points := getTestReceiptPoints(t, handler, pendingId); points != 28 {
+		t.Errorf("%s was awarded %d points once done", pendingId, points)
+	}
+
+	missingPath := "/receipts/00000000-0000-0000-0000-000000000000/status"
+	recorder = serveTestRequest(handler, http.MethodGet, missingPath, "")
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status of a missing receipt responded with %d", recorder.Code)
+	}
+}
+
+func TestValidateReceipt(t *testing.T) {
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		name            string
+		body            string
+		expectedStatus  int
+		expectedReceipt string
+		expectedFields  []string
+	}{
+		{"canonical", targetReceipt, http.StatusOK, "", nil},
+		{
+			"normalized",
+			`{
+				"retailer": "Target",
+				"purchaseDate": "2022-01-01",
+				"purchaseTime": "13:01",
+				"items": [{"shortDescription": "  Gatorade ", "price": 2.5}],
+				"total": 2.5
+			}`,
+			http.StatusOK,
+			`{"retailer":"Target","purchaseDate":"2022-01-01",` +
+				`"purchaseTime":"13:01","items":[{"shortDescription":` +
+				`"Gatorade","price":"2.50"}],"total":"2.50"}`,
+			nil,
+		},
+		{
+			"invalid",
+			`{
+				"retailer": "Target!",
+				"purchaseDate": "2022-01-01",
+				"purchaseTime": "13:01",
+				"items": [],
+				"total": "2.50"
+			}`,
+			http.StatusOK,
+			"",
+			[]string{"retailer", "items"},
+		},
+		{"not JSON", "receipt", http.StatusOK, "", []string{""}},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(
+			handler,
+			http.MethodPost,
+			"/receipts/validate",
+			test.body,
+		)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d: %s",
+				test.name,
+				recorder.Code,
+				recorder.Body,
+			)
+			continue
+		}
+
+		var body struct {
+			Valid   bool                 `json:"valid"`
+			Receipt json.RawMessage      `json:"receipt"`
+			Errors  []receipt.FieldError `json:"errors"`
+		}
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		var fields []string
+
+		for _, fieldError := range body.Errors {
+			fields = append(fields, fieldError.Field)
+		}
+
+		if body.Valid != (test.expectedFields == nil) ||
+			!slices.Equal(fields, test.expectedFields) ||
+			body.Valid == (body.Receipt == nil) {
+			t.Errorf("%s: responded with %s", test.name, recorder.Body)
+		}
+
+		if test.expectedReceipt != "" &&
+			string(body.Receipt) != test.expectedReceipt {
+			t.Errorf(
+				"%s: normalized the receipt to %s, expected %s",
+				test.name,
+				body.Receipt,
+				test.expectedReceipt,
+			)
+		}
+	}
+
+	recorder := serveTestRequest(
+		handler,
+		http.MethodGet,
+		"/receipts/validate",
+		"",
+	)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("a GET responded with %d", recorder.Code)
+	}
+
+	// Nothing is stored
+	if count, err := db.count(); err != nil || count != 0 {
+		t.Errorf("stored %d receipts with error %v", count, err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	defer func(original *webhookNotifier) { webhook = original }(webhook)
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	payloads := make(chan WebhookPayload, 10)
+	var attempts int
+	var mu sync.Mutex
+
+	target := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			attempts++
+			failing := attempts == 1
+			mu.Unlock()
+
+			// The first notification is retried
+			if failing {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			var payload WebhookPayload
+			err := json.NewDecoder(r.Body).Decode(&payload)
+
+			if err != nil ||
+				r.Method != http.MethodPost ||
+				r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("notified with %s: %v", r.Method, err)
+			}
+
+			payloads <- payload
+		},
+	))
+	defer target.Close()
+
+	webhook = newWebhookNotifier(target.URL, time.Second, 1, 10)
+	defer close(webhook.receiptIds)
+
+	// Receipts that aren't processed aren't notified
+	recorder := serveTestRequest(
+		handler,
+		http.MethodPost,
+		"/receipts/process",
+		`{"retailer": "Target!"}`,
+	)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("processing responded with %d", recorder.Code)
+	}
+
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+
+	select {
+	case payload := <-payloads:
+		expected := WebhookPayload{
+			ReceiptId: receiptId,
+			Points:    targetReceiptPoints,
+			Retailer:  "Target",
+		}
+
+		if payload != expected {
+			t.Errorf("notified %+v, expected %+v", payload, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't notified")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if attempts != 2 {
+		t.Errorf("the webhook was notified after %d attempts", attempts)
+	}
+}
+
+func TestReceiptVersion(t *testing.T) {
+	r, err := decodeReceipt(1, []byte(targetReceipt))
+
+	if err != nil || r.Retailer != "Target" || len(r.Items) != 5 {
+		t.Errorf("decoded version 1 as %+v with error %v", r, err)
+	}
+
+	if _, err := decodeReceipt(2, []byte(targetReceipt)); err == nil {
+		t.Error("decoded version 2")
+	}
+
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+
+	tests := []struct {
+		query          string
+		header         string
+		expectedStatus int
+	}{
+		{"", "", http.StatusCreated},
+		{"?version=1", "", http.StatusCreated},
+		{"", "1", http.StatusCreated},
+		{"?version=1", "2", http.StatusCreated},
+		{"?version=2", "", http.StatusBadRequest},
+		{"", "2", http.StatusBadRequest},
+		{"", "v1", http.StatusBadRequest},
+		{"?version=2", "1", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(
+			http.MethodPost,
+			"/receipts/process"+test.query,
+			strings.NewReader(targetReceipt),
+		)
+		request.Header.Set("Content-Type", "application/json")
+
+		if test.header != "" {
+			request.Header.Set(receiptVersionHeader, test.header)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%q with %s %q: responded with %d",
+				test.query,
+				receiptVersionHeader,
+				test.header,
+				recorder.Code,
+			)
+			continue
+		}
+
+		if recorder.Code == http.StatusBadRequest {
+			code := testErrorCode(t, recorder)
+
+			if code != "UNSUPPORTED_RECEIPT_VERSION" {
+				t.Errorf("%q: responded with code %q", test.query, code)
+			}
+		}
+	}
+}
+
+func TestHealthPath(t *testing.T) {
+	defer func(path string) { healthPath = path }(healthPath)
+	healthPath = "/healthz"
+	db = NewXDB()
+	stop := make(chan struct{})
+	defer close(stop)
+	mux := defineResources(stop)
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+	}{
+		{"/healthz", http.StatusOK},
+		{"/healthz/detailed", http.StatusOK},
+		{"/health", http.StatusNotFound},
+		{"/health/detailed", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(mux, http.MethodGet, test.path, "")
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s: responded with %d, expected %d",
+				test.path,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		}
+
+		if recorder.Code == http.StatusNotFound &&
+			testErrorCode(t, recorder) != "NOT_FOUND" {
+			t.Errorf("%s: responded with %s", test.path, recorder.Body)
+		}
+	}
+}
+
+// Probes keep getting through from a client that's over the rate limit
+func TestHealthIsNotRateLimited(t *testing.T) {
+	defer func(rate float64, burst int64) {
+		rateLimit = rate
+		rateLimitBurst = burst
+	}(rateLimit, rateLimitBurst)
+	rateLimit = 0.001
+	rateLimitBurst = 1
+	db = NewXDB()
+	stop := make(chan struct{})
+	defer close(stop)
+	mux := defineResources(stop)
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+	}{
+		{"/version", http.StatusOK},
+		{"/version", http.StatusTooManyRequests},
+		{"/health", http.StatusOK},
+		{"/health/detailed", http.StatusOK},
+		{"/health", http.StatusOK},
+	}
+
+	for index, test := range tests {
+		recorder := serveTestRequest(mux, http.MethodGet, test.path, "")
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"request %d to %s responded with %d, expected %d",
+				index,
+				test.path,
+				recorder.Code,
+				test.expectedStatus,
+			)
+		}
+	}
+}
+
+func TestShedUnderMemoryPressure(t *testing.T) {
+	defer memoryPressure.Store(false)
+	db = NewXDB()
+	handler := receiptsSubresourceHandler()
+	receiptId := processTestReceipt(t, handler, targetReceipt)
+	memoryPressure.Store(true)
+
+	tests := []struct {
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			http.MethodPost,
+			"/receipts/process",
+			targetReceipt,
+			http.StatusServiceUnavailable,
+		},
+		{
+			http.MethodPost,
+			"/receipts/process/batch",
+			"[" + targetReceipt + "]",
+			http.StatusServiceUnavailable,
+		},
+		{
+			http.MethodPost,
+			"/receipts/process/stream",
+			targetReceipt,
+			http.StatusServiceUnavailable,
+		},
+		{
+			http.MethodGet,
+			"/receipts/" + receiptId + "/points",
+			"",
+			http.StatusOK,
+		},
+		{http.MethodGet, "/receipts/" + receiptId, "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(handler, test.method, test.path, test.body)
+
+		if recorder.Code != test.expectedStatus {
+			t.Errorf(
+				"%s %s: responded with %d, expected %d",
+				test.method,
+				test.path,
+				recorder.Code,
+				test.expectedStatus,
+			)
+			continue
+		}
+
+		if recorder.Code == http.StatusServiceUnavailable &&
+			(testErrorCode(t, recorder) != "MEMORY_PRESSURE" ||
+				recorder.Header().Get("Retry-After") == "") {
+			t.Errorf(
+				"%s %s: responded with %s",
+				test.method,
+				test.path,
+				recorder.Body,
+			)
+		}
+	}
+
+	// Receipts are taken again once the heap is back under the watermark
+	memoryPressure.Store(false)
+	processTestReceipt(t, handler, cornerMarketReceipt)
+}
+
+// Paths that no route matches fall through to the page at "/", which only
+// serves exactly "/"
+func TestUnknownRoutesAreNotFound(t *testing.T) {
+	db = NewXDB()
+	stop := make(chan struct{})
+	defer close(stop)
+	mux := defineResources(stop)
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/foo"},
+		{http.MethodPost, "/foo"},
+		{http.MethodGet, "/foo/bar"},
+		{http.MethodGet, "/receipt"},
+		{http.MethodGet, "/healthcheck"},
+		{http.MethodDelete, "/ui/index.html"},
+	}
+
+	for _, test := range tests {
+		recorder := serveTestRequest(mux, test.method, test.path, "")
+		var body ErrorResponseBody
+		err := json.Unmarshal(recorder.Body.Bytes(), &body)
+
+		if err != nil ||
+			recorder.Code != http.StatusNotFound ||
+			recorder.Header().Get("Content-Type") != "application/json" ||
+			body.Code != "NOT_FOUND" ||
+			body.Error == "" ||
+			body.RequestId == "" {
+			t.Errorf(
+				"%s %s: responded with %d: %s",
+				test.method,
+				test.path,
+				recorder.Code,
+				recorder.Body,
+			)
+		}
+	}
+}
@@ -0,0 +1,898 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go-fetch/receipt"
+
+	"github.com/google/uuid"
+	// Registers the "sqlite3" driver. It needs cgo, without which opening a
+	// database fails
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//  ____   ___  _     ___ _____ _____
+// / ___| / _ \| |   |_ _|_   _| ____|
+// \___ \| | | | |    | |  | | |  _|
+//  ___) | |_| | |___ | |  | | | |___
+// |____/ \__\_\_____|___| |_| |_____|
+//
+
+// Keeps receipts in a SQLite database through database/sql
+type sqliteStore struct {
+	DB *sql.DB
+	// Guards stopEviction
+	Mu sync.Mutex
+	// Closed to stop the eviction goroutine, nil when it isn't running
+	stopEviction chan struct{}
+}
+
+// Creation dates are stored as Unix nanoseconds so that they sort in order.
+// The breakdown and item points are stored as JSON along with the points, so
+// that they always agree, whatever the rules in effect when the row is read
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS receipts (
+		id TEXT PRIMARY KEY,
+		retailer TEXT NOT NULL,
+		points INTEGER NOT NULL,
+		receipt TEXT NOT NULL,
+		creation_date INTEGER NOT NULL,
+		idempotency_key TEXT UNIQUE,
+		version INTEGER NOT NULL DEFAULT 0,
+		breakdown TEXT,
+		item_points TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS receipts_retailer ON receipts (retailer)`,
+	`CREATE INDEX IF NOT EXISTS receipts_creation_date
+		ON receipts (creation_date, id)`,
+}
+
+// The columns scanned by scanSQLiteRow, in order
+const sqliteRowColumns = "id, receipt, creation_date, idempotency_key, " +
+	"version, points, breakdown, item_points"
+
+// Implemented by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	ExecContext(
+		ctx context.Context,
+		query string,
+		args ...any,
+	) (sql.Result, error)
+}
+
+// Implemented by both *sql.Row and *sql.Rows
+type sqlScanner interface {
+	Scan(dest ...any) error
+}
+
+// Opens the database with the given data source name, like "receipts.db",
+// creating the receipts table if it doesn't exist yet
+func newSQLiteStore(dsn string) (*sqliteStore, error) {
+	if dsn == "" {
+		return nil, errors.New("STORAGE_DSN must be set")
+	}
+
+	database, err := sql.Open("sqlite3", dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, statement := range sqliteSchema {
+		if _, err := database.Exec(statement); err != nil {
+			database.Close()
+			return nil, err
+		}
+	}
+
+	// Databases created before rows were versioned, or before breakdowns or
+	// item points were stored, have a receipts table without those columns,
+	// which CREATE TABLE IF NOT EXISTS leaves as it is
+	columns := []struct {
+		name       string
+		definition string
+	}{
+		{"version", "INTEGER NOT NULL DEFAULT 0"},
+		{"breakdown", "TEXT"},
+		{"item_points", "TEXT"},
+	}
+
+	for _, column := range columns {
+		err := addSQLiteColumn(database, column.name, column.definition)
+
+		if err != nil {
+			database.Close()
+			return nil, err
+		}
+	}
+
+	return &sqliteStore{DB: database}, nil
+}
+
+// Adds the column to the receipts table unless it already has it
+func addSQLiteColumn(database *sql.DB, name string, definition string) error {
+	var columns int
+	err := database.QueryRow(
+		"SELECT COUNT(*) FROM pragma_table_info('receipts') WHERE name = ?",
+		name,
+	).Scan(&columns)
+
+	if err != nil || columns > 0 {
+		return err
+	}
+
+	_, err = database.Exec(
+		"ALTER TABLE receipts ADD COLUMN " + name + " " + definition,
+	)
+	return err
+}
+
+func (store *sqliteStore) writeReceipt(
+	ctx context.Context,
+	r receipt.Receipt,
+) (string, error) {
+	row, err := newReceiptRow(r, uuid.NewString())
+
+	if err != nil {
+		return "", err
+	}
+
+	// The points column is what receipts are listed with, so unlike xDB the
+	// points have to be computed up front
+	row.computePoints()
+	_, err = insertSQLiteRow(ctx, store.DB, row)
+
+	return row.ReceiptId, err
+}
+
+// Writes the receipt unless one was already written with the given
+// idempotency key, in which case the ID of that receipt is returned instead.
+// The returned bool is true when it was a replay
+func (store *sqliteStore) writeReceiptIdempotent(
+	ctx context.Context,
+	key string,
+	r receipt.Receipt,
+) (string, bool, error) {
+	receiptId, err := store.getReceiptIdByIdempotencyKey(ctx, key)
+
+	if err != nil || receiptId != "" {
+		return receiptId, receiptId != "", err
+	}
+
+	row, err := newReceiptRow(r, uuid.NewString())
+
+	if err != nil {
+		return "", false, err
+	}
+
+	row.IdempotencyKey = key
+	row.computePoints()
+	result, err := insertSQLiteRow(ctx, store.DB, row)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	inserted, err := result.RowsAffected()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	// Another request with the same key was written in between the lookup
+	// and the insert, so this one is a replay of it after all
+	if inserted == 0 {
+		receiptId, err = store.getReceiptIdByIdempotencyKey(ctx, key)
+		return receiptId, true, err
+	}
+
+	return row.ReceiptId, false, nil
+}
+
+// Returns an empty ID when no receipt was written with the given key
+func (store *sqliteStore) getReceiptIdByIdempotencyKey(
+	ctx context.Context,
+	key string,
+) (string, error) {
+	var receiptId string
+	err := store.DB.QueryRowContext(
+		ctx,
+		"SELECT id FROM receipts WHERE idempotency_key = ?",
+		key,
+	).Scan(&receiptId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return receiptId, err
+}
+
+// Rows whose idempotency key was already used by another row aren't inserted,
+// which the caller can tell from the number of rows affected
+func insertSQLiteRow(
+	ctx context.Context,
+	execer sqlExecer,
+	row ReceiptRow,
+) (sql.Result, error) {
+	receiptJSON, err := json.Marshal(row.Receipt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	breakdownJSON, err := json.Marshal(row.Breakdown)
+
+	if err != nil {
+		return nil, err
+	}
+
+	itemPointsJSON, err := json.Marshal(row.ItemPoints)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return execer.ExecContext(
+		ctx,
+		`INSERT INTO receipts (
+				id,
+				retailer,
+				points,
+				receipt,
+				creation_date,
+				idempotency_key,
+				version,
+				breakdown,
+				item_points
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (idempotency_key) DO NOTHING`,
+		row.ReceiptId,
+		string(row.Retailer),
+		row.Points,
+		string(receiptJSON),
+		row.CreationDate.UnixNano(),
+		sql.NullString{
+			String: row.IdempotencyKey,
+			Valid:  row.IdempotencyKey != "",
+		},
+		row.Version,
+		string(breakdownJSON),
+		string(itemPointsJSON),
+	)
+}
+
+// Scans a row selected with sqliteRowColumns, with the points, breakdown and
+// item points it was stored with. Rows stored before breakdowns were have them
+// all computed from the receipt instead, until they're recomputed, and rows
+// stored before item points were have only those computed
+func scanSQLiteRow(scanner sqlScanner) (ReceiptRow, error) {
+	var row ReceiptRow
+	var receiptJSON string
+	var creationDate int64
+	var idempotencyKey sql.NullString
+	var breakdownJSON sql.NullString
+	var itemPointsJSON sql.NullString
+	err := scanner.Scan(
+		&row.ReceiptId,
+		&receiptJSON,
+		&creationDate,
+		&idempotencyKey,
+		&row.Version,
+		&row.Points,
+		&breakdownJSON,
+		&itemPointsJSON,
+	)
+
+	if err != nil {
+		return ReceiptRow{}, err
+	}
+
+	if err := json.Unmarshal([]byte(receiptJSON), &row.Receipt); err != nil {
+		return ReceiptRow{}, err
+	}
+
+	row.CreationDate = time.Unix(0, creationDate).UTC()
+	row.IdempotencyKey = idempotencyKey.String
+
+	if !breakdownJSON.Valid {
+		row.computePoints()
+		return row, nil
+	}
+
+	err = json.Unmarshal([]byte(breakdownJSON.String), &row.Breakdown)
+
+	if err != nil {
+		return ReceiptRow{}, err
+	}
+
+	if !itemPointsJSON.Valid {
+		row.ItemPoints = row.Receipt.ComputeItemPoints(rules)
+	} else {
+		err = json.Unmarshal([]byte(itemPointsJSON.String), &row.ItemPoints)
+
+		if err != nil {
+			return ReceiptRow{}, err
+		}
+	}
+
+	row.Computed = true
+	return row, nil
+}
+
+func (store *sqliteStore) getReceiptRow(receiptId string) (ReceiptRow, error) {
+	row, err := scanSQLiteRow(store.DB.QueryRow(
+		"SELECT "+sqliteRowColumns+" FROM receipts WHERE id = ?",
+		receiptId,
+	))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReceiptRow{}, ErrNotFound
+	}
+
+	return row, err
+}
+
+func (store *sqliteStore) getReceiptPoints(
+	ctx context.Context,
+	receiptId string,
+) (int64, error) {
+	var points int64
+	err := store.DB.QueryRowContext(
+		ctx,
+		"SELECT points FROM receipts WHERE id = ?",
+		receiptId,
+	).Scan(&points)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+
+	return points, err
+}
+
+func (store *sqliteStore) getReceiptsPoints(
+	ctx context.Context,
+	receiptIds []string,
+) (map[string]int64, error) {
+	pointsByReceiptId := make(map[string]int64, len(receiptIds))
+
+	if len(receiptIds) == 0 {
+		return pointsByReceiptId, nil
+	}
+
+	placeholders := strings.Repeat("?, ", len(receiptIds)-1) + "?"
+	args := make([]any, len(receiptIds))
+
+	for index, receiptId := range receiptIds {
+		args[index] = receiptId
+	}
+
+	rows, err := store.DB.QueryContext(
+		ctx,
+		"SELECT id, points FROM receipts WHERE id IN ("+placeholders+")",
+		args...,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var receiptId string
+		var points int64
+
+		if err := rows.Scan(&receiptId, &points); err != nil {
+			return nil, err
+		}
+
+		pointsByReceiptId[receiptId] = points
+	}
+
+	return pointsByReceiptId, rows.Err()
+}
+
+// Rows are always stored with their points computed
+func (store *sqliteStore) getComputedReceiptRow(
+	receiptId string,
+) (ReceiptRow, error) {
+	return store.getReceiptRow(receiptId)
+}
+
+// Returns the requested page of the receipts matching the filter, sorted by
+// creation date and then ID, along with the total number of matching receipts
+func (store *sqliteStore) listReceipts(
+	filter ReceiptFilter,
+	limit int,
+	offset int,
+) ([]ReceiptSummary, int, error) {
+	var conditions []string
+	var args []any
+
+	if filter.Retailer != "" {
+		conditions = append(conditions, "retailer = ?")
+		args = append(args, filter.Retailer)
+	}
+
+	if filter.MinPoints > 0 {
+		conditions = append(conditions, "points >= ?")
+		args = append(args, filter.MinPoints)
+	}
+
+	where := ""
+
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	err := store.DB.QueryRow(
+		"SELECT COUNT(*) FROM receipts"+where,
+		args...,
+	).Scan(&total)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := store.DB.Query(
+		"SELECT id, points, creation_date FROM receipts"+where+
+			" ORDER BY creation_date, id LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+	summaries := make([]ReceiptSummary, 0, limit)
+
+	for rows.Next() {
+		var summary ReceiptSummary
+		var creationDate int64
+		err := rows.Scan(&summary.ReceiptId, &summary.Points, &creationDate)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		summary.CreationDate = time.Unix(0, creationDate).
+			UTC().
+			Format(time.RFC3339)
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, total, rows.Err()
+}
+
+// Only the retailers of the receipts of the rows are set, since that's all
+// the leaderboard shows. Ties are broken in the same order as rankedBefore
+func (store *sqliteStore) topReceipts(n int) ([]ReceiptRow, error) {
+	rows, err := store.DB.Query(
+		"SELECT id, retailer, points, creation_date FROM receipts"+
+			" ORDER BY points DESC, creation_date, id LIMIT ?",
+		n,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	receiptRows := make([]ReceiptRow, 0, n)
+
+	for rows.Next() {
+		var row ReceiptRow
+		var creationDate int64
+		err := rows.Scan(
+			&row.ReceiptId,
+			&row.Receipt.Retailer,
+			&row.Points,
+			&creationDate,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		row.CreationDate = time.Unix(0, creationDate).UTC()
+		row.Computed = true
+		receiptRows = append(receiptRows, row)
+	}
+
+	return receiptRows, rows.Err()
+}
+
+func (store *sqliteStore) stats() (ReceiptStats, error) {
+	stats := ReceiptStats{ReceiptsByRetailer: make(map[string]int)}
+	err := store.DB.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(points), 0), COALESCE(MIN(points), 0),
+			COALESCE(MAX(points), 0) FROM receipts`,
+	).Scan(
+		&stats.Receipts,
+		&stats.TotalPoints,
+		&stats.MinPoints,
+		&stats.MaxPoints,
+	)
+
+	if err != nil {
+		return ReceiptStats{}, err
+	}
+
+	if stats.Receipts > 0 {
+		stats.AveragePoints = float64(stats.TotalPoints) /
+			float64(stats.Receipts)
+	}
+
+	rows, err := store.DB.Query(
+		"SELECT retailer, COUNT(*) FROM receipts GROUP BY retailer",
+	)
+
+	if err != nil {
+		return ReceiptStats{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var retailer string
+		var count int
+
+		if err := rows.Scan(&retailer, &count); err != nil {
+			return ReceiptStats{}, err
+		}
+
+		stats.ReceiptsByRetailer[retailer] = count
+	}
+
+	return stats, rows.Err()
+}
+
+func (store *sqliteStore) deleteReceipt(receiptId string) error {
+	result, err := store.DB.Exec(
+		"DELETE FROM receipts WHERE id = ?",
+		receiptId,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (store *sqliteStore) Ping(ctx context.Context) error {
+	return store.DB.PingContext(ctx)
+}
+
+func (store *sqliteStore) count() (int, error) {
+	var count int
+	err := store.DB.QueryRow("SELECT COUNT(*) FROM receipts").Scan(&count)
+
+	return count, err
+}
+
+// Writes every row as a JSON line, in the same format as xDB.export
+func (store *sqliteStore) export(writer io.Writer) error {
+	rows, err := store.DB.Query(
+		"SELECT " + sqliteRowColumns +
+			" FROM receipts ORDER BY creation_date, id",
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	encoder := json.NewEncoder(writer)
+
+	for rows.Next() {
+		row, err := scanSQLiteRow(rows)
+
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Replaces every row with the rows of an export in a single transaction, so
+// that nothing is replaced unless every row can be read and inserted.
+// Returns the number of rows imported
+func (store *sqliteStore) importRows(reader io.Reader) (int, error) {
+	rows, err := readReceiptRows(reader)
+
+	if err != nil {
+		return 0, err
+	}
+
+	transaction, err := store.DB.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Does nothing once the transaction has been committed
+	defer transaction.Rollback()
+
+	if _, err := transaction.Exec("DELETE FROM receipts"); err != nil {
+		return 0, err
+	}
+
+	for _, row := range rows {
+		if !row.Computed {
+			row.computePoints()
+		}
+
+		_, err := insertSQLiteRow(context.Background(), transaction, row)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(rows), transaction.Commit()
+}
+
+// Recomputes the points column of every row under the given rules, reading
+// a batch of rows at a time in order of ID. Rows may be changed in between
+// reading and updating them, in which case they're recomputed from their
+// latest version. Returns the number of rows recomputed
+func (store *sqliteStore) recomputeAllPoints(
+	cfg receipt.RuleConfig,
+) (int, error) {
+	recomputed := 0
+	lastReceiptId := ""
+
+	for {
+		rows, err := store.getReceiptRowsAfter(
+			lastReceiptId,
+			recomputeBatchSize,
+		)
+
+		if err != nil || len(rows) == 0 {
+			return recomputed, err
+		}
+
+		batchRecomputed, err := recomputeRows(store, rows, cfg)
+		recomputed += batchRecomputed
+
+		if err != nil {
+			return recomputed, err
+		}
+
+		lastReceiptId = rows[len(rows)-1].ReceiptId
+	}
+}
+
+// Returns up to limit rows whose IDs come after the given one, in order of ID
+func (store *sqliteStore) getReceiptRowsAfter(
+	afterReceiptId string,
+	limit int,
+) ([]ReceiptRow, error) {
+	rows, err := store.DB.Query(
+		"SELECT "+sqliteRowColumns+
+			" FROM receipts WHERE id > ? ORDER BY id LIMIT ?",
+		afterReceiptId,
+		limit,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var receiptRows []ReceiptRow
+
+	for rows.Next() {
+		row, err := scanSQLiteRow(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		receiptRows = append(receiptRows, row)
+	}
+
+	return receiptRows, rows.Err()
+}
+
+func (store *sqliteStore) recomputeReceipt(
+	receiptId string,
+	cfg receipt.RuleConfig,
+) (int64, error) {
+	return recomputeStoredReceipt(store, receiptId, cfg)
+}
+
+// Only the points, breakdown and item points are updated, since receipts
+// themselves are only ever changed by updateReceipt
+func (store *sqliteStore) updateReceiptRow(row ReceiptRow) error {
+	breakdownJSON, err := json.Marshal(row.Breakdown)
+
+	if err != nil {
+		return err
+	}
+
+	itemPointsJSON, err := json.Marshal(row.ItemPoints)
+
+	if err != nil {
+		return err
+	}
+
+	result, err := store.DB.Exec(
+		`UPDATE receipts
+			SET points = ?, breakdown = ?, item_points = ?,
+				version = version + 1
+			WHERE id = ? AND version = ?`,
+		row.Points,
+		string(breakdownJSON),
+		string(itemPointsJSON),
+		row.ReceiptId,
+		row.Version,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		return ErrConflict
+	}
+
+	return nil
+}
+
+// Patches the row as it was read, and reads it again to patch it once more when
+// it was changed in between, like recomputeRow
+func (store *sqliteStore) updateReceipt(
+	receiptId string,
+	patch map[string]json.RawMessage,
+) (int64, error) {
+	for attempt := 1; ; attempt++ {
+		row, err := store.getReceiptRow(receiptId)
+
+		if err != nil {
+			return 0, err
+		}
+
+		row.Receipt, err = patchReceipt(row.Receipt, patch)
+
+		if err != nil {
+			return 0, err
+		}
+
+		row.computePoints()
+		receiptJSON, err := json.Marshal(row.Receipt)
+
+		if err != nil {
+			return 0, err
+		}
+
+		breakdownJSON, err := json.Marshal(row.Breakdown)
+
+		if err != nil {
+			return 0, err
+		}
+
+		itemPointsJSON, err := json.Marshal(row.ItemPoints)
+
+		if err != nil {
+			return 0, err
+		}
+
+		result, err := store.DB.Exec(
+			`UPDATE receipts
+				SET retailer = ?, points = ?, breakdown = ?, item_points = ?,
+					receipt = ?, version = version + 1
+				WHERE id = ? AND version = ?`,
+			string(row.Retailer),
+			row.Points,
+			string(breakdownJSON),
+			string(itemPointsJSON),
+			string(receiptJSON),
+			row.ReceiptId,
+			row.Version,
+		)
+
+		if err != nil {
+			return 0, err
+		}
+
+		updated, err := result.RowsAffected()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if updated > 0 {
+			return row.Points, nil
+		}
+
+		if attempt == maxUpdateAttempts {
+			return 0, ErrConflict
+		}
+	}
+}
+
+// Deletes every receipt created more than ttl ago every interval, until Stop
+// is called
+func (store *sqliteStore) StartEviction(
+	ttl time.Duration,
+	interval time.Duration,
+) {
+	store.Mu.Lock()
+	defer store.Mu.Unlock()
+
+	if store.stopEviction != nil {
+		return
+	}
+
+	store.stopEviction = make(chan struct{})
+	go runEviction(
+		store.evictExpiredReceipts,
+		ttl,
+		interval,
+		store.stopEviction,
+	)
+}
+
+func (store *sqliteStore) Stop() {
+	store.Mu.Lock()
+	defer store.Mu.Unlock()
+
+	if store.stopEviction != nil {
+		close(store.stopEviction)
+		store.stopEviction = nil
+	}
+}
+
+// Returns the number of receipts deleted
+func (store *sqliteStore) evictExpiredReceipts(
+	ttl time.Duration,
+) (int, error) {
+	cutoff := time.Now().UTC().Add(-ttl)
+	result, err := store.DB.Exec(
+		"DELETE FROM receipts WHERE creation_date < ?",
+		cutoff.UnixNano(),
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	evicted, err := result.RowsAffected()
+
+	return int(evicted), err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSQLiteStore(t *testing.T) *sqliteStore {
+	t.Helper()
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "receipts.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(store.Stop)
+	return store
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	newStore := func(t *testing.T) Storage { return newTestSQLiteStore(t) }
+	testStorage(t, newStore)
+	testStorageCancellation(t, newStore)
+	testStorageVersioning(t, newStore)
+}
+
+// Changing the rules mustn't change what a stored row reads back as, until
+// it's recomputed
+func TestSQLiteRowKeepsStoredBreakdown(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	receiptId, err := store.writeReceipt(
+		ctx,
+		unmarshalTestReceipt(t, cornerMarketReceipt),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalRules := rules
+	t.Cleanup(func() { rules = originalRules })
+	rules.RoundDollarPoints = 0
+
+	row, err := store.getReceiptRow(receiptId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row.Points != cornerMarketReceiptPoints {
+		t.Errorf(
+			"row has %d points, expected %d",
+			row.Points,
+			cornerMarketReceiptPoints,
+		)
+	}
+
+	if total := row.Breakdown.Total(); total != row.Points {
+		t.Errorf("breakdown totals %d, but the row has %d", total, row.Points)
+	}
+
+	points, err := store.recomputeReceipt(receiptId, rules)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err = store.getReceiptRow(receiptId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if points != cornerMarketReceiptPoints-50 || row.Points != points {
+		t.Errorf("recomputed %d points, row has %d", points, row.Points)
+	}
+
+	if total := row.Breakdown.Total(); total != row.Points {
+		t.Errorf("breakdown totals %d, but the row has %d", total, row.Points)
+	}
+}